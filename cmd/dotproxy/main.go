@@ -4,7 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
+	"dotproxy/internal/dns"
 	"dotproxy/internal/log"
 	"dotproxy/internal/meta"
 	"dotproxy/internal/metrics"
@@ -62,6 +64,7 @@ func main() {
 	clientCxIOHook := metrics.NewNoopConnectionIOHook()
 	upstreamCxIOHook := metrics.NewNoopConnectionIOHook()
 	proxyHook := metrics.NewNoopProxyHook()
+	healthCheckHook := metrics.NewNoopHealthCheckHook()
 
 	if config.Metrics != nil && config.Metrics.Statsd != nil {
 		logger.Info(
@@ -113,67 +116,154 @@ func main() {
 		); err != nil {
 			panic(err)
 		}
+
+		if healthCheckHook, err = metrics.NewAsyncStatsdHealthCheckHook(
+			config.Metrics.Statsd.Address,
+			config.Metrics.Statsd.SampleRate,
+			meta.VersionSHA,
+		); err != nil {
+			panic(err)
+		}
 	} else {
 		logger.Warn("main: no metrics output engine specified; disabling metrics")
 	}
 
-	// Configure upstreams
-	var servers []network.Client
-	for _, server := range config.Upstream.Servers {
-		opts := network.TLSClientOpts{
-			ConnectTimeout:   server.ConnectTimeout,
-			HandshakeTimeout: server.HandshakeTimeout,
-			ReadTimeout:      server.ReadTimeout,
-			WriteTimeout:     server.WriteTimeout,
-			PoolOpts: network.PersistentConnPoolOpts{
-				Capacity:     server.ConnectionPoolSize,
-				StaleTimeout: server.StaleTimeout,
-			},
-		}
+	// Configure bootstrap resolution of upstream server hostnames
+	var resolver *network.BootstrapResolver
+	var resolvingOpts network.ResolvingClientOpts
 
+	if bootstrap := config.Upstream.Bootstrap; bootstrap != nil {
 		logger.Info(
-			"main: starting TLS client for upstream server: addr=%s name=%s conns=%d",
-			server.Address,
-			server.ServerName,
-			opts.PoolOpts.Capacity,
+			"main: configuring bootstrap resolver: servers=%v resolve_interval=%v",
+			bootstrap.Servers,
+			bootstrap.ResolveInterval,
 		)
 
-		client, err := network.NewTLSClient(
-			server.Address,
-			server.ServerName,
+		resolver, err = network.NewBootstrapResolver(
+			bootstrap.Servers,
 			upstreamCxLifecycleHook,
-			opts,
+			network.BootstrapResolverOpts{Timeout: bootstrap.Timeout},
 		)
-
 		if err != nil {
 			panic(err)
 		}
 
-		servers = append(servers, client)
+		resolvingOpts = network.ResolvingClientOpts{
+			ResolveInterval: bootstrap.ResolveInterval,
+			MaxDialFailures: bootstrap.MaxDialFailures,
+		}
 	}
 
-	// Create sharded client for all upstreams
-	lbPolicy, ok := network.ParseLoadBalancingPolicy(config.Upstream.LoadBalancingPolicy)
-	if !ok {
-		logger.Warn(
-			"main: unknown load balancing policy; use default: supplied=%s default=%s",
-			config.Upstream.LoadBalancingPolicy,
-			lbPolicy,
+	// Configure upstreams
+	shardingOpts := network.ShardedClientOpts{
+		FailureBackoff:    config.Upstream.FailureBackoff,
+		MaxFailureBackoff: config.Upstream.MaxFailureBackoff,
+	}
+
+	client := newUpstreamClient(
+		config.Upstream.Servers,
+		config.Upstream.LoadBalancingPolicy,
+		shardingOpts,
+		resolver,
+		resolvingOpts,
+		upstreamCxLifecycleHook,
+		healthCheckHook,
+		logger,
+	)
+
+	var routes *protocol.RoutingTable
+
+	if len(config.Upstream.Groups) > 0 {
+		routes = protocol.NewRoutingTable(client)
+
+		for _, group := range config.Upstream.Groups {
+			logger.Info(
+				"main: configuring upstream group: name=%s domains=%v",
+				group.Name,
+				group.Domains,
+			)
+
+			groupClient := newUpstreamClient(
+				group.Servers,
+				group.LoadBalancingPolicy,
+				shardingOpts,
+				resolver,
+				resolvingOpts,
+				upstreamCxLifecycleHook,
+				healthCheckHook,
+				logger,
+			)
+
+			for _, domain := range group.Domains {
+				routes.Add(domain, groupClient)
+			}
+		}
+	}
+
+	// Configure response caching
+	var cache *protocol.ResponseCache
+	var staleClientTimeout time.Duration
+
+	if config.Cache != nil {
+		logger.Info(
+			"main: configuring response cache: max_size=%d max_ttl=%v stale_window=%v",
+			config.Cache.MaxSize,
+			config.Cache.MaxTTL,
+			config.Cache.StaleWindow,
 		)
+
+		cache = protocol.NewResponseCache(protocol.ResponseCacheOpts{
+			MaxSize:           config.Cache.MaxSize,
+			MaxTTL:            config.Cache.MaxTTL,
+			MaxNegativeTTL:    config.Cache.MaxNegativeTTL,
+			StaleWindow:       config.Cache.StaleWindow,
+			StaleTTL:          config.Cache.StaleTTL,
+			PrefetchThreshold: config.Cache.PrefetchThreshold,
+			PrefetchMinHits:   config.Cache.PrefetchMinHits,
+		})
+		staleClientTimeout = config.Cache.StaleClientTimeout
 	}
 
-	logger.Debug("main: using load balancing policy for request sharding: policy=%s", lbPolicy)
-	client, _ := network.NewShardedClient(servers, lbPolicy)
+	// Configure request hedging
+	var hedge *protocol.HedgePolicy
+
+	if config.Upstream.HedgeDelay > 0 || config.Upstream.HedgePercentile > 0 {
+		logger.Info(
+			"main: configuring upstream request hedging: delay=%v percentile=%v",
+			config.Upstream.HedgeDelay,
+			config.Upstream.HedgePercentile,
+		)
+
+		hedge = protocol.NewHedgePolicy(protocol.HedgePolicyOpts{
+			Delay:      config.Upstream.HedgeDelay,
+			Percentile: config.Upstream.HedgePercentile,
+		})
+	}
+
+	retry := protocol.NewRetryPolicy(protocol.RetryPolicyOpts{
+		MaxRetries:     config.Upstream.MaxConnectionRetries,
+		Deadline:       config.Upstream.RequestTimeout,
+		InitialBackoff: config.Upstream.RetryBackoff,
+		MaxBackoff:     config.Upstream.MaxRetryBackoff,
+	})
+
+	failureResponse, _ := protocol.ParseFailureResponse(config.Upstream.FailureResponse)
+	logger.Debug("main: using upstream failure response: response=%s", failureResponse)
 
 	// Configure server listeners
 	h := &protocol.DNSProxyHandler{
 		Upstream:         client,
+		Routes:           routes,
 		ClientCxIOHook:   clientCxIOHook,
 		UpstreamCxIOHook: upstreamCxIOHook,
 		ProxyHook:        proxyHook,
+		Cache:            cache,
+		Hedge:            hedge,
+		Retry:            retry,
 		Logger:           logger,
 		Opts: protocol.DNSProxyOpts{
-			MaxUpstreamRetries: config.Upstream.MaxConnectionRetries,
+			StaleClientTimeout: staleClientTimeout,
+			FailureResponse:    failureResponse,
 		},
 	}
 
@@ -206,8 +296,10 @@ func main() {
 		)
 
 		opts := network.TCPServerOpts{
-			ReadTimeout:  config.Listener.TCP.ReadTimeout,
-			WriteTimeout: config.Listener.TCP.WriteTimeout,
+			ReadTimeout:           config.Listener.TCP.ReadTimeout,
+			WriteTimeout:          config.Listener.TCP.WriteTimeout,
+			IdleTimeout:           config.Listener.TCP.IdleTimeout,
+			MaxConcurrentRequests: config.Listener.TCP.MaxConcurrentRequests,
 		}
 
 		tcpServer := network.NewTCPServer(
@@ -223,7 +315,370 @@ func main() {
 		}()
 	}
 
+	if config.Listener.TLS != nil {
+		logger.Info(
+			"main: configuring TLS server listener: addr=%s cert=%s",
+			config.Listener.TLS.Address,
+			config.Listener.TLS.CertFile,
+		)
+
+		opts := network.TLSServerOpts{
+			ReadTimeout:               config.Listener.TLS.ReadTimeout,
+			WriteTimeout:              config.Listener.TLS.WriteTimeout,
+			IdleTimeout:               config.Listener.TLS.IdleTimeout,
+			MaxConcurrentRequests:     config.Listener.TLS.MaxConcurrentRequests,
+			CertificateReloadInterval: config.Listener.TLS.CertificateReloadInterval,
+		}
+
+		tlsServer, err := network.NewTLSServer(
+			config.Listener.TLS.Address,
+			config.Listener.TLS.CertFile,
+			config.Listener.TLS.KeyFile,
+			clientCxLifecycleHook,
+			opts,
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		go func() {
+			if err := tlsServer.ListenAndServe(h); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	if config.Listener.HTTPS != nil {
+		logger.Info(
+			"main: configuring HTTPS server listener: addr=%s path=%s cert=%s",
+			config.Listener.HTTPS.Address,
+			config.Listener.HTTPS.Path,
+			config.Listener.HTTPS.CertFile,
+		)
+
+		opts := network.HTTPSServerOpts{
+			Path:                      config.Listener.HTTPS.Path,
+			ReadTimeout:               config.Listener.HTTPS.ReadTimeout,
+			WriteTimeout:              config.Listener.HTTPS.WriteTimeout,
+			IdleTimeout:               config.Listener.HTTPS.IdleTimeout,
+			CertificateReloadInterval: config.Listener.HTTPS.CertificateReloadInterval,
+		}
+
+		httpsServer, err := network.NewHTTPSServer(
+			config.Listener.HTTPS.Address,
+			config.Listener.HTTPS.CertFile,
+			config.Listener.HTTPS.KeyFile,
+			clientCxLifecycleHook,
+			opts,
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		go func() {
+			if err := httpsServer.ListenAndServe(h); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	if config.Listener.QUIC != nil {
+		logger.Info(
+			"main: configuring QUIC server listener: addr=%s cert=%s",
+			config.Listener.QUIC.Address,
+			config.Listener.QUIC.CertFile,
+		)
+
+		opts := network.QUICServerOpts{
+			ReadTimeout:               config.Listener.QUIC.ReadTimeout,
+			WriteTimeout:              config.Listener.QUIC.WriteTimeout,
+			IdleTimeout:               config.Listener.QUIC.IdleTimeout,
+			CertificateReloadInterval: config.Listener.QUIC.CertificateReloadInterval,
+		}
+
+		quicServer, err := network.NewQUICServer(
+			config.Listener.QUIC.Address,
+			config.Listener.QUIC.CertFile,
+			config.Listener.QUIC.KeyFile,
+			clientCxLifecycleHook,
+			opts,
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		go func() {
+			if err := quicServer.ListenAndServe(h); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
 	// Serve indefinitely
 	logger.Info("main: serving indefinitely")
 	<-make(chan bool)
 }
+
+// newUpstreamClient creates a client for each of the upstream servers, sharded among them with the
+// specified load balancing policy and options. If a bootstrap resolver is specified, servers
+// addressed by hostname are resolved through it, with a client for each resolved address sharded
+// with the same policy and options, and the hostnames of DNS-over-HTTPS servers are resolved
+// through it when connecting; otherwise, their hostnames are resolved by the system resolver when
+// connecting.
+func newUpstreamClient(servers []meta.UpstreamServer, policy string, shardingOpts network.ShardedClientOpts, resolver *network.BootstrapResolver, resolvingOpts network.ResolvingClientOpts, cxHook metrics.ConnectionLifecycleHook, healthHook metrics.HealthCheckHook, logger log.Logger) network.Client {
+	var clients []network.Client
+	var weights []int
+	var keys []string
+
+	lbPolicy, ok := network.ParseLoadBalancingPolicy(policy)
+	if !ok {
+		logger.Warn(
+			"main: unknown load balancing policy; use default: supplied=%s default=%s",
+			policy,
+			lbPolicy,
+		)
+	}
+
+	for _, server := range servers {
+		server := server
+
+		poolOpts := network.PersistentConnPoolOpts{
+			Capacity:     server.ConnectionPoolSize,
+			StaleTimeout: server.StaleTimeout,
+		}
+
+		rootCAs, err := network.LoadCertPool(server.CAFile)
+		if err != nil {
+			panic(err)
+		}
+
+		// The TLS hostname defaults to the hostname of the server's address.
+		serverName := server.ServerName
+		if serverName == "" {
+			serverName = server.Hostname()
+		}
+
+		// Creates a client for the server at the specified address, behind its health check and
+		// circuit breaker; for servers addressed by hostname, a client is created for each
+		// resolved address, each of which is health checked and tripped independently.
+		newClient := func(address string) (client network.Client, err error) {
+			switch server.Protocol {
+			case meta.UpstreamProtocolDoH:
+				opts := network.HTTPSClientOpts{
+					ConnectTimeout:   server.ConnectTimeout,
+					HandshakeTimeout: server.HandshakeTimeout,
+					ReadTimeout:      server.ReadTimeout,
+					WriteTimeout:     server.WriteTimeout,
+					RootCAs:          rootCAs,
+					PoolOpts:         poolOpts,
+					Resolver:         resolver,
+				}
+
+				logger.Info(
+					"main: starting HTTPS client for upstream server: url=%s conns=%d",
+					server.URL,
+					opts.PoolOpts.Capacity,
+				)
+
+				client, err = network.NewHTTPSClient(
+					server.URL,
+					server.ServerName,
+					cxHook,
+					opts,
+				)
+			case meta.UpstreamProtocolUDP:
+				opts := network.UDPClientOpts{
+					ConnectTimeout: server.ConnectTimeout,
+					ReadTimeout:    server.ReadTimeout,
+					WriteTimeout:   server.WriteTimeout,
+					PoolOpts:       poolOpts,
+				}
+
+				logger.Info("main: starting UDP client for upstream server: addr=%s", address)
+
+				client, err = network.NewUDPClient(address, cxHook, opts)
+			case meta.UpstreamProtocolTCP:
+				opts := network.TCPClientOpts{
+					ConnectTimeout: server.ConnectTimeout,
+					ReadTimeout:    server.ReadTimeout,
+					WriteTimeout:   server.WriteTimeout,
+					PoolOpts:       poolOpts,
+				}
+
+				logger.Info(
+					"main: starting TCP client for upstream server: addr=%s conns=%d",
+					address,
+					opts.PoolOpts.Capacity,
+				)
+
+				client, err = network.NewTCPClient(address, cxHook, opts)
+			case meta.UpstreamProtocolDoQ:
+				opts := network.QUICClientOpts{
+					ConnectTimeout:   server.ConnectTimeout,
+					HandshakeTimeout: server.HandshakeTimeout,
+					ReadTimeout:      server.ReadTimeout,
+					WriteTimeout:     server.WriteTimeout,
+					RootCAs:          rootCAs,
+					PoolOpts:         poolOpts,
+				}
+
+				logger.Info(
+					"main: starting QUIC client for upstream server: addr=%s name=%s sessions=%d",
+					address,
+					serverName,
+					opts.PoolOpts.Capacity,
+				)
+
+				client, err = network.NewQUICClient(
+					address,
+					serverName,
+					cxHook,
+					opts,
+				)
+			default:
+				opts := network.TLSClientOpts{
+					ConnectTimeout:   server.ConnectTimeout,
+					HandshakeTimeout: server.HandshakeTimeout,
+					ReadTimeout:      server.ReadTimeout,
+					WriteTimeout:     server.WriteTimeout,
+					Pipelining:       server.Pipelining,
+					RootCAs:          rootCAs,
+					PoolOpts:         poolOpts,
+				}
+
+				logger.Info(
+					"main: starting TLS client for upstream server: addr=%s name=%s conns=%d pipelining=%t",
+					address,
+					serverName,
+					opts.PoolOpts.Capacity,
+					opts.Pipelining,
+				)
+
+				client, err = network.NewTLSClient(
+					address,
+					serverName,
+					cxHook,
+					opts,
+				)
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			addr := address
+			if server.Protocol == meta.UpstreamProtocolDoH {
+				addr = server.URL
+			}
+
+			if check := server.HealthCheck; check != nil {
+				logger.Info(
+					"main: configuring upstream server health check: addr=%s interval=%v",
+					addr,
+					check.Interval,
+				)
+
+				queryType, _ := dns.ParseType(check.QueryType)
+
+				client, err = network.NewHealthCheckedClient(client, addr, healthHook, network.HealthCheckOpts{
+					Interval:           check.Interval,
+					Timeout:            check.Timeout,
+					MaxLatency:         check.MaxLatency,
+					QueryName:          check.QueryName,
+					QueryType:          queryType,
+					UnhealthyThreshold: check.UnhealthyThreshold,
+					HealthyThreshold:   check.HealthyThreshold,
+					OnChange: func(healthy bool, err error) {
+						if healthy {
+							logger.Info("main: upstream server is healthy: addr=%s", addr)
+						} else {
+							logger.Warn("main: upstream server is unhealthy: addr=%s err=%v", addr, err)
+						}
+					},
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			if breaker := server.CircuitBreaker; breaker != nil {
+				logger.Info(
+					"main: configuring upstream server circuit breaker: addr=%s error_threshold=%v",
+					addr,
+					breaker.ErrorThreshold,
+				)
+
+				client, err = network.NewCircuitBreakerClient(client, addr, healthHook, network.CircuitBreakerOpts{
+					ErrorThreshold:   breaker.ErrorThreshold,
+					Window:           breaker.Window,
+					MinRequests:      breaker.MinRequests,
+					OpenDuration:     breaker.OpenDuration,
+					MaxOpenDuration:  breaker.MaxOpenDuration,
+					HalfOpenRequests: breaker.HalfOpenRequests,
+					OnChange: func(state network.CircuitState) {
+						logger.Warn("main: upstream server circuit breaker changed state: addr=%s state=%s", addr, state)
+					},
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			return client, nil
+		}
+
+		var client network.Client
+
+		if resolver != nil && server.Hostname() != "" && server.Protocol != meta.UpstreamProtocolDoH {
+			logger.Info(
+				"main: resolving upstream server hostname through bootstrap servers: addr=%s",
+				server.Address,
+			)
+
+			opts := resolvingOpts
+			opts.ShardingOpts = shardingOpts
+			opts.OnResolve = func(addrs []string, err error) {
+				if err != nil {
+					logger.Warn("main: failed to re-resolve upstream server hostname: addr=%s err=%v", server.Address, err)
+				} else {
+					logger.Debug("main: re-resolved upstream server hostname: addr=%s resolved=%v", server.Address, addrs)
+				}
+			}
+
+			var resolving *network.ResolvingClient
+			if resolving, err = network.NewResolvingClient(server.Address, resolver, newClient, lbPolicy, opts); err == nil {
+				logger.Info(
+					"main: resolved upstream server hostname: addr=%s resolved=%v",
+					server.Address,
+					resolving.Addrs(),
+				)
+
+				client = resolving
+			}
+		} else {
+			client, err = newClient(server.Address)
+		}
+
+		if err != nil {
+			panic(err)
+		}
+
+		addr := server.Address
+		if server.Protocol == meta.UpstreamProtocolDoH {
+			addr = server.URL
+		}
+
+		clients = append(clients, client)
+		weights = append(weights, server.Weight)
+		keys = append(keys, addr)
+	}
+
+	// Create sharded client for all servers
+	logger.Debug("main: using load balancing policy for request sharding: policy=%s", lbPolicy)
+	shardingOpts.Weights = weights
+	shardingOpts.Keys = keys
+
+	client, _ := network.NewShardedClient(clients, lbPolicy, shardingOpts)
+
+	return client
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"dotproxy/internal/dns"
+)
+
+const (
+	// smokeTestEnv is the name of the environment variable that directs the test binary to run
+	// the proxy itself, so that it can be started as a subprocess.
+	smokeTestEnv = "DOTPROXY_SMOKE_TEST"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(smokeTestEnv) != "" {
+		main()
+		return
+	}
+
+	os.Exit(m.Run())
+}
+
+// startProxy runs the proxy in a subprocess with the specified arguments and environment, returning
+// the command and a function that reads its combined output so far.
+func startProxy(t *testing.T, env []string, args ...string) (*exec.Cmd, func() string) {
+	// The output is collected in a file, rather than a buffer, so that it can be read while the
+	// proxy is still running.
+	output, err := os.Create(filepath.Join(t.TempDir(), "output"))
+	if err != nil {
+		t.Fatalf("error creating output file: %v", err)
+	}
+	t.Cleanup(func() { output.Close() })
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(append(os.Environ(), smokeTestEnv+"=1"), env...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("error starting proxy: %v", err)
+	}
+
+	return cmd, func() string {
+		contents, _ := ioutil.ReadFile(output.Name())
+		return string(contents)
+	}
+}
+
+// freeAddr returns a loopback TCP address that is not currently in use.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening on loopback: %v", err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+// serveUpstream serves DNS over TCP on the listener, answering every query by echoing it with the
+// QR bit set.
+func serveUpstream(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			for {
+				var length uint16
+				if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+					return
+				}
+
+				frame := make([]byte, 2+int(length))
+				binary.BigEndian.PutUint16(frame, length)
+
+				if _, err := io.ReadFull(conn, frame[2:]); err != nil || length < dns.HeaderSize {
+					return
+				}
+
+				frame[4] |= 0x80
+
+				if _, err := conn.Write(frame); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestStartup(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening on loopback: %v", err)
+	}
+	defer upstream.Close()
+
+	go serveUpstream(upstream)
+
+	listenAddr := freeAddr(t)
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	config := fmt.Sprintf(`listener:
+  tcp:
+    addr: %s
+upstream:
+  servers:
+    - protocol: tcp
+      addr: %s
+`, listenAddr, upstream.Addr())
+
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+
+	cmd, output := startProxy(t, []string{"DOTPROXY_CONFIG=" + configPath})
+	defer cmd.Process.Kill()
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// Wait for the proxy to start listening, failing early if it exits instead.
+	var conn net.Conn
+
+	for deadline := time.Now().Add(10 * time.Second); conn == nil; {
+		select {
+		case err := <-exited:
+			t.Fatalf("proxy exited during startup: err=%v output=%s", err, output())
+		default:
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy did not start listening: output=%s", output())
+		}
+
+		if conn, err = net.Dial("tcp", listenAddr); err != nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	defer conn.Close()
+
+	query, err := dns.NewQuery(0x1234, "example.com", dns.TypeA)
+	if err != nil {
+		t.Fatalf("error creating query: %v", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := binary.Write(conn, binary.BigEndian, uint16(len(query))); err != nil {
+		t.Fatalf("error writing query: %v", err)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		t.Fatalf("error writing query: %v", err)
+	}
+
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+
+	resp := make([]byte, length)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+
+	msg, err := dns.Parse(resp)
+	if err != nil {
+		t.Fatalf("error parsing response: %v", err)
+	}
+
+	if msg.Header.ID != 0x1234 || !msg.Header.Response() || msg.Header.Rcode() != dns.RcodeSuccess {
+		t.Errorf("unexpected response: header=%+v", msg.Header)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	cmd, output := startProxy(t, nil, "-version")
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("error running proxy: err=%v output=%s", err, output())
+	}
+
+	if !strings.HasPrefix(output(), "dotproxy/") {
+		t.Errorf("unexpected version output: output=%s", output())
+	}
+}
@@ -5,6 +5,8 @@ go 1.15
 require (
 	github.com/certifi/gocertifi v0.0.0-20200922220541-2c3bb06c6054 // indirect
 	github.com/getsentry/raven-go v0.2.0
+	// Only linked with the doq build tag; this version panics at startup when built with Go 1.16 or newer.
+	github.com/lucas-clemente/quic-go v0.19.3
 	github.com/pkg/errors v0.9.1 // indirect
 	golang.org/x/lint v0.0.0-20201208152925-83fdc39ff7b5
 	golang.org/x/tools v0.1.0
@@ -0,0 +1,108 @@
+package data
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRUCache is a key-value store bounded by the total size of its values. When inserting a value
+// would exceed its capacity, the least recently used values are evicted to make room.
+type LRUCache struct {
+	capacity int
+	size     int
+	entries  map[string]*list.Element
+	order    *list.List
+	mutex    sync.Mutex
+}
+
+// lruEntry describes a single value in the LRU cache.
+type lruEntry struct {
+	key   string
+	value interface{}
+	size  int
+}
+
+// NewLRUCache creates a new LRU cache with the specified capacity, in arbitrary units of size
+// consistent with those used when setting values.
+func NewLRUCache(capacity int) *LRUCache {
+	return &LRUCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get retrieves the value for a key, marking it as the most recently used value. It returns a
+// boolean indicating whether the key exists in the cache.
+func (c *LRUCache) Get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+
+	return elem.Value.(*lruEntry).value, true
+}
+
+// Set inserts or replaces the value for a key, evicting least recently used values as necessary to
+// remain within capacity. It is considered an error to insert a value larger than the capacity of
+// the cache.
+func (c *LRUCache) Set(key string, value interface{}, size int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if size > c.capacity {
+		return false
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+
+	for c.size+size > c.capacity {
+		c.remove(c.order.Back())
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, size: size})
+	c.size += size
+
+	return true
+}
+
+// Delete removes the value for a key, if it exists.
+func (c *LRUCache) Delete(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// Len reads the current number of values in the cache.
+func (c *LRUCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.entries)
+}
+
+// Size reads the current total size of all values in the cache.
+func (c *LRUCache) Size() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.size
+}
+
+// remove removes a single element from the cache. The caller must hold the mutex.
+func (c *LRUCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*lruEntry)
+
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
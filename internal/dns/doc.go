@@ -0,0 +1,5 @@
+// Package dns contains minimal routines for parsing and manipulating DNS wire format messages. It is
+// deliberately limited to what the proxy needs to be selectively protocol-aware: reading headers,
+// questions, and resource record metadata, and rewriting fields in place. Resource record data is
+// otherwise treated as opaque.
+package dns
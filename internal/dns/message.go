@@ -0,0 +1,633 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Header describes the fixed-size header of a DNS message.
+type Header struct {
+	ID      uint16
+	Flags   uint16
+	QDCount uint16
+	ANCount uint16
+	NSCount uint16
+	ARCount uint16
+}
+
+// Question describes a single entry in the question section of a DNS message.
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// Resource describes the metadata of a single resource record. Its data is not parsed, but its
+// location within the message is retained so that the record can be rewritten in place.
+type Resource struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+
+	// Offsets within the message of the start of the record, the TTL field, and the record
+	// data, and the length of the record data.
+	offset      int
+	ttlOffset   int
+	rdataOffset int
+	rdataLength int
+}
+
+// Message is a parsed DNS message. It retains the raw message from which it was parsed.
+type Message struct {
+	Header     Header
+	Question   []Question
+	Answer     []Resource
+	Authority  []Resource
+	Additional []Resource
+
+	raw         []byte
+	questionEnd int
+}
+
+const (
+	// HeaderSize is the size of the fixed DNS message header.
+	HeaderSize = 12
+
+	// MinUDPSize is the maximum UDP payload size that any client is guaranteed to accept, per
+	// RFC 1035 section 2.3.4. Clients may advertise support for larger payloads with EDNS(0).
+	MinUDPSize = 512
+
+	// maxPointers bounds the number of compression pointers followed while reading a single
+	// name, guarding against pointer loops.
+	maxPointers = 64
+)
+
+// Header flag bits.
+const (
+	flagResponse           = 1 << 15
+	flagTruncated          = 1 << 9
+	flagRecursionDesired   = 1 << 8
+	flagRecursionAvailable = 1 << 7
+	flagCheckingDisabled   = 1 << 4
+	maskOpcode             = 0xf << 11
+	maskRcode              = 0xf
+)
+
+// Resource record types.
+const (
+	// TypeA is the resource record type of an IPv4 host address record.
+	TypeA uint16 = 1
+	// TypeNS is the resource record type of an authoritative name server record.
+	TypeNS uint16 = 2
+	// TypeSOA is the resource record type of a start of authority record.
+	TypeSOA uint16 = 6
+	// TypeTXT is the resource record type of a text record.
+	TypeTXT uint16 = 16
+	// TypeAAAA is the resource record type of an IPv6 host address record.
+	TypeAAAA uint16 = 28
+	// TypeOPT is the resource record type of an EDNS(0) pseudo-record.
+	TypeOPT uint16 = 41
+)
+
+// ClassINET is the Internet resource record class.
+const ClassINET uint16 = 1
+
+// Response codes.
+const (
+	// RcodeSuccess indicates that the query completed successfully.
+	RcodeSuccess = 0
+	// RcodeServerFailure indicates that the server was unable to process the query (SERVFAIL).
+	RcodeServerFailure = 2
+	// RcodeNameError indicates that the queried name does not exist (NXDOMAIN).
+	RcodeNameError = 3
+	// RcodeRefused indicates that the server refused to process the query (REFUSED).
+	RcodeRefused = 5
+)
+
+// Parse parses a DNS message from its wire format, excluding any stream transport length header.
+func Parse(msg []byte) (*Message, error) {
+	header, err := ParseHeader(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{Header: header, raw: msg}
+
+	off := HeaderSize
+
+	for i := 0; i < int(m.Header.QDCount); i++ {
+		name, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+
+		if next+4 > len(msg) {
+			return nil, fmt.Errorf("dns: truncated question: offset=%d", off)
+		}
+
+		m.Question = append(m.Question, Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[next : next+2]),
+			Class: binary.BigEndian.Uint16(msg[next+2 : next+4]),
+		})
+
+		off = next + 4
+	}
+
+	m.questionEnd = off
+
+	sections := []struct {
+		count    uint16
+		resource *[]Resource
+	}{
+		{m.Header.ANCount, &m.Answer},
+		{m.Header.NSCount, &m.Authority},
+		{m.Header.ARCount, &m.Additional},
+	}
+
+	for _, section := range sections {
+		for i := 0; i < int(section.count); i++ {
+			rr, next, err := readResource(msg, off)
+			if err != nil {
+				return nil, err
+			}
+
+			*section.resource = append(*section.resource, rr)
+			off = next
+		}
+	}
+
+	return m, nil
+}
+
+// ParseHeader parses only the fixed-size header of a DNS message.
+func ParseHeader(msg []byte) (Header, error) {
+	if len(msg) < HeaderSize {
+		return Header{}, fmt.Errorf("dns: message smaller than header: bytes=%d", len(msg))
+	}
+
+	return Header{
+		ID:      binary.BigEndian.Uint16(msg[0:2]),
+		Flags:   binary.BigEndian.Uint16(msg[2:4]),
+		QDCount: binary.BigEndian.Uint16(msg[4:6]),
+		ANCount: binary.BigEndian.Uint16(msg[6:8]),
+		NSCount: binary.BigEndian.Uint16(msg[8:10]),
+		ARCount: binary.BigEndian.Uint16(msg[10:12]),
+	}, nil
+}
+
+// NewErrorResponse creates a response to a raw request that carries no records and the specified
+// response code. The response echoes the request's message ID, opcode, RD and CD bits, and
+// question. Only the request's header and question are parsed, so that a response may be created
+// even if the remainder of the request is malformed.
+func NewErrorResponse(req []byte, rcode int) ([]byte, error) {
+	if len(req) < HeaderSize {
+		return nil, fmt.Errorf("dns: message smaller than header: bytes=%d", len(req))
+	}
+
+	reqFlags := binary.BigEndian.Uint16(req[2:4])
+	flags := flagResponse | flagRecursionAvailable | uint16(rcode&maskRcode) |
+		reqFlags&(maskOpcode|flagRecursionDesired|flagCheckingDisabled)
+
+	resp := make([]byte, HeaderSize, MinUDPSize)
+	copy(resp[0:2], req[0:2])
+	binary.BigEndian.PutUint16(resp[2:4], flags)
+
+	// Echo the first question only; multiple questions are not supported in practice. The
+	// question is re-encoded rather than copied, since its name may be compressed with pointers
+	// that are meaningless in the response.
+	if binary.BigEndian.Uint16(req[4:6]) > 0 {
+		name, next, err := readName(req, HeaderSize)
+		if err != nil {
+			return nil, err
+		}
+
+		if next+4 > len(req) {
+			return nil, fmt.Errorf("dns: truncated question: offset=%d", HeaderSize)
+		}
+
+		if resp, err = appendName(resp, name); err != nil {
+			return nil, err
+		}
+
+		resp = append(resp, req[next:next+4]...)
+		binary.BigEndian.PutUint16(resp[4:6], 1)
+	}
+
+	return resp, nil
+}
+
+// NewQuery creates a recursive query for a single question with the specified message ID, name,
+// and record type, in the Internet class.
+func NewQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, HeaderSize, HeaderSize+len(name)+6)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], flagRecursionDesired)
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+
+	msg, err := appendName(msg, name)
+	if err != nil {
+		return nil, err
+	}
+
+	msg = append(msg, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(msg[len(msg)-4:], qtype)
+	binary.BigEndian.PutUint16(msg[len(msg)-2:], ClassINET)
+
+	return msg, nil
+}
+
+// ParseType parses a resource record type from its mnemonic, e.g. "AAAA", in a case-insensitive
+// manner. Only the types with constants defined in this package are supported.
+func ParseType(mnemonic string) (uint16, bool) {
+	knownTypes := map[string]uint16{
+		"A":    TypeA,
+		"NS":   TypeNS,
+		"SOA":  TypeSOA,
+		"TXT":  TypeTXT,
+		"AAAA": TypeAAAA,
+	}
+
+	qtype, ok := knownTypes[strings.ToUpper(mnemonic)]
+
+	return qtype, ok
+}
+
+// Raw returns the raw message from which the message was parsed.
+func (m *Message) Raw() []byte {
+	return m.raw
+}
+
+// Response returns whether the message is a response.
+func (h Header) Response() bool {
+	return h.Flags&flagResponse != 0
+}
+
+// Truncated returns whether the message has the TC bit set.
+func (h Header) Truncated() bool {
+	return h.Flags&flagTruncated != 0
+}
+
+// CheckingDisabled returns whether the message has the CD bit set.
+func (h Header) CheckingDisabled() bool {
+	return h.Flags&flagCheckingDisabled != 0
+}
+
+// Opcode returns the kind of query described by the message.
+func (h Header) Opcode() int {
+	return int(h.Flags&maskOpcode) >> 11
+}
+
+// Rcode returns the response code of the message.
+func (h Header) Rcode() int {
+	return int(h.Flags & maskRcode)
+}
+
+// OPT returns the message's EDNS(0) pseudo-record, if present.
+func (m *Message) OPT() (Resource, bool) {
+	for _, rr := range m.Additional {
+		if rr.Type == TypeOPT {
+			return rr, true
+		}
+	}
+
+	return Resource{}, false
+}
+
+// DNSSECOK returns whether the message's EDNS(0) pseudo-record has the DO bit set.
+func (m *Message) DNSSECOK() bool {
+	opt, ok := m.OPT()
+
+	// For the OPT pseudo-record, the DO bit is the most significant bit of the flags carried in
+	// the lower half of the TTL field.
+	return ok && opt.TTL&0x8000 != 0
+}
+
+// MaxUDPSize returns the maximum UDP payload size the sender of the message is able to receive:
+// the size advertised in its EDNS(0) pseudo-record, or MinUDPSize if it advertises none.
+func (m *Message) MaxUDPSize() int {
+	// For the OPT pseudo-record, the class field carries the advertised payload size.
+	if opt, ok := m.OPT(); ok && int(opt.Class) > MinUDPSize {
+		return int(opt.Class)
+	}
+
+	return MinUDPSize
+}
+
+// Truncate returns a copy of the raw message with the TC bit set, reduced to its header, question,
+// and EDNS(0) pseudo-record, if the message exceeds the size limit. Otherwise, the raw message is
+// returned unmodified.
+func (m *Message) Truncate(limit int) []byte {
+	if len(m.raw) <= limit {
+		return m.raw
+	}
+
+	msg := make([]byte, m.questionEnd)
+	copy(msg, m.raw[:m.questionEnd])
+
+	binary.BigEndian.PutUint16(msg[6:8], 0)
+	binary.BigEndian.PutUint16(msg[8:10], 0)
+	binary.BigEndian.PutUint16(msg[10:12], 0)
+	SetTruncated(msg)
+
+	// Per RFC 6891 section 7, the OPT record should be retained in truncated responses.
+	if opt, ok := m.OPT(); ok {
+		optRaw := m.raw[opt.offset : opt.rdataOffset+opt.rdataLength]
+
+		if len(msg)+len(optRaw) <= limit {
+			msg = append(msg, optRaw...)
+			binary.BigEndian.PutUint16(msg[10:12], 1)
+		}
+	}
+
+	return msg
+}
+
+// MinTTL returns the minimum TTL among all records in the answer section. It returns false if the
+// answer section is empty.
+func (m *Message) MinTTL() (uint32, bool) {
+	var min uint32
+	found := false
+
+	for _, rr := range m.Answer {
+		if !found || rr.TTL < min {
+			min = rr.TTL
+			found = true
+		}
+	}
+
+	return min, found
+}
+
+// Addresses returns the IP addresses in the A and AAAA records of the answer section, in the
+// order in which they appear. Records of other types, e.g. CNAME records leading to the addresses,
+// are skipped.
+func (m *Message) Addresses() []net.IP {
+	var addrs []net.IP
+
+	for _, rr := range m.Answer {
+		if rr.Class != ClassINET {
+			continue
+		}
+
+		if (rr.Type == TypeA && rr.rdataLength == net.IPv4len) ||
+			(rr.Type == TypeAAAA && rr.rdataLength == net.IPv6len) {
+			addr := make(net.IP, rr.rdataLength)
+			copy(addr, m.raw[rr.rdataOffset:rr.rdataOffset+rr.rdataLength])
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// NegativeTTL returns the duration for which a negative response may be cached, per RFC 2308
+// section 5: the lesser of the TTL of the SOA record in the authority section and the SOA MINIMUM
+// field. It returns false if the authority section contains no SOA record.
+func (m *Message) NegativeTTL() (uint32, bool) {
+	for _, rr := range m.Authority {
+		if rr.Type != TypeSOA {
+			continue
+		}
+
+		// The SOA record data comprises two names followed by five 32-bit fields, of which
+		// MINIMUM is the last.
+		end := rr.rdataOffset + rr.rdataLength
+		if rr.rdataLength < 22 || end > len(m.raw) {
+			return 0, false
+		}
+
+		minimum := binary.BigEndian.Uint32(m.raw[end-4 : end])
+		if rr.TTL < minimum {
+			return rr.TTL, true
+		}
+
+		return minimum, true
+	}
+
+	return 0, false
+}
+
+// RewriteTTLs returns a copy of the raw message in which the TTL of every record, excluding the
+// EDNS(0) pseudo-record, is replaced with the result of the rewrite function.
+func (m *Message) RewriteTTLs(rewrite func(ttl uint32) uint32) []byte {
+	msg := make([]byte, len(m.raw))
+	copy(msg, m.raw)
+
+	for _, section := range [][]Resource{m.Answer, m.Authority, m.Additional} {
+		for _, rr := range section {
+			if rr.Type == TypeOPT {
+				continue
+			}
+
+			binary.BigEndian.PutUint32(msg[rr.ttlOffset:rr.ttlOffset+4], rewrite(rr.TTL))
+		}
+	}
+
+	return msg
+}
+
+// QuestionSection returns the raw question section of the message.
+func (m *Message) QuestionSection() []byte {
+	return m.raw[HeaderSize:m.questionEnd]
+}
+
+// SetID rewrites the message ID of a raw message in place.
+func SetID(msg []byte, id uint16) {
+	binary.BigEndian.PutUint16(msg[0:2], id)
+}
+
+// SetTruncated sets the TC bit of a raw message in place.
+func SetTruncated(msg []byte) {
+	binary.BigEndian.PutUint16(msg[2:4], binary.BigEndian.Uint16(msg[2:4])|flagTruncated)
+}
+
+// CanonicalName returns the canonical, case-insensitive representation of a name.
+func CanonicalName(name string) string {
+	return strings.ToLower(name)
+}
+
+// readName reads a possibly compressed name beginning at the specified offset. It returns the name
+// in presentation format and the offset immediately following the name as it appears at the
+// original offset. Dots and backslashes within labels are escaped as "\." and "\\", and
+// non-printable bytes as "\DDD", per RFC 4343 section 2.1, so that distinct names never share a
+// presentation format.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+
+	next := -1
+	pointers := 0
+
+	for {
+		if off >= len(msg) {
+			return "", 0, fmt.Errorf("dns: truncated name: offset=%d", off)
+		}
+
+		length := int(msg[off])
+
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+
+			return strings.Join(labels, ".") + ".", next, nil
+
+		case length&0xc0 == 0xc0:
+			if off+2 > len(msg) {
+				return "", 0, fmt.Errorf("dns: truncated name pointer: offset=%d", off)
+			}
+
+			if pointers++; pointers > maxPointers {
+				return "", 0, fmt.Errorf("dns: too many name compression pointers")
+			}
+
+			if next < 0 {
+				next = off + 2
+			}
+
+			off = int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3fff)
+
+		case length&0xc0 == 0:
+			if off+1+length > len(msg) {
+				return "", 0, fmt.Errorf("dns: truncated label: offset=%d", off)
+			}
+
+			labels = append(labels, escapeLabel(msg[off+1:off+1+length]))
+			off += 1 + length
+
+		default:
+			return "", 0, fmt.Errorf("dns: unsupported label type: offset=%d", off)
+		}
+	}
+}
+
+// escapeLabel returns the presentation format of a raw label.
+func escapeLabel(label []byte) string {
+	escaped := false
+	for _, c := range label {
+		escaped = escaped || c == '.' || c == '\\' || c <= ' ' || c >= 0x7f
+	}
+
+	if !escaped {
+		return string(label)
+	}
+
+	var b strings.Builder
+
+	for _, c := range label {
+		switch {
+		case c == '.' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c <= ' ' || c >= 0x7f:
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// appendName appends the uncompressed wire format of a name in presentation format to a message.
+// Escape sequences within the name, as produced by readName, are decoded.
+func appendName(msg []byte, name string) ([]byte, error) {
+	start := len(msg)
+
+	// The root name is a single empty label.
+	if name == "." {
+		name = ""
+	}
+
+	for off := 0; off < len(name); {
+		// Reserve the label's length octet, and fill it in once the label has been decoded.
+		lengthOffset := len(msg)
+		msg = append(msg, 0)
+
+		for ; off < len(name) && name[off] != '.'; off++ {
+			if name[off] != '\\' {
+				msg = append(msg, name[off])
+				continue
+			}
+
+			switch {
+			case off+3 < len(name) && isDigits(name[off+1:off+4]):
+				value := int(name[off+1]-'0')*100 + int(name[off+2]-'0')*10 + int(name[off+3]-'0')
+				if value > 0xff {
+					return nil, fmt.Errorf("dns: invalid escape sequence: name=%s", name)
+				}
+
+				msg = append(msg, byte(value))
+				off += 3
+
+			case off+1 < len(name):
+				msg = append(msg, name[off+1])
+				off++
+
+			default:
+				return nil, fmt.Errorf("dns: invalid escape sequence: name=%s", name)
+			}
+		}
+
+		length := len(msg) - lengthOffset - 1
+		if length == 0 || length > 63 {
+			return nil, fmt.Errorf("dns: invalid label length: name=%s", name)
+		}
+
+		msg[lengthOffset] = byte(length)
+
+		// Skip the dot terminating the label, if any.
+		off++
+	}
+
+	if len(msg)-start+1 > 255 {
+		return nil, fmt.Errorf("dns: name too long: name=%s", name)
+	}
+
+	return append(msg, 0), nil
+}
+
+// isDigits returns whether every character of the string is a decimal digit.
+func isDigits(s string) bool {
+	for idx := 0; idx < len(s); idx++ {
+		if s[idx] < '0' || s[idx] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// readResource reads the resource record beginning at the specified offset. It returns the record
+// and the offset immediately following it.
+func readResource(msg []byte, off int) (Resource, int, error) {
+	name, next, err := readName(msg, off)
+	if err != nil {
+		return Resource{}, 0, err
+	}
+
+	if next+10 > len(msg) {
+		return Resource{}, 0, fmt.Errorf("dns: truncated resource record: offset=%d", off)
+	}
+
+	rr := Resource{
+		Name:        name,
+		Type:        binary.BigEndian.Uint16(msg[next : next+2]),
+		Class:       binary.BigEndian.Uint16(msg[next+2 : next+4]),
+		TTL:         binary.BigEndian.Uint32(msg[next+4 : next+8]),
+		offset:      off,
+		ttlOffset:   next + 4,
+		rdataOffset: next + 10,
+		rdataLength: int(binary.BigEndian.Uint16(msg[next+8 : next+10])),
+	}
+
+	if rr.rdataOffset+rr.rdataLength > len(msg) {
+		return Resource{}, 0, fmt.Errorf("dns: truncated resource record data: offset=%d", off)
+	}
+
+	return rr, rr.rdataOffset + rr.rdataLength, nil
+}
@@ -0,0 +1,242 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testMessage assembles a raw message from a header and the concatenation of its remaining parts.
+func testMessage(id uint16, flags uint16, counts [4]uint16, parts ...[]byte) []byte {
+	msg := make([]byte, HeaderSize)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], flags)
+
+	for idx, count := range counts {
+		binary.BigEndian.PutUint16(msg[4+2*idx:6+2*idx], count)
+	}
+
+	for _, part := range parts {
+		msg = append(msg, part...)
+	}
+
+	return msg
+}
+
+func TestParseQuestionName(t *testing.T) {
+	typeClass := []byte{0, 1, 0, 1}
+
+	cases := []struct {
+		name string
+		// Question section, following the header
+		question []byte
+		expected string
+		err      bool
+	}{
+		{"root", []byte{0}, ".", false},
+		{"simple", []byte("\x03www\x06google\x03com\x00"), "www.google.com.", false},
+		{"mixed case", []byte("\x03WwW\x06GooGle\x03com\x00"), "WwW.GooGle.com.", false},
+		{"escaped dot", []byte("\x0awww.google\x03com\x00"), `www\.google.com.`, false},
+		{"escaped backslash", []byte("\x03a\\b\x03com\x00"), `a\\b.com.`, false},
+		{"non-printable", []byte("\x03a\x00b\x03com\x00"), `a\000b.com.`, false},
+		{"space", []byte("\x03a b\x03com\x00"), `a\032b.com.`, false},
+		{"high byte", []byte("\x02\xc3\xa9\x03com\x00"), `\195\169.com.`, false},
+		{"truncated label", []byte("\x05ab"), "", true},
+		{"truncated name", []byte("\x03com"), "", true},
+		{"pointer loop", []byte{0xc0, HeaderSize}, "", true},
+		{"pointer out of bounds", []byte{0xc0, 0xff}, "", true},
+		{"truncated pointer", []byte{0xc0}, "", true},
+		{"unsupported label type", []byte{0x40, 0}, "", true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			question := append(append([]byte(nil), tc.question...), typeClass...)
+
+			msg, err := Parse(testMessage(1, 0, [4]uint16{1, 0, 0, 0}, question))
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error parsing message: name=%s", msg.Question[0].Name)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("error parsing message: %v", err)
+			}
+
+			if msg.Question[0].Name != tc.expected {
+				t.Errorf(
+					"unexpected question name: name=%s expected=%s",
+					msg.Question[0].Name,
+					tc.expected,
+				)
+			}
+		})
+	}
+}
+
+func TestParseCompressedResource(t *testing.T) {
+	question := []byte("\x07example\x03com\x00\x00\x01\x00\x01")
+
+	// An A record for a subdomain of the question name, referring to it by a pointer.
+	answer := []byte("\x03www\xc0\x0c\x00\x01\x00\x01\x00\x00\x01\x2c\x00\x04\x7f\x00\x00\x01")
+
+	msg, err := Parse(testMessage(1, flagResponse, [4]uint16{1, 1, 0, 0}, question, answer))
+	if err != nil {
+		t.Fatalf("error parsing message: %v", err)
+	}
+
+	if len(msg.Answer) != 1 {
+		t.Fatalf("unexpected number of answers: answers=%d", len(msg.Answer))
+	}
+
+	rr := msg.Answer[0]
+	if rr.Name != "www.example.com." || rr.Type != TypeA || rr.TTL != 300 {
+		t.Errorf("unexpected answer: name=%s type=%d ttl=%d", rr.Name, rr.Type, rr.TTL)
+	}
+
+	if addrs := msg.Addresses(); len(addrs) != 1 || addrs[0].String() != "127.0.0.1" {
+		t.Errorf("unexpected addresses: addrs=%v", addrs)
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	cases := []struct {
+		name string
+		msg  []byte
+	}{
+		{"header", make([]byte, HeaderSize-1)},
+		{"question", testMessage(1, 0, [4]uint16{1, 0, 0, 0}, []byte("\x03com\x00\x00\x01"))},
+		{"missing question", testMessage(1, 0, [4]uint16{2, 0, 0, 0}, []byte("\x03com\x00\x00\x01\x00\x01"))},
+		{"resource", testMessage(1, 0, [4]uint16{0, 1, 0, 0}, []byte("\x00\x00\x01\x00\x01\x00\x00"))},
+		{"resource data", testMessage(1, 0, [4]uint16{0, 1, 0, 0}, []byte("\x00\x00\x01\x00\x01\x00\x00\x00\x00\x00\x04\x7f"))},
+	}
+
+	for _, tc := range cases {
+		if _, err := Parse(tc.msg); err == nil {
+			t.Errorf("expected error parsing truncated message: case=%s", tc.name)
+		}
+	}
+}
+
+func TestNewQueryRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		// Expected wire format of the name
+		wire []byte
+		err  bool
+	}{
+		{"example.com.", []byte("\x07example\x03com\x00"), false},
+		{"example.com", []byte("\x07example\x03com\x00"), false},
+		{".", []byte{0}, false},
+		{`www\.google.com.`, []byte("\x0awww.google\x03com\x00"), false},
+		{`a\\b.com.`, []byte("\x03a\\b\x03com\x00"), false},
+		{`a\000b.com.`, []byte("\x03a\x00b\x03com\x00"), false},
+		{`\195\169.com.`, []byte("\x02\xc3\xa9\x03com\x00"), false},
+		{"example..com.", nil, true},
+		{`a\256.com.`, nil, true},
+		{`com\`, nil, true},
+		{string(bytes.Repeat([]byte{'a'}, 64)) + ".com.", nil, true},
+		{string(bytes.Repeat([]byte("a."), 128)), nil, true},
+	}
+
+	for _, tc := range cases {
+		query, err := NewQuery(1, tc.name, TypeA)
+		if tc.err {
+			if err == nil {
+				t.Errorf("expected error creating query: name=%s", tc.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("error creating query: name=%s err=%v", tc.name, err)
+			continue
+		}
+
+		if wire := query[HeaderSize : len(query)-4]; !bytes.Equal(wire, tc.wire) {
+			t.Errorf("unexpected wire format: name=%s wire=%q expected=%q", tc.name, wire, tc.wire)
+		}
+
+		// Names read from the wire are encoded to the same wire format.
+		msg, err := Parse(query)
+		if err != nil {
+			t.Errorf("error parsing query: name=%s err=%v", tc.name, err)
+			continue
+		}
+
+		reencoded, err := appendName(nil, msg.Question[0].Name)
+		if err != nil || !bytes.Equal(reencoded, tc.wire) {
+			t.Errorf("name does not round trip: name=%s parsed=%s", tc.name, msg.Question[0].Name)
+		}
+	}
+}
+
+func TestNewErrorResponse(t *testing.T) {
+	question := []byte("\x03WwW\x07example\x03com\x00\x00\x1c\x00\x01")
+	flags := uint16(flagRecursionDesired | flagCheckingDisabled)
+
+	cases := []struct {
+		name string
+		req  []byte
+		// Question section expected in the response
+		question []byte
+	}{
+		{"question", testMessage(7, flags, [4]uint16{1, 0, 0, 0}, question), question},
+		{"no question", testMessage(7, flags, [4]uint16{}), nil},
+		{
+			"trailing garbage",
+			testMessage(7, flags, [4]uint16{1, 1, 0, 0}, question, []byte{0xff, 0xff}),
+			question,
+		},
+		{
+			// The name is a pointer to a copy of itself placed within the question section of a
+			// second question, which must not be carried over to the response.
+			"compressed question",
+			testMessage(
+				7,
+				flags,
+				[4]uint16{2, 0, 0, 0},
+				[]byte{0xc0, HeaderSize + 6, 0, 0x1c, 0, 1},
+				question,
+			),
+			question,
+		},
+	}
+
+	for _, tc := range cases {
+		resp, err := NewErrorResponse(tc.req, RcodeServerFailure)
+		if err != nil {
+			t.Errorf("error creating response: case=%s err=%v", tc.name, err)
+			continue
+		}
+
+		msg, err := Parse(resp)
+		if err != nil {
+			t.Errorf("error parsing response: case=%s err=%v", tc.name, err)
+			continue
+		}
+
+		if msg.Header.ID != 7 || !msg.Header.Response() || msg.Header.Rcode() != RcodeServerFailure {
+			t.Errorf("unexpected header: case=%s header=%+v", tc.name, msg.Header)
+		}
+
+		if !msg.Header.CheckingDisabled() || msg.Header.Flags&flagRecursionDesired == 0 {
+			t.Errorf("request flags not echoed: case=%s flags=%#x", tc.name, msg.Header.Flags)
+		}
+
+		if section := msg.QuestionSection(); !bytes.Equal(section, tc.question) {
+			t.Errorf("unexpected question: case=%s question=%q", tc.name, section)
+		}
+	}
+
+	truncated := testMessage(7, flags, [4]uint16{1, 0, 0, 0}, question[:6])
+	if _, err := NewErrorResponse(truncated, RcodeServerFailure); err == nil {
+		t.Error("expected error creating response to truncated question")
+	}
+}
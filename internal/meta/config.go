@@ -3,11 +3,29 @@ package meta
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
 
+	"dotproxy/internal/dns"
 	"dotproxy/internal/network"
+	"dotproxy/internal/protocol"
+)
+
+const (
+	// UpstreamProtocolDoT selects DNS-over-TLS for an upstream server. It is the default.
+	UpstreamProtocolDoT = "dot"
+	// UpstreamProtocolDoH selects DNS-over-HTTPS for an upstream server.
+	UpstreamProtocolDoH = "doh"
+	// UpstreamProtocolDoQ selects DNS-over-QUIC for an upstream server.
+	UpstreamProtocolDoQ = "doq"
+	// UpstreamProtocolUDP selects plaintext DNS over UDP, with TCP fallback, for an upstream
+	// server.
+	UpstreamProtocolUDP = "udp"
+	// UpstreamProtocolTCP selects plaintext DNS over TCP for an upstream server.
+	UpstreamProtocolTCP = "tcp"
 )
 
 // ApplicationConfig is a top-level block for application-level meta configuration.
@@ -26,9 +44,11 @@ type MetricsConfig struct {
 // ListenerConfig is a top-level block for server listener configuration.
 type ListenerConfig struct {
 	TCP *struct {
-		Address      string        `yaml:"addr"`
-		ReadTimeout  time.Duration `yaml:"read_timeout"`
-		WriteTimeout time.Duration `yaml:"write_timeout"`
+		Address               string        `yaml:"addr"`
+		ReadTimeout           time.Duration `yaml:"read_timeout"`
+		WriteTimeout          time.Duration `yaml:"write_timeout"`
+		IdleTimeout           time.Duration `yaml:"idle_timeout"`
+		MaxConcurrentRequests int           `yaml:"max_concurrent_requests"`
 	} `yaml:"tcp"`
 	UDP *struct {
 		Address                  string        `yaml:"addr"`
@@ -36,25 +56,112 @@ type ListenerConfig struct {
 		ReadTimeout              time.Duration `yaml:"read_timeout"`
 		WriteTimeout             time.Duration `yaml:"write_timeout"`
 	} `yaml:"udp"`
+	TLS *struct {
+		Address                   string        `yaml:"addr"`
+		CertFile                  string        `yaml:"cert_file"`
+		KeyFile                   string        `yaml:"key_file"`
+		CertificateReloadInterval time.Duration `yaml:"cert_reload_interval"`
+		ReadTimeout               time.Duration `yaml:"read_timeout"`
+		WriteTimeout              time.Duration `yaml:"write_timeout"`
+		IdleTimeout               time.Duration `yaml:"idle_timeout"`
+		MaxConcurrentRequests     int           `yaml:"max_concurrent_requests"`
+	} `yaml:"tls"`
+	HTTPS *struct {
+		Address                   string        `yaml:"addr"`
+		Path                      string        `yaml:"path"`
+		CertFile                  string        `yaml:"cert_file"`
+		KeyFile                   string        `yaml:"key_file"`
+		CertificateReloadInterval time.Duration `yaml:"cert_reload_interval"`
+		ReadTimeout               time.Duration `yaml:"read_timeout"`
+		WriteTimeout              time.Duration `yaml:"write_timeout"`
+		IdleTimeout               time.Duration `yaml:"idle_timeout"`
+	} `yaml:"https"`
+	QUIC *struct {
+		Address                   string        `yaml:"addr"`
+		CertFile                  string        `yaml:"cert_file"`
+		KeyFile                   string        `yaml:"key_file"`
+		CertificateReloadInterval time.Duration `yaml:"cert_reload_interval"`
+		ReadTimeout               time.Duration `yaml:"read_timeout"`
+		WriteTimeout              time.Duration `yaml:"write_timeout"`
+		IdleTimeout               time.Duration `yaml:"idle_timeout"`
+	} `yaml:"quic"`
+}
+
+// CacheConfig is a top-level block for response cache configuration.
+type CacheConfig struct {
+	MaxSize            int           `yaml:"max_size"`
+	MaxTTL             time.Duration `yaml:"max_ttl"`
+	MaxNegativeTTL     time.Duration `yaml:"max_negative_ttl"`
+	StaleWindow        time.Duration `yaml:"stale_window"`
+	StaleTTL           time.Duration `yaml:"stale_ttl"`
+	StaleClientTimeout time.Duration `yaml:"stale_client_timeout"`
+	PrefetchThreshold  float64       `yaml:"prefetch_threshold"`
+	PrefetchMinHits    int           `yaml:"prefetch_min_hits"`
 }
 
 // UpstreamServer describes parameters for a single upstream server.
 type UpstreamServer struct {
+	Protocol           string        `yaml:"protocol"`
 	Address            string        `yaml:"addr"`
+	URL                string        `yaml:"url"`
 	ServerName         string        `yaml:"server_name"`
+	CAFile             string        `yaml:"ca_file"`
+	Weight             int           `yaml:"weight"`
 	ConnectionPoolSize int           `yaml:"connection_pool_size"`
 	ConnectTimeout     time.Duration `yaml:"connect_timeout"`
 	HandshakeTimeout   time.Duration `yaml:"handshake_timeout"`
 	ReadTimeout        time.Duration `yaml:"read_timeout"`
 	WriteTimeout       time.Duration `yaml:"write_timeout"`
 	StaleTimeout       time.Duration `yaml:"stale_timeout"`
+	Pipelining         bool          `yaml:"pipelining"`
+	HealthCheck        *struct {
+		Interval           time.Duration `yaml:"interval"`
+		Timeout            time.Duration `yaml:"timeout"`
+		MaxLatency         time.Duration `yaml:"max_latency"`
+		QueryName          string        `yaml:"query_name"`
+		QueryType          string        `yaml:"query_type"`
+		UnhealthyThreshold int           `yaml:"unhealthy_threshold"`
+		HealthyThreshold   int           `yaml:"healthy_threshold"`
+	} `yaml:"health_check"`
+	CircuitBreaker *struct {
+		ErrorThreshold   float64       `yaml:"error_threshold"`
+		Window           time.Duration `yaml:"window"`
+		MinRequests      int           `yaml:"min_requests"`
+		OpenDuration     time.Duration `yaml:"open_duration"`
+		MaxOpenDuration  time.Duration `yaml:"max_open_duration"`
+		HalfOpenRequests int           `yaml:"half_open_requests"`
+	} `yaml:"circuit_breaker"`
+}
+
+// UpstreamGroup describes a named group of upstream servers to which queries for specific domains,
+// and their subdomains, are routed instead of to the top-level upstream servers.
+type UpstreamGroup struct {
+	Name                string           `yaml:"name"`
+	Domains             []string         `yaml:"domains"`
+	LoadBalancingPolicy string           `yaml:"load_balancing_policy"`
+	Servers             []UpstreamServer `yaml:"servers"`
 }
 
 // UpstreamConfig is a top-level block for upstream configuration.
 type UpstreamConfig struct {
 	LoadBalancingPolicy  string           `yaml:"load_balancing_policy"`
-	MaxConnectionRetries int              `yaml:"max_connection_retries"`
+	MaxConnectionRetries *int             `yaml:"max_connection_retries"`
+	RequestTimeout       time.Duration    `yaml:"request_timeout"`
+	RetryBackoff         time.Duration    `yaml:"retry_backoff"`
+	MaxRetryBackoff      time.Duration    `yaml:"max_retry_backoff"`
+	FailureBackoff       time.Duration    `yaml:"failure_backoff"`
+	MaxFailureBackoff    time.Duration    `yaml:"max_failure_backoff"`
+	FailureResponse      string           `yaml:"failure_response"`
+	HedgeDelay           time.Duration    `yaml:"hedge_delay"`
+	HedgePercentile      float64          `yaml:"hedge_percentile"`
 	Servers              []UpstreamServer `yaml:"servers"`
+	Groups               []UpstreamGroup  `yaml:"groups"`
+	Bootstrap            *struct {
+		Servers         []string      `yaml:"servers"`
+		Timeout         time.Duration `yaml:"timeout"`
+		ResolveInterval time.Duration `yaml:"resolve_interval"`
+		MaxDialFailures int           `yaml:"max_dial_failures"`
+	} `yaml:"bootstrap"`
 }
 
 // Config describes all application configuration options.
@@ -62,6 +169,7 @@ type Config struct {
 	Application *ApplicationConfig `yaml:"application"`
 	Metrics     *MetricsConfig     `yaml:"metrics"`
 	Listener    *ListenerConfig    `yaml:"listener"`
+	Cache       *CacheConfig       `yaml:"cache"`
 	Upstream    *UpstreamConfig    `yaml:"upstream"`
 }
 
@@ -105,8 +213,9 @@ func (c *Config) validate() error {
 		return fmt.Errorf("config: missing top-level listener config key")
 	}
 
-	if c.Listener.TCP == nil && c.Listener.UDP == nil {
-		return fmt.Errorf("config: at least one TCP or UDP listener must be specified")
+	if c.Listener.TCP == nil && c.Listener.UDP == nil && c.Listener.TLS == nil &&
+		c.Listener.HTTPS == nil && c.Listener.QUIC == nil {
+		return fmt.Errorf("config: at least one TCP, UDP, TLS, HTTPS, or QUIC listener must be specified")
 	}
 
 	if c.Listener.TCP != nil && c.Listener.TCP.Address == "" {
@@ -117,33 +226,291 @@ func (c *Config) validate() error {
 		return fmt.Errorf("config: missing UDP server listening address")
 	}
 
+	if c.Listener.TLS != nil {
+		if c.Listener.TLS.Address == "" {
+			return fmt.Errorf("config: missing TLS server listening address")
+		}
+
+		if c.Listener.TLS.CertFile == "" || c.Listener.TLS.KeyFile == "" {
+			return fmt.Errorf("config: missing TLS server certificate or key file")
+		}
+	}
+
+	if c.Listener.HTTPS != nil {
+		if c.Listener.HTTPS.Address == "" {
+			return fmt.Errorf("config: missing HTTPS server listening address")
+		}
+
+		if c.Listener.HTTPS.CertFile == "" || c.Listener.HTTPS.KeyFile == "" {
+			return fmt.Errorf("config: missing HTTPS server certificate or key file")
+		}
+
+		if c.Listener.HTTPS.Path != "" && !strings.HasPrefix(c.Listener.HTTPS.Path, "/") {
+			return fmt.Errorf("config: HTTPS server path must be absolute")
+		}
+	}
+
+	if c.Listener.QUIC != nil {
+		if c.Listener.QUIC.Address == "" {
+			return fmt.Errorf("config: missing QUIC server listening address")
+		}
+
+		if c.Listener.QUIC.CertFile == "" || c.Listener.QUIC.KeyFile == "" {
+			return fmt.Errorf("config: missing QUIC server certificate or key file")
+		}
+
+		if !network.QUICSupported {
+			return fmt.Errorf("config: DNS-over-QUIC support is not built; rebuild with the doq build tag")
+		}
+	}
+
+	/* Cache */
+
+	// Users can omit the cache block entirely to disable response caching.
+	if c.Cache != nil {
+		if c.Cache.MaxSize < 0 {
+			return fmt.Errorf("config: cache max size must be non-negative")
+		}
+
+		if c.Cache.MaxTTL < 0 || c.Cache.MaxNegativeTTL < 0 {
+			return fmt.Errorf("config: cache TTL limits must be non-negative")
+		}
+
+		if c.Cache.StaleWindow < 0 || c.Cache.StaleTTL < 0 || c.Cache.StaleClientTimeout < 0 {
+			return fmt.Errorf("config: cache stale durations must be non-negative")
+		}
+
+		if c.Cache.PrefetchThreshold < 0 || c.Cache.PrefetchThreshold > 1 {
+			return fmt.Errorf("config: cache prefetch threshold must be in range [0.0, 1.0]")
+		}
+	}
+
 	/* Upstream */
 
 	if c.Upstream == nil {
 		return fmt.Errorf("config: missing top-level upstream config key")
 	}
 
+	// Users can omit the bootstrap block entirely to resolve upstream server hostnames with the
+	// system resolver when connecting.
+	if c.Upstream.Bootstrap != nil {
+		if len(c.Upstream.Bootstrap.Servers) == 0 {
+			return fmt.Errorf("config: no bootstrap servers specified")
+		}
+
+		for idx, server := range c.Upstream.Bootstrap.Servers {
+			if host, _, err := net.SplitHostPort(server); err != nil || net.ParseIP(host) == nil {
+				return fmt.Errorf(
+					"config: bootstrap server address must be an IP address and port: idx=%d addr=%s",
+					idx,
+					server,
+				)
+			}
+		}
+
+		if c.Upstream.Bootstrap.Timeout < 0 || c.Upstream.Bootstrap.ResolveInterval < 0 {
+			return fmt.Errorf("config: bootstrap durations must be non-negative")
+		}
+
+		if c.Upstream.Bootstrap.MaxDialFailures < 0 {
+			return fmt.Errorf("config: bootstrap max dial failures must be non-negative")
+		}
+	}
+
+	if err := validateUpstreamServers(c.Upstream.LoadBalancingPolicy, c.Upstream.Servers); err != nil {
+		return err
+	}
+
+	// Validate the failure response, only if provided (empty signifies default).
+	if c.Upstream.FailureResponse != "" {
+		if _, ok := protocol.ParseFailureResponse(c.Upstream.FailureResponse); !ok {
+			return fmt.Errorf(
+				"config: unknown failure response: response=%s",
+				c.Upstream.FailureResponse,
+			)
+		}
+	}
+
+	if c.Upstream.HedgeDelay < 0 {
+		return fmt.Errorf("config: negative hedge delay: delay=%v", c.Upstream.HedgeDelay)
+	}
+
+	if c.Upstream.HedgePercentile < 0 || c.Upstream.HedgePercentile >= 100 {
+		return fmt.Errorf(
+			"config: hedge percentile must be between 0 and 100: percentile=%v",
+			c.Upstream.HedgePercentile,
+		)
+	}
+
+	if retries := c.Upstream.MaxConnectionRetries; retries != nil && *retries < 0 {
+		return fmt.Errorf("config: negative maximum connection retries: retries=%d", *retries)
+	}
+
+	if c.Upstream.RequestTimeout < 0 {
+		return fmt.Errorf("config: negative request timeout: timeout=%v", c.Upstream.RequestTimeout)
+	}
+
+	if c.Upstream.RetryBackoff < 0 || c.Upstream.MaxRetryBackoff < 0 {
+		return fmt.Errorf(
+			"config: negative retry backoff: backoff=%v max=%v",
+			c.Upstream.RetryBackoff,
+			c.Upstream.MaxRetryBackoff,
+		)
+	}
+
+	if c.Upstream.FailureBackoff < 0 || c.Upstream.MaxFailureBackoff < 0 {
+		return fmt.Errorf(
+			"config: negative failure backoff: backoff=%v max=%v",
+			c.Upstream.FailureBackoff,
+			c.Upstream.MaxFailureBackoff,
+		)
+	}
+
+	groups := make(map[string]bool)
+	domains := make(map[string]bool)
+
+	for _, group := range c.Upstream.Groups {
+		if group.Name == "" {
+			return fmt.Errorf("config: missing upstream group name")
+		}
+
+		if groups[group.Name] {
+			return fmt.Errorf("config: duplicate upstream group name: group=%s", group.Name)
+		}
+
+		groups[group.Name] = true
+
+		if len(group.Domains) == 0 {
+			return fmt.Errorf("config: no upstream group domains specified: group=%s", group.Name)
+		}
+
+		for _, domain := range group.Domains {
+			canonical := strings.ToLower(strings.TrimSuffix(domain, "."))
+			if domains[canonical] {
+				return fmt.Errorf(
+					"config: domain routed to multiple upstream groups: group=%s domain=%s",
+					group.Name,
+					domain,
+				)
+			}
+
+			domains[canonical] = true
+		}
+
+		if err := validateUpstreamServers(group.LoadBalancingPolicy, group.Servers); err != nil {
+			return fmt.Errorf("%v group=%s", err, group.Name)
+		}
+	}
+
+	return nil
+}
+
+// Hostname returns the hostname of the server's address, or an empty string if the address is
+// an IP address.
+func (s UpstreamServer) Hostname() string {
+	host, _, err := net.SplitHostPort(s.Address)
+	if err != nil || net.ParseIP(host) != nil {
+		return ""
+	}
+
+	return host
+}
+
+// validateUpstreamServers validates a load balancing policy and the servers among which it shards
+// requests.
+func validateUpstreamServers(policy string, servers []UpstreamServer) error {
 	// Validate the load balancing policy, only if provided (empty signifies default).
-	if c.Upstream.LoadBalancingPolicy != "" {
-		if _, ok := network.ParseLoadBalancingPolicy(c.Upstream.LoadBalancingPolicy); !ok {
+	lbPolicy := network.RoundRobin
+	if policy != "" {
+		var ok bool
+		if lbPolicy, ok = network.ParseLoadBalancingPolicy(policy); !ok {
 			return fmt.Errorf(
 				"config: unknown load balancing policy: policy=%s",
-				c.Upstream.LoadBalancingPolicy,
+				policy,
 			)
 		}
 	}
 
-	if len(c.Upstream.Servers) == 0 {
+	weighted := lbPolicy == network.WeightedRoundRobin || lbPolicy == network.WeightedRandom
+
+	if len(servers) == 0 {
 		return fmt.Errorf("config: no upstream servers specified")
 	}
 
-	for idx, server := range c.Upstream.Servers {
-		if server.Address == "" {
-			return fmt.Errorf("config: missing server address: idx=%d", idx)
+	for idx, server := range servers {
+		if server.Weight < 0 {
+			return fmt.Errorf("config: server weight must not be negative: idx=%d", idx)
+		}
+
+		if server.Weight > 0 && !weighted {
+			return fmt.Errorf(
+				"config: server weight requires a weighted load balancing policy: idx=%d policy=%s",
+				idx,
+				lbPolicy,
+			)
+		}
+
+		switch server.Protocol {
+		case "", UpstreamProtocolDoT, UpstreamProtocolDoQ:
+			if server.Address == "" {
+				return fmt.Errorf("config: missing server address: idx=%d", idx)
+			}
+
+			// The TLS hostname defaults to the hostname of the server's address.
+			if server.ServerName == "" && server.Hostname() == "" {
+				return fmt.Errorf("config: missing server TLS hostname: idx=%d", idx)
+			}
+
+			if server.Protocol == UpstreamProtocolDoQ && !network.QUICSupported {
+				return fmt.Errorf(
+					"config: DNS-over-QUIC support is not built; rebuild with the doq build tag: idx=%d",
+					idx,
+				)
+			}
+		case UpstreamProtocolUDP, UpstreamProtocolTCP:
+			if server.Address == "" {
+				return fmt.Errorf("config: missing server address: idx=%d", idx)
+			}
+		case UpstreamProtocolDoH:
+			if server.URL == "" {
+				return fmt.Errorf("config: missing DNS-over-HTTPS server URL: idx=%d", idx)
+			}
+
+			if !strings.HasPrefix(server.URL, "https://") {
+				return fmt.Errorf("config: DNS-over-HTTPS server URL must use https: idx=%d", idx)
+			}
+		default:
+			return fmt.Errorf(
+				"config: unknown upstream server protocol: idx=%d protocol=%s",
+				idx,
+				server.Protocol,
+			)
+		}
+
+		if check := server.HealthCheck; check != nil {
+			if check.Interval <= 0 {
+				return fmt.Errorf("config: missing health check interval: idx=%d", idx)
+			}
+
+			if check.QueryType != "" {
+				if _, ok := dns.ParseType(check.QueryType); !ok {
+					return fmt.Errorf(
+						"config: unknown health check query type: idx=%d type=%s",
+						idx,
+						check.QueryType,
+					)
+				}
+			}
 		}
 
-		if server.ServerName == "" {
-			return fmt.Errorf("config: missing server TLS hostname: idx=%d", idx)
+		if breaker := server.CircuitBreaker; breaker != nil {
+			if breaker.ErrorThreshold <= 0 || breaker.ErrorThreshold > 1 {
+				return fmt.Errorf(
+					"config: circuit breaker error threshold must be between 0 and 1: idx=%d threshold=%v",
+					idx,
+					breaker.ErrorThreshold,
+				)
+			}
 		}
 	}
 
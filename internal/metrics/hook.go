@@ -66,6 +66,40 @@ type ProxyHook interface {
 	// EmitError reports the occurrence of a critical error in the proxy lifecycle that causes
 	// the request to not be correctly served.
 	EmitError()
+
+	// EmitCacheHit reports that a request was served from the response cache.
+	EmitCacheHit(client net.Addr)
+
+	// EmitCacheMiss reports that a request could not be served from the response cache.
+	EmitCacheMiss(client net.Addr)
+
+	// EmitCacheStale reports that a request was served a stale response from the response
+	// cache, because the upstream failed or was too slow to provide a fresh one.
+	EmitCacheStale(client net.Addr)
+
+	// EmitCachePrefetch reports that a popular cached response nearing expiry was scheduled to
+	// be refreshed from the upstream in the background.
+	EmitCachePrefetch(client net.Addr)
+
+	// EmitHedge reports that a request was sent to a second upstream because the first was slow
+	// to respond, and whether the second upstream provided the response that was served.
+	EmitHedge(won bool, client net.Addr)
+}
+
+// HealthCheckHook is a metrics hook interface for reporting the health of upstream servers, as
+// determined by active health checks and circuit breakers.
+type HealthCheckHook interface {
+	// EmitHealthCheck reports the outcome and latency of a single health check probe of the
+	// upstream server at the specified address.
+	EmitHealthCheck(latency time.Duration, success bool, addr string)
+
+	// EmitHealthChange reports that the upstream server at the specified address was marked
+	// healthy or unhealthy.
+	EmitHealthChange(healthy bool, addr string)
+
+	// EmitCircuitStateChange reports that the circuit breaker for the upstream server at the
+	// specified address changed state.
+	EmitCircuitStateChange(state string, addr string)
 }
 
 // AsyncStatsdConnectionLifecycleHook is an implementation of ConnectionLifecycleHook that outputs
@@ -89,6 +123,12 @@ type AsyncStatsdProxyHook struct {
 	sequenceID int64
 }
 
+// AsyncStatsdHealthCheckHook is an implementation of HealthCheckHook that outputs metrics
+// asynchronously to statsd.
+type AsyncStatsdHealthCheckHook struct {
+	client aperture.Statsd
+}
+
 // NoopConnectionLifecycleHook implements the ConnectionLifecycleHook interface but noops on all
 // emissions.
 type NoopConnectionLifecycleHook struct{}
@@ -99,6 +139,9 @@ type NoopConnectionIOHook struct{}
 // NoopProxyHook implements the ProxyHook interface but noops on all emissions.
 type NoopProxyHook struct{}
 
+// NoopHealthCheckHook implements the HealthCheckHook interface but noops on all emissions.
+type NoopHealthCheckHook struct{}
+
 // NewAsyncStatsdConnectionLifecycleHook creates a new client with the specified source, statsd
 // address, and statsd sample rate. The source denotes the entity with whom the server is opening
 // and closing TCP connections.
@@ -306,6 +349,42 @@ func (h *AsyncStatsdProxyHook) EmitError() {
 	go h.client.Count("event.proxy.error", 1, nil)
 }
 
+// EmitCacheHit statsd implementation
+func (h *AsyncStatsdProxyHook) EmitCacheHit(client net.Addr) {
+	go h.client.Count("event.proxy.cache_hit", 1, map[string]interface{}{
+		"client": ipFromAddr(client),
+	})
+}
+
+// EmitCacheMiss statsd implementation
+func (h *AsyncStatsdProxyHook) EmitCacheMiss(client net.Addr) {
+	go h.client.Count("event.proxy.cache_miss", 1, map[string]interface{}{
+		"client": ipFromAddr(client),
+	})
+}
+
+// EmitCacheStale statsd implementation
+func (h *AsyncStatsdProxyHook) EmitCacheStale(client net.Addr) {
+	go h.client.Count("event.proxy.cache_stale", 1, map[string]interface{}{
+		"client": ipFromAddr(client),
+	})
+}
+
+// EmitCachePrefetch statsd implementation
+func (h *AsyncStatsdProxyHook) EmitCachePrefetch(client net.Addr) {
+	go h.client.Count("event.proxy.cache_prefetch", 1, map[string]interface{}{
+		"client": ipFromAddr(client),
+	})
+}
+
+// EmitHedge statsd implementation
+func (h *AsyncStatsdProxyHook) EmitHedge(won bool, client net.Addr) {
+	go h.client.Count("event.proxy.hedge", 1, map[string]interface{}{
+		"won":    won,
+		"client": ipFromAddr(client),
+	})
+}
+
 // NewNoopProxyHook creates a noop implementation of ProxyHook.
 func NewNoopProxyHook() ProxyHook {
 	return &NoopProxyHook{}
@@ -330,6 +409,75 @@ func (h *NoopProxyHook) EmitProcess(client net.Addr, upstream net.Addr) {}
 // EmitError noops.
 func (h *NoopProxyHook) EmitError() {}
 
+// EmitCacheHit noops.
+func (h *NoopProxyHook) EmitCacheHit(client net.Addr) {}
+
+// EmitCacheMiss noops.
+func (h *NoopProxyHook) EmitCacheMiss(client net.Addr) {}
+
+// EmitCacheStale noops.
+func (h *NoopProxyHook) EmitCacheStale(client net.Addr) {}
+
+// EmitCachePrefetch noops.
+func (h *NoopProxyHook) EmitCachePrefetch(client net.Addr) {}
+
+// EmitHedge noops.
+func (h *NoopProxyHook) EmitHedge(won bool, client net.Addr) {}
+
+// NewAsyncStatsdHealthCheckHook creates a new client with the specified statsd address and sample
+// rate.
+func NewAsyncStatsdHealthCheckHook(addr string, sampleRate float64, version string) (HealthCheckHook, error) {
+	client, err := statsdClientFactory(addr, sampleRate, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AsyncStatsdHealthCheckHook{client: client}, nil
+}
+
+// EmitHealthCheck statsd implementation
+func (h *AsyncStatsdHealthCheckHook) EmitHealthCheck(latency time.Duration, success bool, addr string) {
+	go func() {
+		tags := map[string]interface{}{
+			"addr":    addr,
+			"success": success,
+		}
+
+		h.client.Count("event.upstream.health_check", 1, tags)
+		h.client.Timing("latency.upstream.health_check", latency, tags)
+	}()
+}
+
+// EmitHealthChange statsd implementation
+func (h *AsyncStatsdHealthCheckHook) EmitHealthChange(healthy bool, addr string) {
+	go h.client.Count("event.upstream.health_change", 1, map[string]interface{}{
+		"addr":    addr,
+		"healthy": healthy,
+	})
+}
+
+// EmitCircuitStateChange statsd implementation
+func (h *AsyncStatsdHealthCheckHook) EmitCircuitStateChange(state string, addr string) {
+	go h.client.Count("event.upstream.circuit_change", 1, map[string]interface{}{
+		"addr":  addr,
+		"state": state,
+	})
+}
+
+// NewNoopHealthCheckHook creates a noop implementation of HealthCheckHook.
+func NewNoopHealthCheckHook() HealthCheckHook {
+	return &NoopHealthCheckHook{}
+}
+
+// EmitHealthCheck noops.
+func (h *NoopHealthCheckHook) EmitHealthCheck(latency time.Duration, success bool, addr string) {}
+
+// EmitHealthChange noops.
+func (h *NoopHealthCheckHook) EmitHealthChange(healthy bool, addr string) {}
+
+// EmitCircuitStateChange noops.
+func (h *NoopHealthCheckHook) EmitCircuitStateChange(state string, addr string) {}
+
 // statsdClientFactory creates a configured statsd client with reasonable defaults for the given
 // statsd server address and sample rate.
 func statsdClientFactory(addr string, sampleRate float64, version string) (*aperture.Client, error) {
@@ -347,11 +495,19 @@ func statsdClientFactory(addr string, sampleRate float64, version string) (*aper
 // ipFromAddr returns the IP address from a full net.Addr, or null if unavailable.
 func ipFromAddr(addr net.Addr) string {
 	switch networkAddr := addr.(type) {
+	case nil:
+		return "null"
 	case *net.UDPAddr:
 		return networkAddr.IP.String()
 	case *net.TCPAddr:
 		return networkAddr.IP.String()
 	default:
+		// Other addresses, like those wrapping a UDP or TCP address, are expected to be
+		// represented as a host and port.
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			return host
+		}
+
 		return "null"
 	}
 }
@@ -360,11 +516,15 @@ func ipFromAddr(addr net.Addr) string {
 // unavailable.
 func transportFromAddr(addr net.Addr) string {
 	switch addr.(type) {
+	case nil:
+		return "null"
 	case *net.UDPAddr:
 		return "udp"
 	case *net.TCPAddr:
 		return "tcp"
 	default:
-		return "null"
+		// Other addresses identify their transport by network name, e.g. to distinguish
+		// TLS clients from plaintext TCP clients.
+		return addr.Network()
 	}
 }
@@ -0,0 +1,492 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dotproxy/internal/dns"
+	"dotproxy/internal/metrics"
+)
+
+// BootstrapResolver resolves the hostnames of upstream servers by querying a fixed set of bootstrap
+// DNS servers directly, in plaintext over UDP with TCP fallback, rather than through the system
+// resolver, which may itself be served by the proxy.
+type BootstrapResolver struct {
+	servers []string
+	clients []*UDPClient
+}
+
+// BootstrapResolverOpts formalizes bootstrap resolver configuration options.
+type BootstrapResolverOpts struct {
+	// Timeout is the time after which a query to a bootstrap server that has not been answered
+	// is abandoned, and the next server is tried. Defaults to 2 seconds.
+	Timeout time.Duration
+}
+
+// ResolvingClient is a Client for an upstream server addressed by hostname. The hostname is
+// resolved through a BootstrapResolver, and each resolved address is served by its own Client,
+// behind a sharded client with the specified load balancing policy. The hostname is re-resolved
+// periodically, and after repeated failures to provide a connection, so that the client follows
+// providers that rotate the addresses of their servers. Clients for addresses that are unchanged by
+// a re-resolution are retained, along with their pooled connections.
+type ResolvingClient struct {
+	host     string
+	port     string
+	resolver *BootstrapResolver
+	factory  func(addr string) (Client, error)
+	lbPolicy LoadBalancingPolicy
+	opts     ResolvingClientOpts
+
+	addrs   []string
+	clients map[string]Client
+	sharded Client
+	mutex   sync.RWMutex
+
+	// Number of consecutive failures to provide a connection, and whether a resolution is in
+	// progress.
+	failures  int32
+	resolving int32
+
+	// Closed to stop re-resolving once the client is closed.
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// ResolvingClientOpts formalizes resolving client configuration options.
+type ResolvingClientOpts struct {
+	// ResolveInterval is the time between periodic re-resolutions of the hostname. Defaults to
+	// 5 minutes.
+	ResolveInterval time.Duration
+	// MaxDialFailures is the number of consecutive failures to provide a connection after which
+	// the hostname is re-resolved ahead of schedule. Defaults to 3.
+	MaxDialFailures int
+	// ShardingOpts are the options of the sharded client among the resolved addresses. Its
+	// weights and keys are disregarded; the clients are keyed by their addresses.
+	ShardingOpts ShardedClientOpts
+	// OnResolve, if specified, is invoked after each re-resolution with the resolved addresses,
+	// or with the error if it failed, in which case the previously resolved addresses remain in
+	// use.
+	OnResolve func(addrs []string, err error)
+}
+
+// NewBootstrapResolver creates a resolver that queries the bootstrap servers at the specified
+// addresses, in order, until one of them answers.
+func NewBootstrapResolver(servers []string, cxHook metrics.ConnectionLifecycleHook, opts BootstrapResolverOpts) (*BootstrapResolver, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("bootstrap: no bootstrap servers specified")
+	}
+
+	// Sane option defaults
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2 * time.Second
+	}
+
+	clients := make([]*UDPClient, len(servers))
+
+	for idx, server := range servers {
+		client, err := NewUDPClient(server, cxHook, UDPClientOpts{
+			PoolOpts:       PersistentConnPoolOpts{Capacity: 1},
+			ConnectTimeout: opts.Timeout,
+			ReadTimeout:    opts.Timeout,
+			WriteTimeout:   opts.Timeout,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		clients[idx] = client
+	}
+
+	return &BootstrapResolver{servers: servers, clients: clients}, nil
+}
+
+// Resolve returns the IPv4 and IPv6 addresses of the specified hostname, from the first bootstrap
+// server that answers. It returns an error if no server answers, or if the hostname has no
+// addresses.
+func (r *BootstrapResolver) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	var lastErr error
+
+	for idx, client := range r.clients {
+		var addrs []net.IP
+		var err error
+
+		// A server must answer for both address families, so that a partial answer does not
+		// replace a complete one from another server.
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			var resp *dns.Message
+			if resp, err = r.query(ctx, client, host, qtype); err != nil {
+				break
+			}
+
+			addrs = append(addrs, resp.Addresses()...)
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if err != nil {
+			lastErr = fmt.Errorf(
+				"bootstrap: error querying bootstrap server: server=%s err=%v",
+				r.servers[idx],
+				err,
+			)
+
+			continue
+		}
+
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("bootstrap: hostname has no addresses: host=%s", host)
+		}
+
+		return addrs, nil
+	}
+
+	return nil, lastErr
+}
+
+// Dial connects to the address, in host:port form, with the dialer. A hostname is resolved through
+// the bootstrap servers, and its addresses are tried in order until one of them accepts the
+// connection.
+func (r *BootstrapResolver) Dial(ctx context.Context, dialer *net.Dialer, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrap: invalid address: addr=%s err=%v", addr, err)
+	}
+
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	ips, err := r.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, err
+}
+
+// query sends a single query for the hostname to a bootstrap server, and returns its response.
+// Negative responses are valid answers.
+func (r *BootstrapResolver) query(ctx context.Context, client *UDPClient, host string, qtype uint16) (*dns.Message, error) {
+	id := uint16(rand.Intn(1 << 16))
+
+	query, err := dns.NewQuery(id, host, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(req, uint16(len(query)))
+	req = append(req, query...)
+
+	if _, err := conn.Write(req); err != nil {
+		conn.Destroy()
+		return nil, err
+	}
+
+	resp, err := NewFramedReader(conn, MaxMessageSize).ReadFrame()
+	if err != nil {
+		conn.Destroy()
+		return nil, err
+	}
+
+	conn.Close()
+
+	msg, err := dns.Parse(resp[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Header.ID != id || !msg.Header.Response() {
+		return nil, fmt.Errorf("bootstrap: response does not match query: id=%d", msg.Header.ID)
+	}
+
+	if rcode := msg.Header.Rcode(); rcode != dns.RcodeSuccess && rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("bootstrap: response has error response code: rcode=%d", rcode)
+	}
+
+	return msg, nil
+}
+
+// NewResolvingClient creates a client for the upstream server at the specified hostname and port,
+// resolving the hostname immediately. The factory creates a client for each resolved address, in
+// host:port form. It returns an error if the initial resolution fails.
+func NewResolvingClient(addr string, resolver *BootstrapResolver, factory func(addr string) (Client, error), lbPolicy LoadBalancingPolicy, opts ResolvingClientOpts) (*ResolvingClient, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrap: invalid upstream server address: addr=%s err=%v", addr, err)
+	}
+
+	// Sane option defaults
+	if opts.ResolveInterval <= 0 {
+		opts.ResolveInterval = 5 * time.Minute
+	}
+
+	if opts.MaxDialFailures <= 0 {
+		opts.MaxDialFailures = 3
+	}
+
+	c := &ResolvingClient{
+		host:     host,
+		port:     port,
+		resolver: resolver,
+		factory:  factory,
+		lbPolicy: lbPolicy,
+		opts:     opts,
+		stop:     make(chan struct{}),
+	}
+
+	if err := c.resolve(); err != nil {
+		return nil, err
+	}
+
+	go c.run()
+
+	return c, nil
+}
+
+// Conn retrieves a connection from the client for one of the resolved addresses, selected by the
+// load balancing policy. The hostname is re-resolved in the background after repeated failures.
+func (c *ResolvingClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	c.mutex.RLock()
+	sharded := c.sharded
+	c.mutex.RUnlock()
+
+	conn, err := sharded.Conn(ctx)
+	if err == nil {
+		atomic.StoreInt32(&c.failures, 0)
+		return conn, nil
+	}
+
+	// A client is not penalized for failing a request that has been abandoned.
+	if ctx.Err() == nil && int(atomic.AddInt32(&c.failures, 1)) >= c.opts.MaxDialFailures {
+		go c.refresh()
+	}
+
+	return nil, err
+}
+
+// Stats aggregates stats from the clients for all resolved addresses.
+func (c *ResolvingClient) Stats() Stats {
+	c.mutex.RLock()
+	sharded := c.sharded
+	c.mutex.RUnlock()
+
+	return sharded.Stats()
+}
+
+// Addrs returns the currently resolved addresses, in host:port form.
+func (c *ResolvingClient) Addrs() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.addrs
+}
+
+// Close stops re-resolving the hostname, and closes the clients for all resolved addresses.
+func (c *ResolvingClient) Close() error {
+	c.closeOnce.Do(func() { close(c.stop) })
+
+	// A resolution that completes after the client is closed discards its own clients, so only
+	// the current ones need to be closed.
+	c.mutex.Lock()
+	clients := make([]Client, 0, len(c.clients))
+	for _, client := range c.clients {
+		clients = append(clients, client)
+	}
+	c.clients = nil
+	c.mutex.Unlock()
+
+	closeClients(clients)
+
+	return nil
+}
+
+// String returns a string representation of the client.
+func (c *ResolvingClient) String() string {
+	return fmt.Sprintf("ResolvingClient{host: %s, addrs: %v}", c.host, c.Addrs())
+}
+
+// run re-resolves the hostname at every interval, until the client is closed.
+func (c *ResolvingClient) run() {
+	ticker := time.NewTicker(c.opts.ResolveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+
+		c.refresh()
+	}
+}
+
+// closed determines whether the client has been closed.
+func (c *ResolvingClient) closed() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// refresh re-resolves the hostname, unless a resolution is already in progress or the client has
+// been closed.
+func (c *ResolvingClient) refresh() {
+	if c.closed() || !atomic.CompareAndSwapInt32(&c.resolving, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&c.resolving, 0)
+
+	atomic.StoreInt32(&c.failures, 0)
+
+	err := c.resolve()
+
+	if c.opts.OnResolve != nil {
+		c.opts.OnResolve(c.Addrs(), err)
+	}
+}
+
+// resolve resolves the hostname and replaces the set of clients with one for each resolved
+// address, reusing the existing clients for addresses that remain. Nothing is replaced if the set
+// of addresses is unchanged.
+func (c *ResolvingClient) resolve() error {
+	ips, err := c.resolver.Resolve(context.Background(), c.host)
+	if err != nil {
+		return err
+	}
+
+	// Addresses are ordered consistently, so that policies that depend on the order of clients
+	// are stable across re-resolutions that do not change the set of addresses.
+	var addrs []string
+	seen := make(map[string]bool)
+
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), c.port)
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+
+	sort.Strings(addrs)
+
+	c.mutex.RLock()
+	existing := c.clients
+	unchanged := sameAddrs(addrs, c.addrs)
+	c.mutex.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	clients := make(map[string]Client, len(addrs))
+	shards := make([]Client, len(addrs))
+
+	// Clients created for new addresses are closed if the resolution cannot be completed.
+	var created []Client
+
+	for idx, addr := range addrs {
+		client, ok := existing[addr]
+		if !ok {
+			if client, err = c.factory(addr); err != nil {
+				closeClients(created)
+				return fmt.Errorf("bootstrap: error creating client: addr=%s err=%v", addr, err)
+			}
+
+			created = append(created, client)
+		}
+
+		clients[addr] = client
+		shards[idx] = client
+	}
+
+	shardingOpts := c.opts.ShardingOpts
+	shardingOpts.Weights = nil
+	shardingOpts.Keys = addrs
+
+	sharded, err := NewShardedClient(shards, c.lbPolicy, shardingOpts)
+	if err != nil {
+		closeClients(created)
+		return err
+	}
+
+	c.mutex.Lock()
+
+	if c.closed() {
+		c.mutex.Unlock()
+		closeClients(created)
+
+		return fmt.Errorf("bootstrap: client closed during resolution: host=%s", c.host)
+	}
+
+	c.addrs = addrs
+	c.clients = clients
+	c.sharded = sharded
+	c.mutex.Unlock()
+
+	// Clients for addresses that are no longer resolved are closed, so that their connections
+	// are not held open indefinitely.
+	var removed []Client
+
+	for addr, client := range existing {
+		if _, ok := clients[addr]; !ok {
+			removed = append(removed, client)
+		}
+	}
+
+	closeClients(removed)
+
+	return nil
+}
+
+// sameAddrs determines whether two sorted lists of addresses are identical.
+func sameAddrs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// closeClients closes each of the clients that holds connections open.
+func closeClients(clients []Client) {
+	for _, client := range clients {
+		if closable, ok := client.(ClosableClient); ok {
+			closable.Close()
+		}
+	}
+}
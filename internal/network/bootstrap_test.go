@@ -0,0 +1,207 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dotproxy/internal/dns"
+	"dotproxy/internal/metrics"
+)
+
+// bootstrapStub is a loopback bootstrap server that answers every A query with its current set of
+// IPv4 addresses, and every AAAA query with none.
+type bootstrapStub struct {
+	conn    net.PacketConn
+	ips     []net.IP
+	queries int32
+	mutex   sync.Mutex
+}
+
+func newBootstrapStub(t *testing.T, ips ...string) *bootstrapStub {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening on loopback: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	stub := &bootstrapStub{conn: conn}
+	stub.set(ips...)
+
+	go stub.serve()
+
+	return stub
+}
+
+// set replaces the addresses with which the stub answers.
+func (s *bootstrapStub) set(ips ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ips = nil
+	for _, ip := range ips {
+		s.ips = append(s.ips, net.ParseIP(ip).To4())
+	}
+}
+
+func (s *bootstrapStub) serve() {
+	buf := make([]byte, MaxMessageSize)
+
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		atomic.AddInt32(&s.queries, 1)
+
+		// Queries consist of a header and a single question, so the answers directly follow it.
+		resp := append([]byte{}, buf[:n]...)
+		resp[2] |= 0x80
+
+		if binary.BigEndian.Uint16(resp[n-4:n-2]) == dns.TypeA {
+			s.mutex.Lock()
+
+			binary.BigEndian.PutUint16(resp[6:8], uint16(len(s.ips)))
+
+			for _, ip := range s.ips {
+				rr := []byte{0xc0, dns.HeaderSize, 0, 0, 0, 0, 0, 0, 0, 60, 0, net.IPv4len}
+				binary.BigEndian.PutUint16(rr[2:4], dns.TypeA)
+				binary.BigEndian.PutUint16(rr[4:6], dns.ClassINET)
+				resp = append(append(resp, rr...), ip...)
+			}
+
+			s.mutex.Unlock()
+		}
+
+		s.conn.WriteTo(resp, addr)
+	}
+}
+
+// newResolvingTest creates a resolving client for a hostname resolved by the stub, whose
+// clients for each address are recorded as they are created.
+func newResolvingTest(t *testing.T, stub *bootstrapStub, interval time.Duration) (*ResolvingClient, map[string]*unreachableClient) {
+	resolver, err := NewBootstrapResolver(
+		[]string{stub.conn.LocalAddr().String()},
+		metrics.NewNoopConnectionLifecycleHook(),
+		BootstrapResolverOpts{Timeout: time.Second},
+	)
+	if err != nil {
+		t.Fatalf("error creating resolver: %v", err)
+	}
+
+	created := make(map[string]*unreachableClient)
+
+	factory := func(addr string) (Client, error) {
+		if _, ok := created[addr]; ok {
+			t.Errorf("client created more than once: addr=%s", addr)
+		}
+
+		client := &unreachableClient{}
+		created[addr] = client
+
+		return client, nil
+	}
+
+	client, err := NewResolvingClient(
+		"dns.example.com:853",
+		resolver,
+		factory,
+		RoundRobin,
+		ResolvingClientOpts{ResolveInterval: interval},
+	)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+
+	return client, created
+}
+
+func TestResolvingClientResolve(t *testing.T) {
+	stub := newBootstrapStub(t, "192.0.2.2", "192.0.2.1")
+	client, created := newResolvingTest(t, stub, time.Hour)
+	defer client.Close()
+
+	if addrs := client.Addrs(); !sameAddrs(addrs, []string{"192.0.2.1:853", "192.0.2.2:853"}) {
+		t.Fatalf("unexpected addresses: addrs=%v", addrs)
+	}
+
+	// A re-resolution that yields the same addresses retains the existing clients, unchanged.
+	sharded := client.sharded
+
+	if err := client.resolve(); err != nil {
+		t.Fatalf("error re-resolving: %v", err)
+	}
+
+	if client.sharded != sharded || len(created) != 2 {
+		t.Error("expected clients to be retained for unchanged addresses")
+	}
+
+	// A re-resolution that yields new addresses creates clients only for them, and closes the
+	// clients of the addresses that are gone.
+	stub.set("192.0.2.2", "192.0.2.3")
+
+	if err := client.resolve(); err != nil {
+		t.Fatalf("error re-resolving: %v", err)
+	}
+
+	if addrs := client.Addrs(); !sameAddrs(addrs, []string{"192.0.2.2:853", "192.0.2.3:853"}) {
+		t.Fatalf("unexpected addresses: addrs=%v", addrs)
+	}
+
+	expected := map[string]int32{"192.0.2.1:853": 1, "192.0.2.2:853": 0, "192.0.2.3:853": 0}
+
+	for addr, closed := range expected {
+		if inner, ok := created[addr]; !ok || atomic.LoadInt32(&inner.closed) != closed {
+			t.Errorf("unexpected client state: addr=%s created=%t", addr, ok)
+		}
+	}
+}
+
+func TestResolvingClientClose(t *testing.T) {
+	stub := newBootstrapStub(t, "192.0.2.1", "192.0.2.2")
+	client, created := newResolvingTest(t, stub, 5*time.Millisecond)
+
+	var _ ClosableClient = client
+
+	// Wait for a periodic re-resolution, so that the client is known to be running.
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&stub.queries) < 4; {
+		if time.Now().After(deadline) {
+			t.Fatal("hostname not re-resolved")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("error closing client: %v", err)
+	}
+
+	// Closing the client more than once is harmless.
+	client.Close()
+
+	for addr, inner := range created {
+		if atomic.LoadInt32(&inner.closed) != 1 {
+			t.Errorf("expected client to be closed: addr=%s", addr)
+		}
+	}
+
+	// A resolution may have been in flight when the client was closed, but none start
+	// afterwards, including those triggered by failures to provide a connection.
+	time.Sleep(20 * time.Millisecond)
+	queries := atomic.LoadInt32(&stub.queries)
+
+	for i := 0; i < 5; i++ {
+		client.Conn(context.Background())
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if after := atomic.LoadInt32(&stub.queries); after != queries {
+		t.Errorf("client continued resolving after close: queries=%d after=%d", queries, after)
+	}
+}
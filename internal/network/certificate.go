@@ -0,0 +1,116 @@
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertificateReloader provides a TLS certificate loaded from PEM files on disk, and reloads it when
+// the files change. It allows a certificate to be renewed without restarting the server using it.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	mutex    sync.RWMutex
+}
+
+// NewCertificateReloader creates a CertificateReloader for the specified certificate and private
+// key files. It returns an error if the certificate cannot be initially loaded.
+func NewCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate returns the most recently loaded certificate. Its signature conforms to that of
+// tls.Config.GetCertificate.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.cert, nil
+}
+
+// Reload loads the certificate from disk if either file has been modified since it was last
+// loaded. It returns whether the certificate was reloaded. On error, the previously loaded
+// certificate remains in use.
+func (r *CertificateReloader) Reload() (bool, error) {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return false, err
+	}
+
+	r.mutex.RLock()
+	unchanged := r.cert != nil && !modTime.After(r.modTime)
+	r.mutex.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf(
+			"certificate: error loading key pair: cert=%s key=%s err=%v",
+			r.certFile,
+			r.keyFile,
+			err,
+		)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.cert = &cert
+	r.modTime = modTime
+
+	return true, nil
+}
+
+// latestModTime returns the most recent modification time of the certificate and key files.
+func (r *CertificateReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("certificate: error reading file: err=%v", err)
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// LoadCertPool loads a pool of trusted certificate authorities from the specified PEM file. It
+// returns a nil pool, signifying the host's root certificate authorities, if no file is specified.
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("certificate: error reading file: err=%v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("certificate: no certificates found in file: path=%s", caFile)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,372 @@
+//go:generate go run golang.org/x/tools/cmd/stringer -type=CircuitState -linecomment=true
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dotproxy/internal/metrics"
+)
+
+// CircuitState formalizes the state of a circuit breaker.
+type CircuitState int
+
+// CircuitBreakerClient is a Client that stops providing connections from another Client when too
+// many of its recent transactions have failed. A transaction fails if a connection cannot be
+// provided, or if the transaction performed on the connection is reported to have failed through
+// its Observe method, e.g. due to an I/O error or timeout. Once tripped, the circuit remains open
+// for a period of time, after which a limited number of trial transactions are permitted; the
+// circuit closes if they all succeed, and reopens for a longer period of time otherwise. Clients
+// with open circuits are skipped by every load balancing policy.
+type CircuitBreakerClient struct {
+	client Client
+	addr   string
+	hook   metrics.HealthCheckHook
+	opts   CircuitBreakerOpts
+
+	state        CircuitState
+	buckets      []circuitBucket
+	openedAt     time.Time
+	openDuration time.Duration
+	// Number of trial transactions admitted, and the number of them that have succeeded, since
+	// the circuit was last half-opened.
+	trials         int
+	trialSuccesses int
+	mutex          sync.RWMutex
+
+	// Source of the current time, replaceable in tests.
+	now func() time.Time
+}
+
+// CircuitBreakerOpts formalizes circuit breaker configuration options.
+type CircuitBreakerOpts struct {
+	// ErrorThreshold, between 0 exclusive and 1 inclusive, is the fraction of transactions
+	// within the window that must fail for the circuit to open.
+	ErrorThreshold float64
+	// Window is the duration of the sliding window of recent transactions over which the error
+	// rate is measured. Defaults to 10 seconds.
+	Window time.Duration
+	// MinRequests is the minimum number of transactions within the window required for the
+	// circuit to open, so that a handful of failures during low traffic do not trip it.
+	// Defaults to 10.
+	MinRequests int
+	// OpenDuration is the duration for which the circuit initially remains open before
+	// permitting trial transactions. It is doubled each time a trial fails. Defaults to 1
+	// second.
+	OpenDuration time.Duration
+	// MaxOpenDuration caps the duration for which the circuit remains open. Defaults to 1
+	// minute.
+	MaxOpenDuration time.Duration
+	// HalfOpenRequests is the number of trial transactions permitted while the circuit is
+	// half-open, all of which must succeed for the circuit to close. Defaults to 1.
+	HalfOpenRequests int
+	// OnChange, if specified, is invoked whenever the circuit changes state.
+	OnChange func(state CircuitState)
+}
+
+// circuitBucket counts the outcomes of transactions within a single slice of the sliding window.
+type circuitBucket struct {
+	start     time.Time
+	successes int
+	failures  int
+}
+
+const (
+	// CircuitClosed describes a circuit that permits all transactions.
+	CircuitClosed CircuitState = iota // closed
+	// CircuitOpen describes a circuit that rejects all transactions.
+	CircuitOpen // open
+	// CircuitHalfOpen describes a circuit that permits a limited number of trial transactions
+	// to determine whether it should close.
+	CircuitHalfOpen // half-open
+)
+
+const (
+	// circuitWindowBuckets is the number of slices into which the sliding window is divided.
+	circuitWindowBuckets = 10
+)
+
+// NewCircuitBreakerClient wraps a client with a circuit breaker. The address identifies the
+// upstream server in metrics. The circuit is initially closed.
+func NewCircuitBreakerClient(client Client, addr string, hook metrics.HealthCheckHook, opts CircuitBreakerOpts) (*CircuitBreakerClient, error) {
+	if opts.ErrorThreshold <= 0 || opts.ErrorThreshold > 1 {
+		return nil, fmt.Errorf(
+			"circuit: error threshold must be between 0 and 1: threshold=%v",
+			opts.ErrorThreshold,
+		)
+	}
+
+	// Sane option defaults
+	if opts.Window < circuitWindowBuckets {
+		opts.Window = 10 * time.Second
+	}
+
+	if opts.MinRequests <= 0 {
+		opts.MinRequests = 10
+	}
+
+	if opts.OpenDuration <= 0 {
+		opts.OpenDuration = time.Second
+	}
+
+	if opts.MaxOpenDuration <= 0 {
+		opts.MaxOpenDuration = time.Minute
+	}
+
+	if opts.MaxOpenDuration < opts.OpenDuration {
+		opts.MaxOpenDuration = opts.OpenDuration
+	}
+
+	if opts.HalfOpenRequests <= 0 {
+		opts.HalfOpenRequests = 1
+	}
+
+	return &CircuitBreakerClient{
+		client:       client,
+		addr:         addr,
+		hook:         hook,
+		opts:         opts,
+		buckets:      make([]circuitBucket, circuitWindowBuckets),
+		openDuration: opts.OpenDuration,
+		now:          time.Now,
+	}, nil
+}
+
+// Conn retrieves a connection from the underlying client, if the circuit permits it. The outcome
+// of the transaction is recorded as soon as it is observed on the connection. Transactions that are
+// never observed, e.g. because their request was cancelled by the client or by hedging, or because
+// the connection was never used, are disregarded when the connection is closed or destroyed.
+func (c *CircuitBreakerClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	trial, err := c.admit()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.client.Conn(ctx)
+	if err != nil {
+		c.settle(ctx, trial, false)
+		return nil, err
+	}
+
+	// Set once the transaction's outcome has been recorded or disregarded, so that it is settled
+	// exactly once.
+	var settled int32
+
+	closer := conn.closer
+	observer := conn.observer
+
+	conn.observer = func(latency time.Duration, success bool) {
+		if atomic.CompareAndSwapInt32(&settled, 0, 1) {
+			c.record(trial, success)
+		}
+
+		if observer != nil {
+			observer(latency, success)
+		}
+	}
+
+	conn.closer = func(destroyed bool) error {
+		if atomic.CompareAndSwapInt32(&settled, 0, 1) {
+			c.release(trial)
+		}
+
+		return closer(destroyed)
+	}
+
+	return conn, nil
+}
+
+// Stats returns the underlying client's stats, marked unhealthy if the circuit would reject a
+// transaction.
+func (c *CircuitBreakerClient) Stats() Stats {
+	stats := c.client.Stats()
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	switch c.state {
+	case CircuitOpen:
+		stats.Unhealthy = stats.Unhealthy || c.now().Sub(c.openedAt) < c.openDuration
+	case CircuitHalfOpen:
+		stats.Unhealthy = stats.Unhealthy || c.trials >= c.opts.HalfOpenRequests
+	}
+
+	return stats
+}
+
+// Close closes the underlying client if it is closable.
+func (c *CircuitBreakerClient) Close() error {
+	if closable, ok := c.client.(ClosableClient); ok {
+		return closable.Close()
+	}
+
+	return nil
+}
+
+// String returns a string representation of the client.
+func (c *CircuitBreakerClient) String() string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return fmt.Sprintf("CircuitBreakerClient{%v, state: %s}", c.client, c.state)
+}
+
+// admit determines whether the circuit permits a transaction, half-opening the circuit if it has
+// been open for long enough. It returns whether the transaction is a trial.
+func (c *CircuitBreakerClient) admit() (bool, error) {
+	c.mutex.Lock()
+
+	changed := false
+	if c.state == CircuitOpen && c.now().Sub(c.openedAt) >= c.openDuration {
+		c.state = CircuitHalfOpen
+		c.trials = 0
+		c.trialSuccesses = 0
+		changed = true
+	}
+
+	state := c.state
+	admitted := true
+
+	if state == CircuitOpen || (state == CircuitHalfOpen && c.trials >= c.opts.HalfOpenRequests) {
+		admitted = false
+	} else if state == CircuitHalfOpen {
+		c.trials++
+	}
+
+	c.mutex.Unlock()
+
+	if changed {
+		c.notify(state)
+	}
+
+	if !admitted {
+		return false, fmt.Errorf("circuit: circuit is %s: addr=%s", state, c.addr)
+	}
+
+	return state == CircuitHalfOpen, nil
+}
+
+// settle records the outcome of a transaction, unless it failed because its request was cancelled,
+// in which case a trial transaction is released for another request to attempt.
+func (c *CircuitBreakerClient) settle(ctx context.Context, trial bool, success bool) {
+	if success || !errors.Is(ctx.Err(), context.Canceled) {
+		c.record(trial, success)
+		return
+	}
+
+	c.release(trial)
+}
+
+// release disregards the outcome of a transaction, releasing it for another request to attempt if
+// it is a trial transaction.
+func (c *CircuitBreakerClient) release(trial bool) {
+	if !trial {
+		return
+	}
+
+	c.mutex.Lock()
+	if c.state == CircuitHalfOpen && c.trials > c.trialSuccesses {
+		c.trials--
+	}
+	c.mutex.Unlock()
+}
+
+// record records the outcome of a transaction, opening or closing the circuit as necessary.
+func (c *CircuitBreakerClient) record(trial bool, success bool) {
+	c.mutex.Lock()
+
+	prev := c.state
+
+	// Outcomes of transactions admitted before the most recent state change are disregarded.
+	switch {
+	case trial && c.state == CircuitHalfOpen:
+		if !success {
+			c.open(c.openDuration * 2)
+		} else if c.trialSuccesses++; c.trialSuccesses >= c.opts.HalfOpenRequests {
+			c.state = CircuitClosed
+			c.openDuration = c.opts.OpenDuration
+
+			for idx := range c.buckets {
+				c.buckets[idx] = circuitBucket{}
+			}
+		}
+
+	case !trial && c.state == CircuitClosed:
+		now := c.now()
+		bucket := c.bucket(now)
+
+		if success {
+			bucket.successes++
+		} else {
+			bucket.failures++
+		}
+
+		successes, failures := c.window(now)
+		total := successes + failures
+
+		if total >= c.opts.MinRequests && float64(failures)/float64(total) >= c.opts.ErrorThreshold {
+			c.open(c.opts.OpenDuration)
+		}
+	}
+
+	state := c.state
+
+	c.mutex.Unlock()
+
+	if state != prev {
+		c.notify(state)
+	}
+}
+
+// open opens the circuit for the specified duration, capped at the maximum open duration. The
+// caller must hold the mutex.
+func (c *CircuitBreakerClient) open(duration time.Duration) {
+	if duration > c.opts.MaxOpenDuration {
+		duration = c.opts.MaxOpenDuration
+	}
+
+	c.state = CircuitOpen
+	c.openedAt = c.now()
+	c.openDuration = duration
+}
+
+// bucket returns the window bucket for the specified time, resetting it if it last described an
+// earlier slice of time. The caller must hold the mutex.
+func (c *CircuitBreakerClient) bucket(now time.Time) *circuitBucket {
+	width := c.opts.Window / circuitWindowBuckets
+	start := now.Truncate(width)
+	bucket := &c.buckets[(start.UnixNano()/int64(width))%circuitWindowBuckets]
+
+	if !bucket.start.Equal(start) {
+		*bucket = circuitBucket{start: start}
+	}
+
+	return bucket
+}
+
+// window sums the outcomes of transactions within the sliding window ending at the specified time.
+// The caller must hold the mutex.
+func (c *CircuitBreakerClient) window(now time.Time) (successes int, failures int) {
+	for _, bucket := range c.buckets {
+		if now.Sub(bucket.start) < c.opts.Window {
+			successes += bucket.successes
+			failures += bucket.failures
+		}
+	}
+
+	return successes, failures
+}
+
+// notify reports a change in the circuit's state.
+func (c *CircuitBreakerClient) notify(state CircuitState) {
+	c.hook.EmitCircuitStateChange(state.String(), c.addr)
+
+	if c.opts.OnChange != nil {
+		c.opts.OnChange(state)
+	}
+}
@@ -0,0 +1,316 @@
+package network
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dotproxy/internal/metrics"
+)
+
+// fakeClock is a manually advanced source of the current time.
+type fakeClock struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// nopClient is a Client that provides connections on which no I/O may be performed.
+type nopClient struct{}
+
+func (nopClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	return NewPersistentConn(nil, func(destroyed bool) error { return nil }), nil
+}
+
+func (nopClient) Stats() Stats {
+	return Stats{}
+}
+
+// circuitTest drives a circuit breaker with a fake clock, recording its state changes.
+type circuitTest struct {
+	t       *testing.T
+	client  *CircuitBreakerClient
+	clock   *fakeClock
+	changes []CircuitState
+}
+
+func newCircuitTest(t *testing.T) *circuitTest {
+	ct := &circuitTest{t: t, clock: &fakeClock{now: time.Unix(1000000, 0)}}
+
+	opts := CircuitBreakerOpts{
+		ErrorThreshold:   0.5,
+		Window:           10 * time.Second,
+		MinRequests:      4,
+		OpenDuration:     time.Second,
+		MaxOpenDuration:  3 * time.Second,
+		HalfOpenRequests: 1,
+		OnChange:         func(state CircuitState) { ct.changes = append(ct.changes, state) },
+	}
+
+	client, err := NewCircuitBreakerClient(nopClient{}, "192.0.2.1:853", metrics.NewNoopHealthCheckHook(), opts)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+
+	client.now = ct.clock.Now
+	ct.client = client
+
+	return ct
+}
+
+// conn retrieves a connection, failing the test if the circuit rejects it.
+func (ct *circuitTest) conn() *PersistentConn {
+	ct.t.Helper()
+
+	conn, err := ct.client.Conn(context.Background())
+	if err != nil {
+		ct.t.Fatalf("error retrieving connection: %v", err)
+	}
+
+	return conn
+}
+
+// transact performs a transaction with the specified outcome.
+func (ct *circuitTest) transact(success bool) {
+	ct.t.Helper()
+
+	conn := ct.conn()
+	conn.Observe(time.Millisecond, success)
+	conn.Close()
+}
+
+// expect asserts the state of the circuit, and whether it admits a transaction.
+func (ct *circuitTest) expect(state CircuitState, admits bool) {
+	ct.t.Helper()
+
+	ct.client.mutex.RLock()
+	actual := ct.client.state
+	ct.client.mutex.RUnlock()
+
+	if actual != state {
+		ct.t.Fatalf("unexpected circuit state: state=%s expected=%s", actual, state)
+	}
+
+	if unhealthy := ct.client.Stats().Unhealthy; unhealthy == admits {
+		ct.t.Fatalf("unexpected client health: unhealthy=%t", unhealthy)
+	}
+}
+
+// reject asserts that the circuit rejects a transaction.
+func (ct *circuitTest) reject() {
+	ct.t.Helper()
+
+	if _, err := ct.client.Conn(context.Background()); err == nil {
+		ct.t.Fatal("expected circuit to reject connection")
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	ct := newCircuitTest(t)
+
+	// Failures below the minimum number of requests do not trip the circuit.
+	ct.transact(false)
+	ct.transact(false)
+	ct.transact(true)
+	ct.expect(CircuitClosed, true)
+
+	ct.transact(false)
+	ct.expect(CircuitOpen, false)
+	ct.reject()
+
+	// The circuit half-opens once the open duration has elapsed.
+	ct.clock.Advance(time.Second - time.Millisecond)
+	ct.expect(CircuitOpen, false)
+	ct.reject()
+
+	ct.clock.Advance(time.Millisecond)
+	ct.expect(CircuitOpen, true)
+
+	// Only a single trial is admitted while it is in flight, and a failed trial reopens the
+	// circuit for twice as long.
+	trial := ct.conn()
+	ct.expect(CircuitHalfOpen, false)
+	ct.reject()
+
+	trial.Observe(time.Millisecond, false)
+	trial.Close()
+	ct.expect(CircuitOpen, false)
+
+	ct.clock.Advance(time.Second)
+	ct.reject()
+
+	ct.clock.Advance(time.Second)
+	ct.transact(true)
+	ct.expect(CircuitClosed, true)
+
+	// The open duration is reset once the circuit closes.
+	for i := 0; i < 4; i++ {
+		ct.transact(false)
+	}
+
+	ct.expect(CircuitOpen, false)
+	ct.clock.Advance(time.Second)
+	ct.expect(CircuitOpen, true)
+
+	expected := []CircuitState{
+		CircuitOpen,
+		CircuitHalfOpen,
+		CircuitOpen,
+		CircuitHalfOpen,
+		CircuitClosed,
+		CircuitOpen,
+	}
+
+	if len(ct.changes) != len(expected) {
+		t.Fatalf("unexpected state changes: changes=%v expected=%v", ct.changes, expected)
+	}
+
+	for idx := range expected {
+		if ct.changes[idx] != expected[idx] {
+			t.Fatalf("unexpected state changes: changes=%v expected=%v", ct.changes, expected)
+		}
+	}
+}
+
+func TestCircuitBreakerMaxOpenDuration(t *testing.T) {
+	ct := newCircuitTest(t)
+
+	for i := 0; i < 4; i++ {
+		ct.transact(false)
+	}
+
+	// Open durations double with each failed trial: 1s, 2s, then 4s capped to 3s.
+	for _, duration := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		ct.clock.Advance(duration - time.Millisecond)
+		ct.reject()
+
+		ct.clock.Advance(time.Millisecond)
+		ct.transact(false)
+	}
+
+	ct.clock.Advance(3 * time.Second)
+	ct.expect(CircuitOpen, true)
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	ct := newCircuitTest(t)
+
+	ct.transact(false)
+	ct.transact(false)
+	ct.transact(false)
+
+	// Outcomes older than the window are disregarded.
+	ct.clock.Advance(10 * time.Second)
+	ct.transact(false)
+	ct.transact(true)
+	ct.transact(true)
+	ct.expect(CircuitClosed, true)
+
+	ct.transact(false)
+	ct.expect(CircuitOpen, false)
+}
+
+func TestCircuitBreakerSettlesOnce(t *testing.T) {
+	ct := newCircuitTest(t)
+
+	// A transaction observed to have failed is recorded once, even if its connection is then
+	// destroyed.
+	for i := 0; i < 3; i++ {
+		conn := ct.conn()
+		conn.Observe(time.Millisecond, false)
+		conn.Destroy()
+	}
+
+	// Transactions disregarded when their connections are closed unobserved are not recorded by
+	// a later observation.
+	for i := 0; i < 8; i++ {
+		conn := ct.conn()
+		conn.Close()
+		conn.Observe(time.Millisecond, false)
+	}
+
+	ct.expect(CircuitClosed, true)
+
+	ct.transact(false)
+	ct.expect(CircuitOpen, false)
+}
+
+func TestCircuitBreakerTrialRelease(t *testing.T) {
+	ct := newCircuitTest(t)
+
+	for i := 0; i < 4; i++ {
+		ct.transact(false)
+	}
+
+	ct.clock.Advance(time.Second)
+
+	// A trial that is abandoned unobserved, e.g. because its request was cancelled, releases
+	// its slot for another request to attempt.
+	abandoned := ct.conn()
+	ct.reject()
+	abandoned.Close()
+
+	trial := ct.conn()
+	ct.reject()
+
+	// Closing the connection of a trial whose outcome was recorded releases nothing.
+	trial.Observe(time.Millisecond, true)
+	trial.Close()
+	ct.expect(CircuitClosed, true)
+
+	// A released trial from a previous half-open period does not affect the next one.
+	for i := 0; i < 4; i++ {
+		ct.transact(false)
+	}
+
+	ct.clock.Advance(time.Second)
+
+	stale := ct.conn()
+	stale.Observe(time.Millisecond, false)
+
+	ct.clock.Advance(2 * time.Second)
+
+	current := ct.conn()
+	stale.Close()
+	ct.reject()
+
+	current.Observe(time.Millisecond, true)
+	current.Close()
+	ct.expect(CircuitClosed, true)
+}
+
+func TestCircuitBreakerClose(t *testing.T) {
+	inner := &unreachableClient{}
+
+	client, err := NewCircuitBreakerClient(inner, "192.0.2.1:853", metrics.NewNoopHealthCheckHook(), CircuitBreakerOpts{
+		ErrorThreshold: 0.5,
+	})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+
+	var _ ClosableClient = client
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("error closing client: %v", err)
+	}
+
+	if atomic.LoadInt32(&inner.closed) != 1 {
+		t.Error("expected underlying client to be closed")
+	}
+}
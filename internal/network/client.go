@@ -1,7 +1,9 @@
 package network
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"sync"
@@ -13,13 +15,33 @@ import (
 
 // Client defines the interface for a TCP network client.
 type Client interface {
-	// Conn retrieves a single persistent connection.
-	Conn() (*PersistentConn, error)
+	// Conn retrieves a single persistent connection. Establishing a new connection is abandoned
+	// if the context is done first.
+	Conn(ctx context.Context) (*PersistentConn, error)
 
 	// Stats returns historical client stats.
 	Stats() Stats
 }
 
+// KeyedClient is a Client that can select the upstream providing a connection by a request key,
+// such that requests with the same key are preferentially served by the same upstream.
+type KeyedClient interface {
+	Client
+
+	// ConnFor retrieves a single persistent connection for a request with the specified key.
+	ConnFor(ctx context.Context, key string) (*PersistentConn, error)
+}
+
+// ClosableClient is a Client that holds connections open, e.g. in a pool, which must be released
+// once the client is no longer used.
+type ClosableClient interface {
+	Client
+
+	// Close closes the client's idle connections. Connections in use are closed, rather than
+	// reused, once they are closed. The client should not be used once it is closed.
+	Close() error
+}
+
 // Stats formalizes stats tracked per-client.
 type Stats struct {
 	// SuccessfulConnections is the number of connections that the client has successfully
@@ -28,15 +50,44 @@ type Stats struct {
 	// FailedConnections is the number of times that the client has failed to provide a
 	// connection.
 	FailedConnections int
+	// Latency is an exponentially weighted moving average of the duration of transactions
+	// performed on connections provided by the client, as reported through Observe on each
+	// connection. It is zero until the first transaction is reported.
+	Latency time.Duration
+	// ActiveConnections is the number of connections provided by the client that have not yet
+	// been closed or destroyed, i.e. the number of transactions currently in flight.
+	ActiveConnections int
+	// Unhealthy describes whether the client has been marked unhealthy by an active health
+	// check, or is rejecting connections because its circuit breaker is open. Load balancing
+	// policies avoid unhealthy clients whenever a healthy one is available.
+	Unhealthy bool
+}
+
+// statsTracker records Stats on behalf of a Client.
+type statsTracker struct {
+	stats Stats
+	mutex sync.RWMutex
 }
 
 // TLSClient describes a TLS_secured TCP client that recycles connections in a pool.
 type TLSClient struct {
-	addr       string
-	cxHook     metrics.ConnectionLifecycleHook
-	pool       *PersistentConnPool
-	stats      Stats
-	statsMutex sync.RWMutex
+	addr   string
+	cxHook metrics.ConnectionLifecycleHook
+	pool   connPool
+	stats  statsTracker
+}
+
+// connPool is a common interface for pools of reusable connections.
+type connPool interface {
+	// Conn retrieves a single connection from the pool.
+	Conn(ctx context.Context) (*PersistentConn, error)
+
+	// Size reports the current size of the pool.
+	Size() int
+
+	// Close closes all idle connections in the pool, and stops the pool from reusing
+	// connections.
+	Close() error
 }
 
 // TLSClientOpts formalizes TLS client configuration options.
@@ -53,8 +104,26 @@ type TLSClientOpts struct {
 	ReadTimeout time.Duration
 	// WriteTimeout is the timeout associated with each write to a remote connection.
 	WriteTimeout time.Duration
+	// RootCAs is the set of certificate authorities against which the server identity is
+	// verified. If nil, the host's root certificate authorities are used.
+	RootCAs *x509.CertPool
+	// Pipelining controls whether many concurrent requests are multiplexed over each
+	// connection, rather than each request holding a pooled connection for the duration of
+	// its transaction. When enabled, the pool capacity describes the number of pipelined
+	// sessions to maintain.
+	Pipelining bool
 }
 
+const (
+	// latencySmoothing is the weight of each new sample in the moving average of transaction
+	// latency. Higher values adapt more quickly to changes in latency, at the cost of
+	// sensitivity to outliers.
+	latencySmoothing = 0.2
+	// failedTransactionLatency is the minimum latency recorded for a failed transaction, or a
+	// failure to provide a connection, so that a failing client is not mistaken for a fast one.
+	failedTransactionLatency = time.Second
+)
+
 const (
 	// tcpFastOpenConnect is the TCP socket option constant (defined in the kernel)
 	// controlling whether outgoing connections should use TCP Fast Open to reduce the number of
@@ -85,14 +154,15 @@ func NewTLSClient(addr string, serverName string, cxHook metrics.ConnectionLifec
 
 	conf := &tls.Config{
 		ServerName:         serverName,
+		RootCAs:            opts.RootCAs,
 		ClientSessionCache: tls.NewLRUClientSessionCache(opts.PoolOpts.Capacity),
 	}
 
-	// The TLS dialer wraps the custom TCP dialer with a TLS encryption layer and R/W timeouts.
-	tlsDialer := func() (net.Conn, error) {
-		conn, err := dialer.Dial("tcp", addr)
+	// The TLS dialer wraps the custom TCP dialer with a TLS encryption layer.
+	tlsDialer := func(ctx context.Context) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
 		if err != nil {
-			return nil, fmt.Errorf("client: error establishing connection: err=%v", err)
+			return nil, fmt.Errorf("client: error establishing connection: err=%w", err)
 		}
 
 		// Implicitly set a TLS handshake timeout by enforcing a R/W deadline on the
@@ -101,53 +171,156 @@ func NewTLSClient(addr string, serverName string, cxHook metrics.ConnectionLifec
 			conn.SetDeadline(time.Now().Add(opts.HandshakeTimeout))
 		}
 
+		// Abort the handshake by expiring the deadline if the context is done first. The
+		// watcher is stopped before the deadline is cleared, so that it cannot expire the
+		// deadline of an established connection.
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+
+		go func() {
+			defer close(stopped)
+
+			select {
+			case <-ctx.Done():
+				conn.SetDeadline(time.Unix(1, 0))
+			case <-done:
+			}
+		}()
+
 		tlsConn := tls.Client(conn, conf)
-		if err := tlsConn.Handshake(); err != nil {
+		err = tlsConn.Handshake()
+
+		close(done)
+		<-stopped
+
+		if err == nil {
+			err = ctx.Err()
+		}
+
+		if err != nil {
 			go conn.Close()
-			return nil, fmt.Errorf("client: TLS handshake failed: err=%v", err)
+			return nil, fmt.Errorf("client: TLS handshake failed: err=%w", err)
 		}
 
-		return NewTCPConn(tlsConn, opts.ReadTimeout, opts.WriteTimeout), nil
+		// Clear the handshake deadline; subsequent I/O timeouts are managed by the caller.
+		conn.SetDeadline(time.Time{})
+
+		return tlsConn, nil
 	}
 
-	pool := NewPersistentConnPool(tlsDialer, cxHook, opts.PoolOpts)
+	var pool connPool
+
+	if opts.Pipelining {
+		// Pipelined sessions manage their own per-transaction timeouts, since the session
+		// itself is expected to remain idle between transactions.
+		pool = NewPipelinedSessionPool(tlsDialer, cxHook, PipelinedSessionPoolOpts{
+			Capacity:     opts.PoolOpts.Capacity,
+			StaleTimeout: opts.PoolOpts.StaleTimeout,
+			ReadTimeout:  opts.ReadTimeout,
+			WriteTimeout: opts.WriteTimeout,
+		})
+	} else {
+		// Pooled connections are wrapped with R/W timeouts for each transaction.
+		pool = NewPersistentConnPool(func(ctx context.Context) (net.Conn, error) {
+			conn, err := tlsDialer(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			return NewTCPConn(conn, opts.ReadTimeout, opts.WriteTimeout), nil
+		}, cxHook, opts.PoolOpts)
+	}
 
 	return &TLSClient{
-		addr:  addr,
-		pool:  pool,
-		stats: Stats{},
+		addr: addr,
+		pool: pool,
 	}, nil
 }
 
 // Conn retrieves a single persistent connection from the pool.
-func (c *TLSClient) Conn() (*PersistentConn, error) {
-	conn, err := c.pool.Conn()
-
-	defer func() {
-		go func() {
-			c.statsMutex.Lock()
-			defer c.statsMutex.Unlock()
-
-			if err != nil {
-				c.stats.FailedConnections++
-			} else {
-				c.stats.SuccessfulConnections++
-			}
-		}()
-	}()
+func (c *TLSClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	return c.stats.track(c.pool.Conn(ctx))
+}
 
-	return conn, err
+// Close closes the connections in the pool.
+func (c *TLSClient) Close() error {
+	return c.pool.Close()
 }
 
 // Stats returns current client stats.
 func (c *TLSClient) Stats() Stats {
-	c.statsMutex.RLock()
-	defer c.statsMutex.RUnlock()
-
-	return c.stats
+	return c.stats.snapshot()
 }
 
 // String returns a string representation of the client.
 func (c *TLSClient) String() string {
 	return fmt.Sprintf("TLSClient{addr: %s, connections: %d}", c.addr, c.pool.Size())
 }
+
+// track records the outcome of a request for a connection. A provided connection is counted as
+// active until it is closed, and the latency of the transaction performed on it is recorded when it
+// is observed.
+func (t *statsTracker) track(conn *PersistentConn, err error) (*PersistentConn, error) {
+	if err != nil {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+
+		t.stats.FailedConnections++
+		t.observeLatency(failedTransactionLatency)
+
+		return nil, err
+	}
+
+	t.mutex.Lock()
+	t.stats.SuccessfulConnections++
+	t.stats.ActiveConnections++
+	t.mutex.Unlock()
+
+	closer := conn.closer
+	observer := conn.observer
+
+	conn.closer = func(destroyed bool) error {
+		t.mutex.Lock()
+		t.stats.ActiveConnections--
+		t.mutex.Unlock()
+
+		return closer(destroyed)
+	}
+
+	conn.observer = func(latency time.Duration, success bool) {
+		sample := latency
+		if !success && sample < failedTransactionLatency {
+			sample = failedTransactionLatency
+		}
+
+		t.mutex.Lock()
+		t.observeLatency(sample)
+		t.mutex.Unlock()
+
+		if observer != nil {
+			observer(latency, success)
+		}
+	}
+
+	return conn, nil
+}
+
+// observeLatency folds a latency sample into the moving average. The caller must hold the mutex.
+func (t *statsTracker) observeLatency(latency time.Duration) {
+	if t.stats.Latency == 0 {
+		t.stats.Latency = latency
+		return
+	}
+
+	t.stats.Latency = time.Duration(
+		latencySmoothing*float64(latency) + (1-latencySmoothing)*float64(t.stats.Latency),
+	)
+}
+
+// snapshot returns the current stats.
+func (t *statsTracker) snapshot() Stats {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.stats
+}
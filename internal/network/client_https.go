@@ -0,0 +1,310 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"lib.kevinlin.info/aperture/lib"
+
+	"dotproxy/internal/metrics"
+)
+
+// HTTPSClient describes a DNS-over-HTTPS client that sends queries to a remote server over
+// persistent HTTP/2 connections. Connections are pooled and multiplexed by the HTTP transport;
+// each connection provided by the client represents a single HTTP request-response exchange.
+type HTTPSClient struct {
+	url    *url.URL
+	addr   *httpsAddr
+	client *http.Client
+	opts   HTTPSClientOpts
+	stats  statsTracker
+}
+
+// HTTPSClientOpts formalizes DNS-over-HTTPS client configuration options.
+type HTTPSClientOpts struct {
+	// PoolOpts are connection pool-specific options. Only the capacity, which bounds the number
+	// of idle connections held open to the server, and the stale timeout, which closes idle
+	// connections, are applicable.
+	PoolOpts PersistentConnPoolOpts
+	// ConnectTimeout is the timeout associated with establishing a connection with the remote
+	// server.
+	ConnectTimeout time.Duration
+	// HandshakeTimeout is the timeout associated with performing a TLS handshake with the
+	// remote server, after a connection has been successfully established.
+	HandshakeTimeout time.Duration
+	// ReadTimeout is the timeout associated with reading the HTTP response from the remote
+	// server, after the request has been sent.
+	ReadTimeout time.Duration
+	// WriteTimeout is the timeout associated with sending the HTTP request to the remote server.
+	WriteTimeout time.Duration
+	// RootCAs is the set of certificate authorities against which the server identity is
+	// verified. If nil, the host's root certificate authorities are used.
+	RootCAs *x509.CertPool
+	// Resolver, if specified, resolves the URL's hostname through bootstrap servers whenever a
+	// connection is established, rather than through the system resolver.
+	Resolver *BootstrapResolver
+}
+
+// httpsConn is a net.Conn adapter that represents a single DNS-over-HTTPS transaction. A framed
+// query written to the connection is buffered until the first read, at which point it is sent to
+// the server as an HTTP POST request; the response body is then framed and made available to
+// subsequent reads.
+type httpsConn struct {
+	ctx    context.Context
+	client *HTTPSClient
+	req    bytes.Buffer
+	resp   *bytes.Reader
+}
+
+// hookedConn is a net.Conn that reports its closure to a connection lifecycle hook, for
+// connections whose lifecycle is managed outside of this package.
+type hookedConn struct {
+	cxHook metrics.ConnectionLifecycleHook
+	once   sync.Once
+
+	net.Conn
+}
+
+// httpsAddr is a net.Addr describing the remote endpoint of a DNS-over-HTTPS server.
+type httpsAddr struct {
+	host string
+}
+
+// NewHTTPSClient creates an HTTPSClient that sends queries to the DNS-over-HTTPS endpoint at the
+// specified URL. The server's identity is verified against serverName, or against the URL's
+// hostname if serverName is empty.
+func NewHTTPSClient(rawURL string, serverName string, cxHook metrics.ConnectionLifecycleHook, opts HTTPSClientOpts) (*HTTPSClient, error) {
+	endpoint, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("client: error parsing DNS-over-HTTPS URL: url=%s err=%v", rawURL, err)
+	}
+
+	if endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("client: DNS-over-HTTPS URL must be absolute with scheme https: url=%s", rawURL)
+	}
+
+	if serverName == "" {
+		serverName = endpoint.Hostname()
+	}
+
+	host := endpoint.Host
+	if endpoint.Port() == "" {
+		host = net.JoinHostPort(endpoint.Hostname(), "443")
+	}
+
+	// Use a custom dialer that sets the TCP Fast Open socket option and a connection timeout.
+	dialer := &net.Dialer{
+		Timeout: opts.ConnectTimeout,
+		Control: func(network string, addr string, rc syscall.RawConn) error {
+			return rc.Control(func(fd uintptr) {
+				syscall.SetsockoptInt(
+					int(fd),
+					syscall.IPPROTO_TCP,
+					tcpFastOpenConnect,
+					1,
+				)
+			})
+		},
+	}
+
+	dial := dialer.DialContext
+	if opts.Resolver != nil {
+		dial = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return opts.Resolver.Dial(ctx, dialer, network, addr)
+		}
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			dialTimer := lib.NewStopwatch()
+
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				cxHook.EmitConnectionError()
+				return nil, fmt.Errorf("client: error establishing connection: err=%w", err)
+			}
+
+			cxHook.EmitConnectionOpen(dialTimer.Elapsed(), conn.RemoteAddr())
+
+			return &hookedConn{cxHook: cxHook, Conn: conn}, nil
+		},
+		TLSClientConfig: &tls.Config{
+			ServerName:         serverName,
+			RootCAs:            opts.RootCAs,
+			ClientSessionCache: tls.NewLRUClientSessionCache(opts.PoolOpts.Capacity),
+		},
+		// A custom dialer disables HTTP/2 unless it is explicitly requested.
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: opts.HandshakeTimeout,
+		MaxIdleConnsPerHost: opts.PoolOpts.Capacity,
+		IdleConnTimeout:     opts.PoolOpts.StaleTimeout,
+	}
+
+	return &HTTPSClient{
+		url:    endpoint,
+		addr:   &httpsAddr{host: host},
+		client: &http.Client{Transport: transport},
+		opts:   opts,
+	}, nil
+}
+
+// Conn provides a connection representing a single DNS-over-HTTPS transaction. The underlying
+// HTTP connection is established lazily when the transaction is performed, so I/O errors are
+// reported on read rather than here. The HTTP request is abandoned if the context is done first.
+func (c *HTTPSClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	conn := &httpsConn{ctx: ctx, client: c}
+
+	return c.stats.track(NewPersistentConn(conn, func(destroyed bool) error {
+		return conn.Close()
+	}), nil)
+}
+
+// Close closes the HTTP connections that are idle.
+func (c *HTTPSClient) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+// Stats returns current client stats.
+func (c *HTTPSClient) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// String returns a string representation of the client.
+func (c *HTTPSClient) String() string {
+	return fmt.Sprintf("HTTPSClient{url: %s}", c.url)
+}
+
+// transact sends a single DNS query, without its length header, to the server and returns the
+// response message, abandoning the request if the context is done first.
+func (c *HTTPSClient) transact(ctx context.Context, msg []byte) ([]byte, error) {
+	timeout := c.opts.WriteTimeout + c.opts.ReadTimeout
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url.String(), bytes.NewReader(msg))
+	if err != nil {
+		return nil, fmt.Errorf("client: error creating HTTP request: err=%v", err)
+	}
+
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	req.Header.Set("Accept", dnsMessageContentType)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("client: error performing HTTP request: err=%w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("client: unexpected HTTP response status: status=%d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("client: error reading HTTP response body: err=%w", err)
+	}
+
+	if len(body) < minMessageSize || len(body) > MaxMessageSize {
+		return nil, fmt.Errorf("client: invalid DNS response size: size=%d", len(body))
+	}
+
+	return body, nil
+}
+
+// Read performs the transaction on the first invocation, then reads from the framed response.
+func (c *httpsConn) Read(b []byte) (int, error) {
+	if c.resp == nil {
+		req := c.req.Bytes()
+		if len(req) < 2 || int(binary.BigEndian.Uint16(req)) != len(req)-2 {
+			return 0, fmt.Errorf("client: incomplete DNS-over-HTTPS request: size=%d", len(req))
+		}
+
+		resp, err := c.client.transact(c.ctx, req[2:])
+		if err != nil {
+			return 0, err
+		}
+
+		framed := make([]byte, len(resp)+2)
+		binary.BigEndian.PutUint16(framed, uint16(len(resp)))
+		copy(framed[2:], resp)
+
+		c.resp = bytes.NewReader(framed)
+	}
+
+	return c.resp.Read(b)
+}
+
+// Write buffers the framed query until it is sent on the first read.
+func (c *httpsConn) Write(b []byte) (int, error) {
+	if c.resp != nil {
+		return 0, fmt.Errorf("client: DNS-over-HTTPS transaction already performed")
+	}
+
+	return c.req.Write(b)
+}
+
+// Close is a noop; the underlying HTTP connection is managed by the client's transport.
+func (c *httpsConn) Close() error {
+	return nil
+}
+
+// LocalAddr is not meaningful for a DNS-over-HTTPS transaction.
+func (c *httpsConn) LocalAddr() net.Addr {
+	return nil
+}
+
+// RemoteAddr returns the address of the DNS-over-HTTPS server.
+func (c *httpsConn) RemoteAddr() net.Addr {
+	return c.client.addr
+}
+
+// SetDeadline is a noop; timeouts are enforced per transaction by the client.
+func (c *httpsConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline is a noop; timeouts are enforced per transaction by the client.
+func (c *httpsConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline is a noop; timeouts are enforced per transaction by the client.
+func (c *httpsConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Close closes the underlying connection, emitting a close event exactly once.
+func (c *hookedConn) Close() error {
+	c.once.Do(func() {
+		c.cxHook.EmitConnectionClose(c.Conn.RemoteAddr())
+	})
+
+	return c.Conn.Close()
+}
+
+// Network returns the name of the network.
+func (a *httpsAddr) Network() string {
+	return "https"
+}
+
+// String returns the host and port of the server.
+func (a *httpsAddr) String() string {
+	return a.host
+}
@@ -0,0 +1,274 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"lib.kevinlin.info/aperture/lib"
+
+	"dotproxy/internal/dns"
+	"dotproxy/internal/metrics"
+)
+
+// TCPClient describes a plaintext TCP client that recycles connections in a pool. It is intended
+// for trusted internal resolvers that do not support encrypted transports.
+type TCPClient struct {
+	addr  string
+	pool  *PersistentConnPool
+	stats statsTracker
+}
+
+// TCPClientOpts formalizes TCP client configuration options.
+type TCPClientOpts struct {
+	// PoolOpts are connection pool-specific options.
+	PoolOpts PersistentConnPoolOpts
+	// ConnectTimeout is the timeout associated with establishing a connection with the remote
+	// server.
+	ConnectTimeout time.Duration
+	// ReadTimeout is the timeout associated with each read from a remote connection.
+	ReadTimeout time.Duration
+	// WriteTimeout is the timeout associated with each write to a remote connection.
+	WriteTimeout time.Duration
+}
+
+// UDPClient describes a plaintext UDP client. Each query is sent from its own socket, so that
+// responses cannot be confused across queries and the source port is unpredictable. Truncated
+// responses are retried over TCP, per RFC 7766.
+type UDPClient struct {
+	addr     string
+	cxHook   metrics.ConnectionLifecycleHook
+	dialer   *net.Dialer
+	fallback *TCPClient
+	opts     UDPClientOpts
+	stats    statsTracker
+}
+
+// UDPClientOpts formalizes UDP client configuration options.
+type UDPClientOpts struct {
+	// PoolOpts are connection pool-specific options for the TCP client used to retry truncated
+	// responses. Since truncated responses are rare, the pool is always lazily populated.
+	PoolOpts PersistentConnPoolOpts
+	// ConnectTimeout is the timeout associated with establishing a TCP connection with the
+	// remote server, when retrying a truncated response.
+	ConnectTimeout time.Duration
+	// ReadTimeout is the timeout associated with awaiting a response from the remote server.
+	ReadTimeout time.Duration
+	// WriteTimeout is the timeout associated with sending a query to the remote server.
+	WriteTimeout time.Duration
+}
+
+// udpClientConn is a net.Conn adapter for a single DNS-over-UDP transaction. The framed query
+// written to it is sent, without its length header, in a single datagram; the response is read
+// on the first read, and framed for consistency with stream transports.
+type udpClientConn struct {
+	ctx    context.Context
+	client *UDPClient
+	req    bytes.Buffer
+	resp   *bytes.Reader
+
+	net.Conn
+}
+
+// NewTCPClient creates a TCPClient pool, connected to a specified remote address.
+func NewTCPClient(addr string, cxHook metrics.ConnectionLifecycleHook, opts TCPClientOpts) (*TCPClient, error) {
+	dialer := &net.Dialer{Timeout: opts.ConnectTimeout}
+
+	pool := NewPersistentConnPool(func(ctx context.Context) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("client: error establishing connection: err=%w", err)
+		}
+
+		return NewTCPConn(conn, opts.ReadTimeout, opts.WriteTimeout), nil
+	}, cxHook, opts.PoolOpts)
+
+	return &TCPClient{
+		addr: addr,
+		pool: pool,
+	}, nil
+}
+
+// Conn retrieves a single persistent connection from the pool.
+func (c *TCPClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	return c.stats.track(c.pool.Conn(ctx))
+}
+
+// Close closes the connections in the pool.
+func (c *TCPClient) Close() error {
+	return c.pool.Close()
+}
+
+// Stats returns current client stats.
+func (c *TCPClient) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// String returns a string representation of the client.
+func (c *TCPClient) String() string {
+	return fmt.Sprintf("TCPClient{addr: %s, connections: %d}", c.addr, c.pool.Size())
+}
+
+// NewUDPClient creates a UDPClient for the server at the specified address.
+func NewUDPClient(addr string, cxHook metrics.ConnectionLifecycleHook, opts UDPClientOpts) (*UDPClient, error) {
+	opts.PoolOpts.Lazy = true
+
+	fallback, err := NewTCPClient(addr, cxHook, TCPClientOpts{
+		PoolOpts:       opts.PoolOpts,
+		ConnectTimeout: opts.ConnectTimeout,
+		ReadTimeout:    opts.ReadTimeout,
+		WriteTimeout:   opts.WriteTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &UDPClient{
+		addr:     addr,
+		cxHook:   cxHook,
+		dialer:   &net.Dialer{},
+		fallback: fallback,
+		opts:     opts,
+	}, nil
+}
+
+// Conn opens a new socket for a single transaction. The context also governs establishing a TCP
+// connection, if the response is truncated.
+func (c *UDPClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	return c.stats.track(c.dial(ctx))
+}
+
+// dial opens a new socket.
+func (c *UDPClient) dial(ctx context.Context) (*PersistentConn, error) {
+	dialTimer := lib.NewStopwatch()
+
+	conn, err := c.dialer.DialContext(ctx, "udp", c.addr)
+	if err != nil {
+		c.cxHook.EmitConnectionError()
+		return nil, fmt.Errorf("client: error opening UDP socket: err=%w", err)
+	}
+
+	c.cxHook.EmitConnectionOpen(dialTimer.Elapsed(), conn.RemoteAddr())
+
+	// Sockets are never reused, regardless of whether the transaction succeeded.
+	return NewPersistentConn(&udpClientConn{ctx: ctx, client: c, Conn: conn}, func(destroyed bool) error {
+		c.cxHook.EmitConnectionClose(conn.RemoteAddr())
+		return conn.Close()
+	}), nil
+}
+
+// Close closes the pooled connections used to retry truncated responses over TCP.
+func (c *UDPClient) Close() error {
+	return c.fallback.Close()
+}
+
+// Stats returns current client stats.
+func (c *UDPClient) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// String returns a string representation of the client.
+func (c *UDPClient) String() string {
+	return fmt.Sprintf("UDPClient{addr: %s}", c.addr)
+}
+
+// Write buffers the framed query until it is complete, then sends it in a single datagram.
+func (c *udpClientConn) Write(buf []byte) (n int, err error) {
+	c.req.Write(buf)
+
+	req := c.req.Bytes()
+	if len(req) < 2 || int(binary.BigEndian.Uint16(req)) > len(req)-2 {
+		return len(buf), nil
+	}
+
+	if c.client.opts.WriteTimeout > 0 {
+		if err := c.SetWriteDeadline(time.Now().Add(c.client.opts.WriteTimeout)); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := c.Conn.Write(req[2:]); err != nil {
+		return 0, err
+	}
+
+	return len(buf), nil
+}
+
+// Read awaits the response on the first invocation, retrying the query over TCP if the response
+// is truncated, then reads from the framed response.
+func (c *udpClientConn) Read(buf []byte) (n int, err error) {
+	if c.resp == nil {
+		resp, err := c.exchange()
+		if err != nil {
+			return 0, err
+		}
+
+		c.resp = bytes.NewReader(resp)
+	}
+
+	return c.resp.Read(buf)
+}
+
+// exchange reads the response to the sent query, and returns it framed with a length header.
+func (c *udpClientConn) exchange() ([]byte, error) {
+	req := c.req.Bytes()
+	if len(req) < 2+dns.HeaderSize {
+		return nil, fmt.Errorf("client: incomplete UDP request: size=%d", len(req))
+	}
+
+	id := binary.BigEndian.Uint16(req[2:])
+
+	if c.client.opts.ReadTimeout > 0 {
+		if err := c.SetReadDeadline(time.Now().Add(c.client.opts.ReadTimeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	resp := make([]byte, MaxMessageSize+2)
+
+	for {
+		size, err := c.Conn.Read(resp[2:])
+		if err != nil {
+			return nil, err
+		}
+
+		// Datagrams that do not answer the query are discarded; they may be late responses to
+		// a previous query or spoofed.
+		header, err := dns.ParseHeader(resp[2 : 2+size])
+		if err != nil || !header.Response() || header.ID != id {
+			continue
+		}
+
+		if header.Truncated() {
+			return c.exchangeTCP(req)
+		}
+
+		binary.BigEndian.PutUint16(resp, uint16(size))
+
+		return resp[:2+size], nil
+	}
+}
+
+// exchangeTCP retries the framed query over a TCP connection, returning the framed response.
+func (c *udpClientConn) exchangeTCP(req []byte) ([]byte, error) {
+	conn, err := c.client.fallback.Conn(c.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		conn.Destroy()
+		return nil, fmt.Errorf("client: error writing TCP fallback request: err=%w", err)
+	}
+
+	resp, err := NewFramedReader(conn, MaxMessageSize).ReadFrame()
+	if err != nil {
+		conn.Destroy()
+		return nil, fmt.Errorf("client: error reading TCP fallback response: err=%w", err)
+	}
+
+	return resp, conn.Close()
+}
@@ -0,0 +1,269 @@
+//go:build doq
+// +build doq
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lucas-clemente/quic-go"
+	"lib.kevinlin.info/aperture/lib"
+
+	"dotproxy/internal/metrics"
+)
+
+// QUICClient describes a DNS-over-QUIC client, per RFC 9250. Queries are multiplexed as independent
+// streams over a small number of long-lived QUIC sessions, so that a lost packet delays only the
+// query it belongs to. Sessions are resumed with 0-RTT when the server supports it.
+type QUICClient struct {
+	addr      string
+	cxHook    metrics.ConnectionLifecycleHook
+	tlsConf   *tls.Config
+	quicConf  *quic.Config
+	opts      QUICClientOpts
+	slots     []*quicSessionSlot
+	slotIdx   int
+	slotMutex sync.Mutex
+	stats     statsTracker
+	// Whether the client has been closed, set atomically.
+	closed int32
+}
+
+// quicSessionSlot holds a single, lazily (re)established session.
+type quicSessionSlot struct {
+	session quic.Session
+	mutex   sync.Mutex
+}
+
+// quicClientConn is a net.Conn adapter for a single DNS-over-QUIC transaction. RFC 9250 requires
+// that the message ID of every query be zero, since the stream itself identifies the transaction,
+// so the ID is cleared on write and the original ID is restored to the response on read.
+type quicClientConn struct {
+	id   uint16
+	req  bytes.Buffer
+	resp *bytes.Reader
+
+	*QUICStreamConn
+}
+
+// NewQUICClient creates a QUICClient for the server at the specified address, validating the
+// server identity against serverName. Sessions are established lazily, on first use.
+func NewQUICClient(addr string, serverName string, cxHook metrics.ConnectionLifecycleHook, opts QUICClientOpts) (*QUICClient, error) {
+	// Sane option defaults
+	if opts.PoolOpts.Capacity <= 0 {
+		opts.PoolOpts.Capacity = 1
+	}
+
+	slots := make([]*quicSessionSlot, opts.PoolOpts.Capacity)
+	for i := range slots {
+		slots[i] = &quicSessionSlot{}
+	}
+
+	return &QUICClient{
+		addr:   addr,
+		cxHook: cxHook,
+		tlsConf: &tls.Config{
+			ServerName:         serverName,
+			RootCAs:            opts.RootCAs,
+			NextProtos:         []string{doqALPN},
+			ClientSessionCache: tls.NewLRUClientSessionCache(opts.PoolOpts.Capacity),
+		},
+		quicConf: &quic.Config{
+			HandshakeTimeout: opts.ConnectTimeout + opts.HandshakeTimeout,
+			MaxIdleTimeout:   opts.PoolOpts.StaleTimeout,
+		},
+		opts:  opts,
+		slots: slots,
+	}, nil
+}
+
+// Conn opens a new stream for a single transaction on one of the client's sessions, establishing
+// the session first if necessary. Establishing the session and opening the stream are abandoned if
+// the context is done first.
+func (c *QUICClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	conn, err := c.open(ctx)
+	if err != nil {
+		return c.stats.track(nil, err)
+	}
+
+	return c.stats.track(NewPersistentConn(conn, func(destroyed bool) error {
+		// An incomplete transaction is abandoned so that the server stops working on it; a
+		// complete transaction has already closed its stream in both directions.
+		if destroyed {
+			conn.Abort(doqRequestCancelled)
+		}
+
+		return nil
+	}), nil)
+}
+
+// Close closes every session, failing all in-flight transactions. Subsequent requests for
+// connections fail.
+func (c *QUICClient) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+
+	for _, slot := range c.slots {
+		slot.mutex.Lock()
+		if slot.session != nil {
+			slot.session.CloseWithError(doqNoError, "")
+			slot.session = nil
+		}
+		slot.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// Stats returns current client stats.
+func (c *QUICClient) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// String returns a string representation of the client.
+func (c *QUICClient) String() string {
+	return fmt.Sprintf("QUICClient{addr: %s, sessions: %d}", c.addr, len(c.slots))
+}
+
+// open opens a stream on the next session in round-robin order.
+func (c *QUICClient) open(ctx context.Context) (*quicClientConn, error) {
+	c.slotMutex.Lock()
+	slot := c.slots[c.slotIdx]
+	c.slotIdx = (c.slotIdx + 1) % len(c.slots)
+	c.slotMutex.Unlock()
+
+	session, err := c.session(ctx, slot)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.opts.WriteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.WriteTimeout)
+		defer cancel()
+	}
+
+	// Opening a stream blocks if the server's limit on concurrent streams has been reached.
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("client: error opening QUIC stream: err=%w", err)
+	}
+
+	return &quicClientConn{
+		QUICStreamConn: NewQUICStreamConn(
+			stream,
+			session.LocalAddr(),
+			session.RemoteAddr(),
+			c.opts.ReadTimeout,
+			c.opts.WriteTimeout,
+		),
+	}, nil
+}
+
+// session returns the slot's session, establishing a new one if the slot is empty or its session
+// has been closed.
+func (c *QUICClient) session(ctx context.Context, slot *quicSessionSlot) (quic.Session, error) {
+	slot.mutex.Lock()
+	defer slot.mutex.Unlock()
+
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return nil, fmt.Errorf("client: client is closed")
+	}
+
+	if slot.session != nil {
+		select {
+		case <-slot.session.Context().Done():
+		default:
+			return slot.session, nil
+		}
+	}
+
+	dialTimer := lib.NewStopwatch()
+
+	session, err := c.dial(ctx)
+	if err != nil {
+		c.cxHook.EmitConnectionError()
+		return nil, fmt.Errorf("client: error establishing QUIC session: err=%w", err)
+	}
+
+	c.cxHook.EmitConnectionOpen(dialTimer.Elapsed(), session.RemoteAddr())
+
+	go func() {
+		<-session.Context().Done()
+		c.cxHook.EmitConnectionClose(session.RemoteAddr())
+	}()
+
+	slot.session = session
+
+	return session, nil
+}
+
+// dial establishes a new session, abandoning it if the context is done first. An abandoned session
+// is closed once it is established, since it will never be used.
+func (c *QUICClient) dial(ctx context.Context) (quic.Session, error) {
+	type dialResult struct {
+		session quic.Session
+		err     error
+	}
+
+	results := make(chan dialResult, 1)
+
+	go func() {
+		session, err := quic.DialAddrEarly(c.addr, c.tlsConf, c.quicConf)
+		results <- dialResult{session, err}
+	}()
+
+	select {
+	case result := <-results:
+		return result.session, result.err
+	case <-ctx.Done():
+		go func() {
+			if result := <-results; result.err == nil {
+				result.session.CloseWithError(doqNoError, "")
+			}
+		}()
+
+		return nil, ctx.Err()
+	}
+}
+
+// Write buffers the framed query until it is complete, then sends it with a zero message ID and
+// closes the sending direction of the stream.
+func (c *quicClientConn) Write(buf []byte) (n int, err error) {
+	c.req.Write(buf)
+
+	req := c.req.Bytes()
+	if len(req) < 4 || int(binary.BigEndian.Uint16(req)) > len(req)-2 {
+		return len(buf), nil
+	}
+
+	c.id = binary.BigEndian.Uint16(req[2:])
+	binary.BigEndian.PutUint16(req[2:], 0)
+
+	if _, err := c.QUICStreamConn.Write(req); err != nil {
+		return 0, err
+	}
+
+	return len(buf), c.Close()
+}
+
+// Read reads the complete framed response on the first invocation, restoring the query's original
+// message ID, then reads from the buffered response.
+func (c *quicClientConn) Read(buf []byte) (n int, err error) {
+	if c.resp == nil {
+		resp, err := NewFramedReader(c.QUICStreamConn, MaxMessageSize).ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		binary.BigEndian.PutUint16(resp[2:], c.id)
+		c.resp = bytes.NewReader(resp)
+	}
+
+	return c.resp.Read(buf)
+}
@@ -0,0 +1,28 @@
+package network
+
+import (
+	"crypto/x509"
+	"time"
+)
+
+// QUICClientOpts formalizes DNS-over-QUIC client configuration options.
+type QUICClientOpts struct {
+	// PoolOpts are connection pool-specific options. The capacity describes the number of QUIC
+	// sessions to maintain, and the stale timeout describes the idle timeout after which a
+	// session is closed.
+	PoolOpts PersistentConnPoolOpts
+	// ConnectTimeout is the timeout associated with establishing a session with the remote
+	// server. Since QUIC performs the connection and TLS handshakes together, it is combined
+	// with the handshake timeout.
+	ConnectTimeout time.Duration
+	// HandshakeTimeout is the timeout associated with performing a TLS handshake with the
+	// remote server.
+	HandshakeTimeout time.Duration
+	// ReadTimeout is the timeout associated with each read from a remote stream.
+	ReadTimeout time.Duration
+	// WriteTimeout is the timeout associated with opening, and each write to, a remote stream.
+	WriteTimeout time.Duration
+	// RootCAs is the set of certificate authorities against which the server identity is
+	// verified. If nil, the host's root certificate authorities are used.
+	RootCAs *x509.CertPool
+}
@@ -0,0 +1,225 @@
+//go:build doq
+// +build doq
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dotproxy/internal/dns"
+)
+
+// recordingLifecycleHook counts connection lifecycle events.
+type recordingLifecycleHook struct {
+	opens  int32
+	closes int32
+	errors int32
+}
+
+// doqStubHandler answers every query with a response echoing its question, recording the message
+// ID with which each query arrived.
+type doqStubHandler struct {
+	ids chan uint16
+}
+
+func (h *recordingLifecycleHook) EmitConnectionOpen(latency time.Duration, addr net.Addr) {
+	atomic.AddInt32(&h.opens, 1)
+}
+
+func (h *recordingLifecycleHook) EmitConnectionClose(addr net.Addr) {
+	atomic.AddInt32(&h.closes, 1)
+}
+
+func (h *recordingLifecycleHook) EmitConnectionError() {
+	atomic.AddInt32(&h.errors, 1)
+}
+
+func (h *doqStubHandler) Handle(ctx context.Context, conn net.Conn) error {
+	req, err := NewFramedReader(conn, MaxMessageSize).ReadFrame()
+	if err != nil {
+		return err
+	}
+
+	h.ids <- binary.BigEndian.Uint16(req[2:])
+
+	// Set the QR bit, leaving the rest of the query, including its ID, untouched.
+	resp := append([]byte(nil), req...)
+	resp[4] |= 0x80
+
+	_, err = conn.Write(resp)
+
+	return err
+}
+
+func (h *doqStubHandler) ConsumeError(ctx context.Context, err error) {}
+
+func TestQUICClientRoundTrip(t *testing.T) {
+	certFile, keyFile, roots := writeTestCertificate(t)
+	addr := freeUDPAddr(t)
+
+	serverHook := &recordingLifecycleHook{}
+	handler := &doqStubHandler{ids: make(chan uint16, 1)}
+
+	server, err := NewQUICServer(addr, certFile, keyFile, serverHook, QUICServerOpts{
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+		IdleTimeout:  10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+
+	go server.ListenAndServe(handler)
+
+	clientHook := &recordingLifecycleHook{}
+
+	client, err := NewQUICClient(addr, "localhost", clientHook, QUICClientOpts{
+		PoolOpts:         PersistentConnPoolOpts{Capacity: 1, StaleTimeout: 10 * time.Second},
+		HandshakeTimeout: time.Second,
+		ReadTimeout:      time.Second,
+		WriteTimeout:     time.Second,
+		RootCAs:          roots,
+	})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+
+	query, err := dns.NewQuery(0x1234, "example.com", dns.TypeA)
+	if err != nil {
+		t.Fatalf("error creating query: %v", err)
+	}
+
+	req := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(req, uint16(len(query)))
+	req = append(req, query...)
+
+	// The server is started asynchronously, so the first sessions may fail to establish.
+	var conn *PersistentConn
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if conn, err = client.Conn(context.Background()); err == nil {
+			break
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err != nil {
+		t.Fatalf("error opening stream: %v", err)
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("error writing query: %v", err)
+	}
+
+	resp, err := NewFramedReader(conn, MaxMessageSize).ReadFrame()
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+
+	conn.Close()
+
+	select {
+	case id := <-handler.ids:
+		if id != 0 {
+			t.Errorf("expected query to be sent with message ID 0: id=%d", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not receive query")
+	}
+
+	if id := binary.BigEndian.Uint16(resp[2:]); id != 0x1234 {
+		t.Errorf("expected original message ID to be restored: id=%#x", id)
+	}
+
+	expected := append([]byte(nil), query...)
+	expected[2] |= 0x80
+
+	if !bytes.Equal(resp[2:], expected) {
+		t.Errorf("unexpected response: resp=%x", resp[2:])
+	}
+
+	if opens := atomic.LoadInt32(&clientHook.opens); opens != 1 {
+		t.Errorf("expected client to report one session open: opens=%d", opens)
+	}
+
+	if opens := atomic.LoadInt32(&serverHook.opens); opens != 1 {
+		t.Errorf("expected server to report one session open: opens=%d", opens)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate and key for localhost to a temporary
+// directory, returning their paths and a pool trusting the certificate.
+func writeTestCertificate(t *testing.T) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error encoding key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("error writing certificate: %v", err)
+	}
+
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("error writing key: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+
+	return certFile, keyFile, roots
+}
+
+// freeUDPAddr returns a loopback UDP address that is not currently bound.
+func freeUDPAddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error binding UDP socket: %v", err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().String()
+}
@@ -1,8 +1,12 @@
 package network
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,6 +28,51 @@ type TCPConn struct {
 	net.Conn
 }
 
+// MessageConn is an abstraction over a single request that has already been read from a shared,
+// stream-oriented client connection. Reads are served from the buffered request, and writes are
+// serialized onto the shared connection, allowing several requests pipelined on the same
+// connection to be handled concurrently.
+type MessageConn struct {
+	msg        *bytes.Reader
+	writeMutex *sync.Mutex
+
+	net.Conn
+}
+
+// HTTPConn is an abstraction over a single DNS-over-HTTPS exchange to give it net.Conn-like
+// semantics. Reads are served from the DNS query carried by the HTTP request, and the response
+// written to it is retained for the HTTP response. Since the handler interface expects stream
+// semantics from non-UDP transports, the query is read with, and the response written with, a
+// two-octet length header.
+type HTTPConn struct {
+	req    *bytes.Reader
+	resp   []byte
+	remote net.Addr
+}
+
+// TransportListener is an abstraction over a net.Listener whose accepted connections report remote
+// addresses identifying a specific transport.
+type TransportListener struct {
+	transport Transport
+
+	net.Listener
+}
+
+// transportConn is a net.Conn whose remote address identifies a specific transport.
+type transportConn struct {
+	remote net.Addr
+
+	net.Conn
+}
+
+// transportAddr is a net.Addr that reports a specific transport as its network name. It allows
+// consumers to distinguish between transports layered over the same network, like TCP and TLS.
+type transportAddr struct {
+	transport Transport
+
+	net.Addr
+}
+
 // NewUDPConn creates a UDPConn from a backing net.PacketConn.
 func NewUDPConn(conn net.PacketConn, readTimeout time.Duration, writeTimeout time.Duration) *UDPConn {
 	return &UDPConn{
@@ -127,3 +176,126 @@ func (c *TCPConn) Write(buf []byte) (n int, err error) {
 
 	return c.Conn.Write(buf)
 }
+
+// NewMessageConn creates a MessageConn for a single buffered request read from the shared
+// connection. The write mutex must be shared among all MessageConns backed by the same connection.
+func NewMessageConn(conn net.Conn, msg []byte, writeMutex *sync.Mutex) *MessageConn {
+	return &MessageConn{
+		msg:        bytes.NewReader(msg),
+		writeMutex: writeMutex,
+		Conn:       conn,
+	}
+}
+
+// Read reads from the buffered request.
+func (c *MessageConn) Read(buf []byte) (n int, err error) {
+	return c.msg.Read(buf)
+}
+
+// Write writes to the shared connection, serialized with all other writes to the same connection.
+// Callers should write each response in a single call so that responses are not interleaved.
+func (c *MessageConn) Write(buf []byte) (n int, err error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	return c.Conn.Write(buf)
+}
+
+// Close is a noop; the lifecycle of the shared connection is owned by the server.
+func (c *MessageConn) Close() error {
+	return nil
+}
+
+// NewTransportListener wraps an existing net.Listener so that accepted connections identify the
+// specified transport.
+func NewTransportListener(ln net.Listener, transport Transport) *TransportListener {
+	return &TransportListener{transport: transport, Listener: ln}
+}
+
+// Accept accepts the next connection from the backing listener.
+func (l *TransportListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &transportConn{
+		remote: &transportAddr{transport: l.transport, Addr: conn.RemoteAddr()},
+		Conn:   conn,
+	}, nil
+}
+
+// RemoteAddr obtains the connection's remote address, identifying its transport.
+func (c *transportConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Network returns the name of the address's transport.
+func (a *transportAddr) Network() string {
+	return strings.ToLower(a.transport.String())
+}
+
+// NewHTTPConn creates an HTTPConn for a DNS query received from the specified remote address.
+func NewHTTPConn(msg []byte, remote net.Addr) *HTTPConn {
+	req := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(req, uint16(len(msg)))
+	copy(req[2:], msg)
+
+	return &HTTPConn{req: bytes.NewReader(req), remote: remote}
+}
+
+// Read reads from the length-prefixed DNS query.
+func (c *HTTPConn) Read(buf []byte) (n int, err error) {
+	return c.req.Read(buf)
+}
+
+// Write retains a single, complete, length-prefixed DNS response.
+func (c *HTTPConn) Write(buf []byte) (n int, err error) {
+	if c.resp != nil {
+		return 0, fmt.Errorf("conn: response already written")
+	}
+
+	if len(buf) < 2 || int(binary.BigEndian.Uint16(buf)) != len(buf)-2 {
+		return 0, fmt.Errorf("conn: response is not a single length-prefixed message")
+	}
+
+	c.resp = append([]byte(nil), buf[2:]...)
+
+	return len(buf), nil
+}
+
+// Response returns the DNS response written to the connection, without its length header, and
+// whether a response was written at all.
+func (c *HTTPConn) Response() ([]byte, bool) {
+	return c.resp, c.resp != nil
+}
+
+// Close is a noop; the lifecycle of the underlying HTTP connection is owned by the server.
+func (c *HTTPConn) Close() error {
+	return nil
+}
+
+// LocalAddr is unavailable for an HTTP exchange.
+func (c *HTTPConn) LocalAddr() net.Addr {
+	return nil
+}
+
+// RemoteAddr obtains the address of the HTTP client.
+func (c *HTTPConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline noops; timeouts are governed by the HTTP server.
+func (c *HTTPConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline noops; timeouts are governed by the HTTP server.
+func (c *HTTPConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline noops; timeouts are governed by the HTTP server.
+func (c *HTTPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,87 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// FramedReader reads length-prefixed DNS messages from a stream-oriented transport. Per RFC 1035
+// section 4.2.2, each message on a stream is prefixed with a two-octet, big-endian length header
+// describing the size of the message that follows.
+type FramedReader struct {
+	r       io.Reader
+	maxSize int
+}
+
+const (
+	// MaxMessageSize is the largest DNS message size that can be described by a two-octet
+	// length header.
+	MaxMessageSize = 65535
+
+	// minMessageSize is the smallest size of a well-formed DNS message, which must contain at
+	// least a complete header.
+	minMessageSize = 12
+)
+
+// NewFramedReader creates a FramedReader that reads messages from the specified reader, rejecting
+// those whose length header exceeds the maximum size. A non-positive maximum size permits messages
+// up to MaxMessageSize.
+func NewFramedReader(r io.Reader, maxSize int) *FramedReader {
+	if maxSize <= 0 || maxSize > MaxMessageSize {
+		maxSize = MaxMessageSize
+	}
+
+	return &FramedReader{r: r, maxSize: maxSize}
+}
+
+// ReadFrame reads exactly one message from the stream, tolerating a length header and message body
+// that arrive across several reads. The returned frame includes the two-octet length header. It
+// returns io.EOF if the stream ends cleanly before a new frame begins.
+func (f *FramedReader) ReadFrame() ([]byte, error) {
+	header := make([]byte, 2)
+
+	if n, err := io.ReadFull(f.r, header); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf(
+			"framing: short frame: failed reading length header: bytes=%d err=%w",
+			n,
+			err,
+		)
+	}
+
+	size := int(binary.BigEndian.Uint16(header))
+
+	if size < minMessageSize {
+		return nil, fmt.Errorf(
+			"framing: short frame: message smaller than DNS header: size=%d min=%d",
+			size,
+			minMessageSize,
+		)
+	}
+
+	if size > f.maxSize {
+		return nil, fmt.Errorf(
+			"framing: oversized frame: size=%d max=%d",
+			size,
+			f.maxSize,
+		)
+	}
+
+	frame := make([]byte, 2+size)
+	copy(frame, header)
+
+	if n, err := io.ReadFull(f.r, frame[2:]); err != nil {
+		return nil, fmt.Errorf(
+			"framing: short frame: failed reading message: expected=%d actual=%d err=%w",
+			size,
+			n,
+			err,
+		)
+	}
+
+	return frame, nil
+}
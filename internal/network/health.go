@@ -0,0 +1,282 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"dotproxy/internal/dns"
+	"dotproxy/internal/metrics"
+)
+
+// HealthCheckedClient is a Client that actively monitors the health of the upstream server behind
+// another Client. It periodically sends a probe query on a connection from the underlying client,
+// and marks the client unhealthy if the probe fails, times out, is answered with an error response
+// code, or is answered too slowly. A probe that fails on a pooled connection, which may have gone
+// stale while idle, is retried once on another connection. Unhealthy clients are skipped by every
+// load balancing policy.
+type HealthCheckedClient struct {
+	client Client
+	addr   string
+	hook   metrics.HealthCheckHook
+	opts   HealthCheckOpts
+
+	// Current health, and the number of consecutive probes that have disagreed with it.
+	unhealthy bool
+	streak    int
+	mutex     sync.RWMutex
+
+	// Closed to stop probing once the client is closed.
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// HealthCheckOpts formalizes health check configuration options.
+type HealthCheckOpts struct {
+	// Interval is the time between consecutive probes.
+	Interval time.Duration
+	// Timeout is the time after which a probe that has not been answered is considered failed.
+	// Defaults to the interval.
+	Timeout time.Duration
+	// MaxLatency is the latency above which an answered probe is considered failed. Disabled
+	// if unset.
+	MaxLatency time.Duration
+	// QueryName is the name queried by each probe. Defaults to the root zone.
+	QueryName string
+	// QueryType is the resource record type queried by each probe. Defaults to NS.
+	QueryType uint16
+	// UnhealthyThreshold is the number of consecutive failed probes after which a healthy
+	// client is marked unhealthy. Defaults to 2.
+	UnhealthyThreshold int
+	// HealthyThreshold is the number of consecutive successful probes after which an unhealthy
+	// client is marked healthy. Defaults to 1.
+	HealthyThreshold int
+	// OnChange, if specified, is invoked whenever the client is marked healthy or unhealthy,
+	// with the error from the most recent probe, if any.
+	OnChange func(healthy bool, err error)
+}
+
+// NewHealthCheckedClient wraps a client with active health checking, and starts probing the
+// upstream server in the background until the client is closed. The address identifies the
+// upstream server in metrics. The client is initially considered healthy.
+func NewHealthCheckedClient(client Client, addr string, hook metrics.HealthCheckHook, opts HealthCheckOpts) (*HealthCheckedClient, error) {
+	if opts.Interval <= 0 {
+		return nil, fmt.Errorf("health: non-positive health check interval: interval=%v", opts.Interval)
+	}
+
+	// Sane option defaults
+	if opts.Timeout <= 0 {
+		opts.Timeout = opts.Interval
+	}
+
+	if opts.QueryName == "" {
+		opts.QueryName = "."
+	}
+
+	if opts.QueryType == 0 {
+		opts.QueryType = dns.TypeNS
+	}
+
+	if opts.UnhealthyThreshold <= 0 {
+		opts.UnhealthyThreshold = 2
+	}
+
+	if opts.HealthyThreshold <= 0 {
+		opts.HealthyThreshold = 1
+	}
+
+	// Validate the probe query upfront, so that a misconfiguration is not mistaken for an
+	// unhealthy server.
+	if _, err := dns.NewQuery(0, opts.QueryName, opts.QueryType); err != nil {
+		return nil, fmt.Errorf("health: invalid health check query: err=%v", err)
+	}
+
+	c := &HealthCheckedClient{
+		client: client,
+		addr:   addr,
+		hook:   hook,
+		opts:   opts,
+		stop:   make(chan struct{}),
+	}
+
+	go c.run()
+
+	return c, nil
+}
+
+// Conn retrieves a connection from the underlying client, regardless of its health. It is the
+// responsibility of the load balancing policy to avoid unhealthy clients.
+func (c *HealthCheckedClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	return c.client.Conn(ctx)
+}
+
+// Stats returns the underlying client's stats, marked unhealthy if the most recent probes failed.
+// The underlying client may itself be marked unhealthy regardless.
+func (c *HealthCheckedClient) Stats() Stats {
+	stats := c.client.Stats()
+
+	c.mutex.RLock()
+	stats.Unhealthy = stats.Unhealthy || c.unhealthy
+	c.mutex.RUnlock()
+
+	return stats
+}
+
+// Close stops probing the upstream server, and closes the underlying client if it is closable.
+func (c *HealthCheckedClient) Close() error {
+	c.closeOnce.Do(func() { close(c.stop) })
+
+	if closable, ok := c.client.(ClosableClient); ok {
+		return closable.Close()
+	}
+
+	return nil
+}
+
+// String returns a string representation of the client.
+func (c *HealthCheckedClient) String() string {
+	return fmt.Sprintf("HealthCheckedClient{%v}", c.client)
+}
+
+// run probes the upstream server at every interval, until the client is closed.
+func (c *HealthCheckedClient) run() {
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+
+		start := time.Now()
+		err := c.probe()
+		latency := time.Since(start)
+
+		c.hook.EmitHealthCheck(latency, err == nil, c.addr)
+		c.observe(err)
+	}
+}
+
+// probe sends a probe query and validates its response. A probe that fails before it can be
+// answered, e.g. on a stale pooled connection, is retried once within the timeout.
+func (c *HealthCheckedClient) probe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+
+	id := uint16(rand.Intn(1 << 16))
+
+	resp, latency, err := c.exchange(ctx, id)
+	if err != nil && ctx.Err() == nil {
+		resp, latency, err = c.exchange(ctx, id)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	header, err := dns.ParseHeader(resp[2:])
+	if err != nil {
+		return fmt.Errorf("health: malformed probe response: err=%v", err)
+	}
+
+	if !header.Response() || header.ID != id {
+		return fmt.Errorf("health: probe response does not match query: id=%d", header.ID)
+	}
+
+	// A nonexistent name is still a valid answer from a functioning resolver.
+	if rcode := header.Rcode(); rcode != dns.RcodeSuccess && rcode != dns.RcodeNameError {
+		return fmt.Errorf("health: probe response has error response code: rcode=%d", rcode)
+	}
+
+	if c.opts.MaxLatency > 0 && latency > c.opts.MaxLatency {
+		return fmt.Errorf(
+			"health: probe response too slow: latency=%v max=%v",
+			latency,
+			c.opts.MaxLatency,
+		)
+	}
+
+	return nil
+}
+
+// exchange sends a single probe query with the specified message ID on a connection from the
+// underlying client, and returns the framed response and the latency with which it was answered.
+func (c *HealthCheckedClient) exchange(ctx context.Context, id uint16) ([]byte, time.Duration, error) {
+	conn, err := c.client.Conn(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("health: error opening connection: err=%v", err)
+	}
+
+	// The probe is abandoned by destroying its connection if it is not answered in time, which
+	// unblocks any pending I/O.
+	deadline, _ := ctx.Deadline()
+	timer := time.AfterFunc(time.Until(deadline), func() { conn.Destroy() })
+	start := time.Now()
+
+	query, _ := dns.NewQuery(id, c.opts.QueryName, c.opts.QueryType)
+
+	req := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(req, uint16(len(query)))
+	req = append(req, query...)
+
+	if _, err := conn.Write(req); err != nil {
+		timer.Stop()
+		conn.Destroy()
+		return nil, 0, fmt.Errorf("health: error writing probe: err=%v", err)
+	}
+
+	resp, err := NewFramedReader(conn, MaxMessageSize).ReadFrame()
+	if err != nil {
+		timer.Stop()
+		conn.Destroy()
+		return nil, 0, fmt.Errorf("health: error reading probe response: err=%v", err)
+	}
+
+	if !timer.Stop() {
+		return nil, 0, fmt.Errorf("health: probe timed out: timeout=%v", c.opts.Timeout)
+	}
+
+	latency := time.Since(start)
+	conn.Close()
+
+	return resp, latency, nil
+}
+
+// observe updates the client's health with the outcome of a probe, once enough consecutive probes
+// have disagreed with its current health.
+func (c *HealthCheckedClient) observe(err error) {
+	c.mutex.Lock()
+
+	failed := err != nil
+	if failed != c.unhealthy {
+		c.streak++
+	} else {
+		c.streak = 0
+	}
+
+	threshold := c.opts.UnhealthyThreshold
+	if c.unhealthy {
+		threshold = c.opts.HealthyThreshold
+	}
+
+	changed := c.streak >= threshold
+	if changed {
+		c.unhealthy = failed
+		c.streak = 0
+	}
+
+	c.mutex.Unlock()
+
+	if changed {
+		c.hook.EmitHealthChange(!failed, c.addr)
+
+		if c.opts.OnChange != nil {
+			c.opts.OnChange(!failed, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dotproxy/internal/metrics"
+)
+
+// unreachableClient is a ClosableClient that fails to provide every connection, and records
+// whether it has been closed.
+type unreachableClient struct {
+	attempts int32
+	closed   int32
+}
+
+func (c *unreachableClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	atomic.AddInt32(&c.attempts, 1)
+
+	return nil, errors.New("unreachable")
+}
+
+func (c *unreachableClient) Stats() Stats {
+	return Stats{}
+}
+
+func (c *unreachableClient) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+
+	return nil
+}
+
+func TestHealthCheckedClientClose(t *testing.T) {
+	inner := &unreachableClient{}
+
+	client, err := NewHealthCheckedClient(
+		inner,
+		"192.0.2.1:53",
+		metrics.NewNoopHealthCheckHook(),
+		HealthCheckOpts{Interval: 5 * time.Millisecond},
+	)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+
+	var _ ClosableClient = client
+
+	for deadline := time.Now().Add(time.Second); !client.Stats().Unhealthy; {
+		if time.Now().After(deadline) {
+			t.Fatal("client not marked unhealthy")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("error closing client: %v", err)
+	}
+
+	// Closing the client more than once is harmless.
+	client.Close()
+
+	if atomic.LoadInt32(&inner.closed) != 1 {
+		t.Error("expected underlying client to be closed")
+	}
+
+	// A probe may have been in flight when the client was closed, but none start afterwards.
+	time.Sleep(20 * time.Millisecond)
+	attempts := atomic.LoadInt32(&inner.attempts)
+	time.Sleep(50 * time.Millisecond)
+
+	if after := atomic.LoadInt32(&inner.attempts); after != attempts {
+		t.Errorf("client continued probing after close: attempts=%d after=%d", attempts, after)
+	}
+}
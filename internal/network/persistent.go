@@ -1,8 +1,10 @@
 package network
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"lib.kevinlin.info/aperture/lib"
@@ -14,10 +16,15 @@ import (
 // PersistentConnPool is a pool of persistent, long-lived connections. Connections are returned to
 // the pool instead of closed for later reuse.
 type PersistentConnPool struct {
-	dialer       func() (net.Conn, error)
+	dialer       func(ctx context.Context) (net.Conn, error)
 	cxHook       metrics.ConnectionLifecycleHook
 	staleTimeout time.Duration
 	conns        *data.MRUQueue
+
+	// Whether the pool has been closed, and the mutex serializing its closure with the insertion
+	// of connections into the pool.
+	closed bool
+	mutex  sync.Mutex
 }
 
 // PersistentConnPoolOpts formalizes configuration options for a persistent connection pool.
@@ -31,54 +38,65 @@ type PersistentConnPoolOpts struct {
 	// StaleTimeout is the duration after which a cached connection should be considered stale,
 	// and thus reconnected before use. This represents the time between connection I/O events.
 	StaleTimeout time.Duration
+	// Lazy disables the initial population of the pool, so that connections are only
+	// established on demand. It suits pools that are rarely used.
+	Lazy bool
 }
 
 // PersistentConn is a net.Conn that lazily closes connections; it invokes a closer callback
 // function instead of actually closing the underlying connection. It also augments the net.Conn API
-// by providing a Destroy() method that forcefully closes the underlying connection.
+// by providing a Destroy() method that forcefully closes the underlying connection, and an
+// Observe() method through which the user of the connection reports the outcome of its
+// transaction.
 type PersistentConn struct {
-	closer    func(destroyed bool) error
-	destroyed bool
+	closer   func(destroyed bool) error
+	observer func(latency time.Duration, success bool)
+	once     sync.Once
+	observed sync.Once
 
 	net.Conn
 }
 
 // NewPersistentConnPool creates a connection pool with the specified dialer factory and
 // configuration options.  The dialer is a net.Conn factory that describes how a new connection is
-// created.
-func NewPersistentConnPool(dialer func() (net.Conn, error), cxHook metrics.ConnectionLifecycleHook, opts PersistentConnPoolOpts) *PersistentConnPool {
-	conns := data.NewMRUQueue(opts.Capacity)
-
-	// The entire pool is initially populated asynchronously with live connections, if possible.
-	go func() {
-		for i := 0; i < opts.Capacity; i++ {
-			dialTimer := lib.NewStopwatch()
-			conn, err := dialer()
-
-			// It is nonideal, but not necessarily an error, if the pool cannot be
-			// initially populated to the desired capacity. The size of the pool is
-			// inherently variable, and pool clients generally degrade gracefully when
-			// the pool fails to provide a connection.
-			if err != nil {
-				cxHook.EmitConnectionError()
-			} else {
-				cxHook.EmitConnectionOpen(dialTimer.Elapsed(), conn.RemoteAddr())
-				conns.Push(conn)
-			}
-		}
-	}()
-
-	return &PersistentConnPool{
+// created; it should abandon the connection attempt once its context is done.
+func NewPersistentConnPool(dialer func(ctx context.Context) (net.Conn, error), cxHook metrics.ConnectionLifecycleHook, opts PersistentConnPoolOpts) *PersistentConnPool {
+	p := &PersistentConnPool{
 		dialer:       dialer,
 		cxHook:       cxHook,
 		staleTimeout: opts.StaleTimeout,
-		conns:        conns,
+		conns:        data.NewMRUQueue(opts.Capacity),
 	}
+
+	// Unless the pool is lazy, the entire pool is initially populated asynchronously with live
+	// connections, if possible.
+	if !opts.Lazy {
+		go func() {
+			for i := 0; i < opts.Capacity; i++ {
+				dialTimer := lib.NewStopwatch()
+				conn, err := dialer(context.Background())
+
+				// It is nonideal, but not necessarily an error, if the pool cannot be
+				// initially populated to the desired capacity. The size of the pool is
+				// inherently variable, and pool clients generally degrade gracefully when
+				// the pool fails to provide a connection.
+				if err != nil {
+					cxHook.EmitConnectionError()
+				} else {
+					cxHook.EmitConnectionOpen(dialTimer.Elapsed(), conn.RemoteAddr())
+					p.put(conn)
+				}
+			}
+		}()
+	}
+
+	return p
 }
 
 // Conn returns a single connection. It may be a cached connection that already exists in the pool,
-// or it may be a newly created connection in the event that the pool is empty.
-func (p *PersistentConnPool) Conn() (*PersistentConn, error) {
+// or it may be a newly created connection in the event that the pool is empty. Creating a new
+// connection is abandoned if the context is done first.
+func (p *PersistentConnPool) Conn(ctx context.Context) (*PersistentConn, error) {
 	value, timestamp, ok := p.conns.Pop()
 
 	// Factory for creating a closer callback that closes the connection if it is destroyed, but
@@ -112,7 +130,7 @@ func (p *PersistentConnPool) Conn() (*PersistentConn, error) {
 
 	// A cached connection is not available or stale; create a new one
 	dialTimer := lib.NewStopwatch()
-	conn, err := p.dialer()
+	conn, err := p.dialer(ctx)
 	if err != nil {
 		p.cxHook.EmitConnectionError()
 		return nil, err
@@ -128,10 +146,39 @@ func (p *PersistentConnPool) Size() int {
 	return p.conns.Size()
 }
 
+// Close closes all connections in the pool. Connections that are in use when the pool is closed,
+// and those established by it afterwards, are closed rather than returned to the pool.
+func (p *PersistentConnPool) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+
+	for {
+		value, _, ok := p.conns.Pop()
+		if !ok {
+			return nil
+		}
+
+		conn := value.(net.Conn)
+
+		p.cxHook.EmitConnectionClose(conn.RemoteAddr())
+		go conn.Close()
+	}
+}
+
 // put attempts to return a connection back to the pool, e.g. when it would otherwise be closed.
-// The connection will be reinserted into the pool if there is sufficient capacity; otherwise, the
-// connection is simply closed.
+// The connection will be reinserted into the pool if there is sufficient capacity and the pool has
+// not been closed; otherwise, the connection is simply closed.
 func (p *PersistentConnPool) put(conn net.Conn) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		p.cxHook.EmitConnectionClose(conn.RemoteAddr())
+		return conn.Close()
+	}
+
 	if ok := p.conns.Push(conn); !ok {
 		return conn.Close()
 	}
@@ -144,19 +191,40 @@ func NewPersistentConn(conn net.Conn, closer func(destroyed bool) error) *Persis
 	return &PersistentConn{closer: closer, Conn: conn}
 }
 
-// Close will invoke the close callback if the connection has not been destroyed; otherwise, it is
-// a noop. The callback is invoked with a single parameter describing whether the connection has
-// been marked as destroyed; the interpretation of a destroyed connection is abstracted out to the
-// PersistentConn callback supplier.
+// Close will invoke the close callback if the connection has not already been closed or destroyed;
+// otherwise, it is a noop. The callback is invoked with a single parameter describing whether the
+// connection has been marked as destroyed; the interpretation of a destroyed connection is
+// abstracted out to the PersistentConn callback supplier.
 func (c *PersistentConn) Close() error {
-	return c.closer(c.destroyed)
+	return c.close(false)
 }
 
-// Destroy markes the connection as destroyed and invokes the close callback.
+// Destroy markes the connection as destroyed and invokes the close callback, if the connection has
+// not already been closed or destroyed. It is safe to call concurrently with I/O on the connection,
+// e.g. to abort a transaction in progress.
 func (c *PersistentConn) Destroy() error {
-	c.destroyed = true
+	return c.close(true)
+}
+
+// Observe reports the duration and outcome of the transaction performed on the connection to the
+// clients that provided it, e.g. for latency-aware load balancing. Only the first report is
+// delivered, so that it is safe to report a failure from concurrent code paths. Transactions that
+// are abandoned, or for which the connection is never used, should not be reported.
+func (c *PersistentConn) Observe(latency time.Duration, success bool) {
+	c.observed.Do(func() {
+		if c.observer != nil {
+			c.observer(latency, success)
+		}
+	})
+}
+
+// close invokes the close callback at most once.
+func (c *PersistentConn) close(destroyed bool) (err error) {
+	c.once.Do(func() {
+		err = c.closer(destroyed)
+	})
 
-	return c.Close()
+	return err
 }
 
 // String implements the Stringer interface for human-consumable representation.
@@ -0,0 +1,99 @@
+//go:build doq
+// +build doq
+
+package network
+
+import (
+	"net"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// QUICStreamConn is an abstraction over a single bidirectional QUIC stream to give it net.Conn
+// semantics, with dynamic read and write timeouts. Per RFC 9250, each DNS-over-QUIC transaction is
+// carried on its own stream, so a QUICStreamConn represents exactly one query and its response.
+type QUICStreamConn struct {
+	local        net.Addr
+	remote       net.Addr
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	quic.Stream
+}
+
+const (
+	// QUICSupported describes whether DNS-over-QUIC support is built into the binary. It is only
+	// built with the doq build tag, since it depends on a TLS implementation that supports a
+	// specific Go release only.
+	QUICSupported = true
+)
+
+const (
+	// doqALPN is the ALPN token identifying DNS-over-QUIC, per RFC 9250.
+	doqALPN = "doq"
+)
+
+const (
+	// doqNoError signals that a DNS-over-QUIC session is closed without error.
+	doqNoError quic.ErrorCode = 0x0
+	// doqInternalError signals that a DNS-over-QUIC stream could not be served due to an
+	// internal failure.
+	doqInternalError quic.ErrorCode = 0x1
+	// doqProtocolError signals that the peer violated the DNS-over-QUIC protocol, e.g. by
+	// sending a malformed query.
+	doqProtocolError quic.ErrorCode = 0x2
+	// doqRequestCancelled signals that a DNS-over-QUIC transaction was abandoned before it
+	// completed.
+	doqRequestCancelled quic.ErrorCode = 0x3
+)
+
+// NewQUICStreamConn wraps a QUIC stream opened on a session between the specified local and remote
+// addresses.
+func NewQUICStreamConn(stream quic.Stream, local net.Addr, remote net.Addr, readTimeout time.Duration, writeTimeout time.Duration) *QUICStreamConn {
+	return &QUICStreamConn{
+		local:        local,
+		remote:       remote,
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+		Stream:       stream,
+	}
+}
+
+// Read sets a read deadline followed by reading from the backing stream.
+func (c *QUICStreamConn) Read(buf []byte) (n int, err error) {
+	if c.readTimeout > 0 {
+		if err := c.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return 0, err
+		}
+	}
+
+	return c.Stream.Read(buf)
+}
+
+// Write sets a write deadline followed by writing to the backing stream.
+func (c *QUICStreamConn) Write(buf []byte) (n int, err error) {
+	if c.writeTimeout > 0 {
+		if err := c.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return 0, err
+		}
+	}
+
+	return c.Stream.Write(buf)
+}
+
+// Abort abruptly terminates both directions of the stream with the specified error code.
+func (c *QUICStreamConn) Abort(code quic.ErrorCode) {
+	c.CancelRead(code)
+	c.CancelWrite(code)
+}
+
+// LocalAddr returns the local address of the session carrying the stream.
+func (c *QUICStreamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the remote address of the session carrying the stream.
+func (c *QUICStreamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,53 @@
+//go:build !doq
+// +build !doq
+
+package network
+
+import (
+	"context"
+	"errors"
+
+	"dotproxy/internal/metrics"
+)
+
+// QUICClient is a placeholder for the DNS-over-QUIC client in binaries built without the doq build
+// tag. It cannot be created.
+type QUICClient struct{}
+
+const (
+	// QUICSupported describes whether DNS-over-QUIC support is built into the binary. It is only
+	// built with the doq build tag, since it depends on a TLS implementation that supports a
+	// specific Go release only.
+	QUICSupported = false
+)
+
+var (
+	// errQUICUnsupported is returned when DNS-over-QUIC is used in a binary built without
+	// support for it.
+	errQUICUnsupported = errors.New("quic: DNS-over-QUIC support is not built; rebuild with the doq build tag")
+)
+
+// NewQUICClient fails, since DNS-over-QUIC support is not built.
+func NewQUICClient(addr string, serverName string, cxHook metrics.ConnectionLifecycleHook, opts QUICClientOpts) (*QUICClient, error) {
+	return nil, errQUICUnsupported
+}
+
+// Conn fails, since DNS-over-QUIC support is not built.
+func (c *QUICClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	return nil, errQUICUnsupported
+}
+
+// Stats returns empty stats.
+func (c *QUICClient) Stats() Stats {
+	return Stats{}
+}
+
+// Close is a no-op.
+func (c *QUICClient) Close() error {
+	return nil
+}
+
+// ListenAndServe fails, since DNS-over-QUIC support is not built.
+func (s *QUICServer) ListenAndServe(handler ServerHandler) error {
+	return errQUICUnsupported
+}
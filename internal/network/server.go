@@ -3,11 +3,20 @@
 package network
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
+	"dotproxy/internal/dns"
 	"dotproxy/internal/metrics"
 )
 
@@ -68,8 +77,104 @@ type TCPServerOpts struct {
 	// WriteTimeout is the maximum amount of time the server is allowed to take to write to a
 	// client, after which the server will consider the write to have failed.
 	WriteTimeout time.Duration
+	// IdleTimeout is the maximum amount of time the server will keep a client connection open
+	// while waiting for the next request to be pipelined on it. If unset, the read timeout is
+	// used instead.
+	IdleTimeout time.Duration
+	// MaxConcurrentRequests is the maximum number of requests pipelined on a single client
+	// connection that the server handles concurrently. Once reached, the server stops reading
+	// further requests from the connection until an in-flight request completes. Defaults to 64.
+	MaxConcurrentRequests int
+}
+
+// TLSServer describes a server that listens on a TCP address and serves DNS over TLS, per RFC 7858.
+// Apart from the TLS layer, it behaves identically to a TCPServer.
+type TLSServer struct {
+	addr   string
+	certs  *CertificateReloader
+	cxHook metrics.ConnectionLifecycleHook
+	opts   TLSServerOpts
+}
+
+// TLSServerOpts formalizes TLS server configuration options.
+type TLSServerOpts struct {
+	// ReadTimeout is the maximum amount of time the server will wait to read a request from a
+	// client, after which the server will consider the read to have failed.
+	ReadTimeout time.Duration
+	// WriteTimeout is the maximum amount of time the server is allowed to take to write to a
+	// client, after which the server will consider the write to have failed.
+	WriteTimeout time.Duration
+	// IdleTimeout is the maximum amount of time the server will keep a client connection open
+	// while waiting for the next request to be pipelined on it. If unset, the read timeout is
+	// used instead.
+	IdleTimeout time.Duration
+	// MaxConcurrentRequests is the maximum number of requests pipelined on a single client
+	// connection that the server handles concurrently. Defaults to 64.
+	MaxConcurrentRequests int
+	// CertificateReloadInterval is the interval at which the certificate and key files are
+	// checked for changes, and reloaded if they have changed. Reloading is disabled if unset.
+	CertificateReloadInterval time.Duration
+}
+
+// HTTPSServer describes a server that listens on a TCP address and serves DNS over HTTPS, per
+// RFC 8484. HTTP/2 is negotiated with clients that support it.
+type HTTPSServer struct {
+	addr   string
+	certs  *CertificateReloader
+	cxHook metrics.ConnectionLifecycleHook
+	opts   HTTPSServerOpts
+}
+
+// HTTPSServerOpts formalizes HTTPS server configuration options.
+type HTTPSServerOpts struct {
+	// Path is the URL path at which DNS queries are served. Defaults to /dns-query.
+	Path string
+	// ReadTimeout is the maximum amount of time the server will wait to read an entire HTTP
+	// request from a client.
+	ReadTimeout time.Duration
+	// WriteTimeout is the maximum amount of time the server is allowed to take to serve a
+	// request and write the response to a client, including the time spent proxying the
+	// request to the upstream.
+	WriteTimeout time.Duration
+	// IdleTimeout is the maximum amount of time the server will keep a client connection open
+	// while waiting for the next request.
+	IdleTimeout time.Duration
+	// CertificateReloadInterval is the interval at which the certificate and key files are
+	// checked for changes, and reloaded if they have changed. Reloading is disabled if unset.
+	CertificateReloadInterval time.Duration
+}
+
+// QUICServer describes a server that listens on a UDP address and serves DNS over QUIC, per
+// RFC 9250. Each query is carried on its own QUIC stream, so queries on the same session are
+// handled concurrently without head-of-line blocking.
+type QUICServer struct {
+	addr   string
+	certs  *CertificateReloader
+	cxHook metrics.ConnectionLifecycleHook
+	opts   QUICServerOpts
+}
+
+// QUICServerOpts formalizes QUIC server configuration options.
+type QUICServerOpts struct {
+	// ReadTimeout is the maximum amount of time the server will wait to read a request from a
+	// client stream, after which the server will consider the read to have failed.
+	ReadTimeout time.Duration
+	// WriteTimeout is the maximum amount of time the server is allowed to take to write to a
+	// client stream, after which the server will consider the write to have failed.
+	WriteTimeout time.Duration
+	// IdleTimeout is the maximum amount of time the server will keep a client session open
+	// without any activity.
+	IdleTimeout time.Duration
+	// CertificateReloadInterval is the interval at which the certificate and key files are
+	// checked for changes, and reloaded if they have changed. Reloading is disabled if unset.
+	CertificateReloadInterval time.Duration
 }
 
+const (
+	// dnsMessageContentType is the media type of a DNS message in wire format, per RFC 8484.
+	dnsMessageContentType = "application/dns-message"
+)
+
 const (
 	// TransportContextKey is the name of the context key used to indicate the network transport
 	// protocol the handler is serving. This is necessary because the handler APIs are
@@ -83,6 +188,12 @@ const (
 	TCP Transport = iota
 	// UDP describes a UDP transport.
 	UDP
+	// TLS describes a TLS-secured TCP transport.
+	TLS
+	// HTTPS describes an HTTPS transport.
+	HTTPS
+	// QUIC describes a QUIC transport.
+	QUIC
 )
 
 // NewUDPServer creates a UDP server listening on the specified address.
@@ -123,12 +234,22 @@ func (s *UDPServer) ListenAndServe(handler ServerHandler) error {
 
 // NewTCPServer creates a TCP server listening on the specified address.
 func NewTCPServer(addr string, cxHook metrics.ConnectionLifecycleHook, opts TCPServerOpts) *TCPServer {
+	// Sane option defaults
+	if opts.MaxConcurrentRequests <= 0 {
+		opts.MaxConcurrentRequests = 64
+	}
+
 	return &TCPServer{addr, cxHook, opts}
 }
 
 // ListenAndServe starts listening on the TCP address with which the server was configured and
 // indefinitely serves connections using the specified handler. It returns an error if it fails to
-//// bind to the initialized address.
+// bind to the initialized address.
+//
+// Each client connection is kept open for as long as the client continues to send requests within
+// the idle timeout. Requests pipelined on the same connection are handled concurrently, and their
+// responses are written back as soon as they are available, possibly out of order. Per RFC 7766,
+// clients are expected to match responses to requests by message ID.
 func (s *TCPServer) ListenAndServe(handler ServerHandler) error {
 	ln, err := net.Listen("tcp", s.addr)
 	if err != nil {
@@ -137,6 +258,14 @@ func (s *TCPServer) ListenAndServe(handler ServerHandler) error {
 
 	ctx := context.WithValue(context.Background(), TransportContextKey, TCP)
 
+	s.acceptLoop(ctx, ln, handler)
+
+	return nil
+}
+
+// acceptLoop indefinitely accepts client connections from the listener and serves each in its own
+// goroutine.
+func (s *TCPServer) acceptLoop(ctx context.Context, ln net.Listener, handler ServerHandler) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -154,9 +283,351 @@ func (s *TCPServer) ListenAndServe(handler ServerHandler) error {
 				tcpConn.Close()
 			}()
 
-			if err := handler.Handle(ctx, tcpConn); err != nil {
+			s.serve(ctx, tcpConn, handler)
+		}()
+	}
+}
+
+// serve reads length-prefixed requests from a single client connection until the client closes
+// the connection, the connection is idle for longer than the idle timeout, or a read fails. Each
+// request is dispatched to the handler in its own goroutine, up to the maximum number of concurrent
+// requests. It returns only after all dispatched requests have been handled.
+func (s *TCPServer) serve(ctx context.Context, conn *TCPConn, handler ServerHandler) {
+	var wg sync.WaitGroup
+	var writeMutex sync.Mutex
+
+	// Slots for in-flight requests, so that a single client cannot pipeline an unbounded number
+	// of concurrent requests.
+	inflight := make(chan struct{}, s.opts.MaxConcurrentRequests)
+
+	// Requests in flight are abandoned once the client closes the connection or reading from it
+	// fails, since their responses can no longer be delivered. Requests in flight when the
+	// connection goes idle are still served.
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	defer wg.Wait()
+
+	idleTimeout := s.opts.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = s.opts.ReadTimeout
+	}
+
+	// Buffering the connection allows the server to block on the arrival of the next request
+	// under the idle timeout, before reading the request itself under the read timeout.
+	reader := bufio.NewReader(conn.Conn)
+	framedReader := NewFramedReader(reader, MaxMessageSize)
+
+	for {
+		// Deadlines are managed explicitly on the backing connection, since the time spent
+		// waiting for the next request is governed by the idle timeout, not the read timeout.
+		if idleTimeout > 0 {
+			conn.Conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+
+		if _, err := reader.Peek(1); err != nil {
+			// The client closing the connection or going idle is the expected way for
+			// the connection to end, and is not an error.
+			if err != io.EOF && !isTimeout(err) {
+				handler.ConsumeError(ctx, fmt.Errorf(
+					"server: error reading request from client: err=%v",
+					err,
+				))
+			}
+
+			if !isTimeout(err) {
+				cancel()
+			}
+
+			return
+		}
+
+		if s.opts.ReadTimeout > 0 {
+			conn.Conn.SetReadDeadline(time.Now().Add(s.opts.ReadTimeout))
+		}
+
+		req, err := framedReader.ReadFrame()
+		if err != nil {
+			handler.ConsumeError(ctx, fmt.Errorf(
+				"server: error reading request from client: err=%v",
+				err,
+			))
+
+			cancel()
+
+			return
+		}
+
+		msgConn := NewMessageConn(conn, req, &writeMutex)
+
+		inflight <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer func() {
+				<-inflight
+				wg.Done()
+			}()
+
+			if err := handler.Handle(connCtx, msgConn); err != nil {
 				handler.ConsumeError(ctx, err)
 			}
 		}()
 	}
 }
+
+// NewTLSServer creates a TLS server listening on the specified address, presenting the
+// certificate and private key stored in the specified PEM files. It returns an error if the
+// certificate cannot be loaded.
+func NewTLSServer(addr string, certFile string, keyFile string, cxHook metrics.ConnectionLifecycleHook, opts TLSServerOpts) (*TLSServer, error) {
+	certs, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TLSServer{addr, certs, cxHook, opts}, nil
+}
+
+// ListenAndServe starts listening on the TCP address with which the server was configured and
+// indefinitely serves TLS connections using the specified handler. It returns an error if it fails
+// to bind to the initialized address.
+//
+// Client connections are served identically to those of a TCPServer, including concurrent
+// handling of pipelined requests. The server's certificate is periodically reloaded if it changes
+// on disk, so that it may be renewed without restarting the server.
+func (s *TLSServer) ListenAndServe(handler ServerHandler) error {
+	ln, err := tls.Listen("tcp", s.addr, &tls.Config{
+		GetCertificate: s.certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	})
+	if err != nil {
+		return fmt.Errorf("server: failed to listen on TLS socket: err=%v", err)
+	}
+
+	ctx := context.WithValue(context.Background(), TransportContextKey, TLS)
+
+	if s.opts.CertificateReloadInterval > 0 {
+		go func() {
+			for range time.Tick(s.opts.CertificateReloadInterval) {
+				if _, err := s.certs.Reload(); err != nil {
+					handler.ConsumeError(ctx, err)
+				}
+			}
+		}()
+	}
+
+	stream := NewTCPServer(s.addr, s.cxHook, TCPServerOpts{
+		ReadTimeout:           s.opts.ReadTimeout,
+		WriteTimeout:          s.opts.WriteTimeout,
+		IdleTimeout:           s.opts.IdleTimeout,
+		MaxConcurrentRequests: s.opts.MaxConcurrentRequests,
+	})
+
+	// Client addresses identify their transport as TLS, so that metrics can distinguish them
+	// from those of plaintext TCP clients.
+	stream.acceptLoop(ctx, NewTransportListener(ln, TLS), handler)
+
+	return nil
+}
+
+// NewHTTPSServer creates an HTTPS server listening on the specified address, presenting the
+// certificate and private key stored in the specified PEM files. It returns an error if the
+// certificate cannot be loaded.
+func NewHTTPSServer(addr string, certFile string, keyFile string, cxHook metrics.ConnectionLifecycleHook, opts HTTPSServerOpts) (*HTTPSServer, error) {
+	// Sane option defaults
+	if opts.Path == "" {
+		opts.Path = "/dns-query"
+	}
+
+	certs, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HTTPSServer{addr, certs, cxHook, opts}, nil
+}
+
+// ListenAndServe starts listening on the TCP address with which the server was configured and
+// indefinitely serves DNS-over-HTTPS requests using the specified handler. It returns an error if
+// it fails to bind to the initialized address.
+//
+// Each HTTP request carries a single DNS query, which is passed to the handler through an HTTPConn.
+// The server's certificate is periodically reloaded if it changes on disk, so that it may be
+// renewed without restarting the server.
+func (s *HTTPSServer) ListenAndServe(handler ServerHandler) error {
+	ctx := context.WithValue(context.Background(), TransportContextKey, HTTPS)
+
+	if s.opts.CertificateReloadInterval > 0 {
+		go func() {
+			for range time.Tick(s.opts.CertificateReloadInterval) {
+				if _, err := s.certs.Reload(); err != nil {
+					handler.ConsumeError(ctx, err)
+				}
+			}
+		}()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.opts.Path, func(w http.ResponseWriter, r *http.Request) {
+		s.serveHTTP(ctx, w, r, handler)
+	})
+
+	srv := &http.Server{
+		Addr:    s.addr,
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			GetCertificate: s.certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		},
+		ReadTimeout:  s.opts.ReadTimeout,
+		WriteTimeout: s.opts.WriteTimeout,
+		IdleTimeout:  s.opts.IdleTimeout,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			addr := &transportAddr{transport: HTTPS, Addr: conn.RemoteAddr()}
+
+			switch state {
+			case http.StateNew:
+				s.cxHook.EmitConnectionOpen(0, addr)
+			case http.StateClosed, http.StateHijacked:
+				s.cxHook.EmitConnectionClose(addr)
+			}
+		},
+	}
+
+	// The certificate is provided by the TLS configuration, rather than by file paths.
+	if err := srv.ListenAndServeTLS("", ""); err != nil {
+		return fmt.Errorf("server: failed to listen on HTTPS socket: err=%v", err)
+	}
+
+	return nil
+}
+
+// serveHTTP serves a single DNS-over-HTTPS request. GET requests carry the DNS query in the
+// base64url-encoded dns query parameter, and POST requests carry it in the request body.
+func (s *HTTPSServer) serveHTTP(ctx context.Context, w http.ResponseWriter, r *http.Request, handler ServerHandler) {
+	var msg []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns query parameter", http.StatusBadRequest)
+			return
+		}
+
+		if msg, err = base64.RawURLEncoding.DecodeString(param); err != nil {
+			http.Error(w, "malformed dns query parameter", http.StatusBadRequest)
+			return
+		}
+
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dnsMessageContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if msg, err = ioutil.ReadAll(io.LimitReader(r.Body, MaxMessageSize+1)); err != nil {
+			http.Error(w, "error reading request body", http.StatusBadRequest)
+			return
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(msg) > MaxMessageSize {
+		http.Error(w, "dns query too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if len(msg) < minMessageSize {
+		http.Error(w, "malformed dns query", http.StatusBadRequest)
+		return
+	}
+
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		remote = &net.TCPAddr{}
+	}
+
+	conn := NewHTTPConn(msg, &transportAddr{transport: HTTPS, Addr: remote})
+
+	// The request is abandoned if the client goes away before it is served.
+	reqCtx, cancel := requestContext(ctx, r.Context().Done())
+	defer cancel()
+
+	if err := handler.Handle(reqCtx, conn); err != nil {
+		handler.ConsumeError(ctx, err)
+	}
+
+	resp, ok := conn.Response()
+	if !ok {
+		http.Error(w, "unable to resolve dns query", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", dnsMessageContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp)))
+
+	// Per RFC 8484 section 5.1, the freshness lifetime of the HTTP response should not exceed
+	// the smallest TTL of the records in the DNS response.
+	if maxAge, ok := responseMaxAge(resp); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+	}
+
+	w.Write(resp)
+}
+
+// responseMaxAge derives the HTTP freshness lifetime of a DNS response, in seconds, from the
+// smallest TTL of its answer records, or from its negative caching TTL if it has no answers. It
+// returns false if no lifetime can be derived.
+func responseMaxAge(resp []byte) (uint32, bool) {
+	msg, err := dns.Parse(resp)
+	if err != nil {
+		return 0, false
+	}
+
+	if ttl, ok := msg.MinTTL(); ok {
+		return ttl, true
+	}
+
+	return msg.NegativeTTL()
+}
+
+// NewQUICServer creates a QUIC server listening on the specified address, presenting the
+// certificate and private key stored in the specified PEM files. It returns an error if the
+// certificate cannot be loaded.
+func NewQUICServer(addr string, certFile string, keyFile string, cxHook metrics.ConnectionLifecycleHook, opts QUICServerOpts) (*QUICServer, error) {
+	certs, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QUICServer{addr, certs, cxHook, opts}, nil
+}
+
+// requestContext derives the context for a single client request from the server's context, which
+// is cancelled once done is closed, e.g. when the client abandons the request.
+func requestContext(ctx context.Context, done <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// isTimeout returns whether an error describes a network timeout.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,131 @@
+//go:build doq
+// +build doq
+
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// ListenAndServe starts listening on the UDP address with which the server was configured and
+// indefinitely serves QUIC sessions using the specified handler. It returns an error if it fails
+// to bind to the initialized address.
+//
+// Sessions accept 0-RTT data from clients resuming a previous session. The server's certificate is
+// periodically reloaded if it changes on disk, so that it may be renewed without restarting the
+// server.
+func (s *QUICServer) ListenAndServe(handler ServerHandler) error {
+	ln, err := quic.ListenAddrEarly(
+		s.addr,
+		&tls.Config{
+			GetCertificate: s.certs.GetCertificate,
+			MinVersion:     tls.VersionTLS13,
+			NextProtos:     []string{doqALPN},
+		},
+		&quic.Config{MaxIdleTimeout: s.opts.IdleTimeout},
+	)
+	if err != nil {
+		return fmt.Errorf("server: failed to listen on QUIC socket: err=%v", err)
+	}
+
+	ctx := context.WithValue(context.Background(), TransportContextKey, QUIC)
+
+	if s.opts.CertificateReloadInterval > 0 {
+		go func() {
+			for range time.Tick(s.opts.CertificateReloadInterval) {
+				if _, err := s.certs.Reload(); err != nil {
+					handler.ConsumeError(ctx, err)
+				}
+			}
+		}()
+	}
+
+	for {
+		session, err := ln.Accept(context.Background())
+		if err != nil {
+			s.cxHook.EmitConnectionError()
+			handler.ConsumeError(ctx, err)
+			continue
+		}
+
+		remote := &transportAddr{transport: QUIC, Addr: session.RemoteAddr()}
+		s.cxHook.EmitConnectionOpen(0, remote)
+
+		go func() {
+			defer s.cxHook.EmitConnectionClose(remote)
+
+			s.serve(ctx, session, remote, handler)
+		}()
+	}
+}
+
+// serve accepts streams from a single client session until the session is closed by the client or
+// times out. Each stream is served in its own goroutine. It returns only after all accepted
+// streams have been served.
+func (s *QUICServer) serve(ctx context.Context, session quic.Session, remote net.Addr, handler ServerHandler) {
+	var wg sync.WaitGroup
+
+	defer wg.Wait()
+
+	for {
+		// The session closing, including due to the idle timeout, is the expected way for
+		// it to end, and is not an error.
+		stream, err := session.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		conn := NewQUICStreamConn(
+			stream,
+			session.LocalAddr(),
+			remote,
+			s.opts.ReadTimeout,
+			s.opts.WriteTimeout,
+		)
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			s.serveStream(ctx, conn, handler)
+		}()
+	}
+}
+
+// serveStream serves the single length-prefixed request carried by a client stream.
+func (s *QUICServer) serveStream(ctx context.Context, conn *QUICStreamConn, handler ServerHandler) {
+	req, err := NewFramedReader(conn, MaxMessageSize).ReadFrame()
+	if err != nil {
+		conn.Abort(doqProtocolError)
+		handler.ConsumeError(ctx, fmt.Errorf(
+			"server: error reading request from client stream: err=%v",
+			err,
+		))
+
+		return
+	}
+
+	// The request is abandoned if the client cancels the stream, or closes the session, before
+	// it is served.
+	reqCtx, cancel := requestContext(ctx, conn.Context().Done())
+	defer cancel()
+
+	// The stream carries only this request, so writes need not be serialized with any others.
+	if err := handler.Handle(reqCtx, NewMessageConn(conn, req, &sync.Mutex{})); err != nil {
+		handler.ConsumeError(ctx, err)
+	}
+
+	// Closing the stream signals the end of the response. If the handler did not write a
+	// response, this leaves the client with an empty stream, which it treats as a failure.
+	if err := conn.Close(); err != nil {
+		conn.Abort(doqInternalError)
+	}
+}
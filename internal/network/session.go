@@ -0,0 +1,501 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lib.kevinlin.info/aperture/lib"
+
+	"dotproxy/internal/metrics"
+)
+
+// PipelinedSession multiplexes many concurrent DNS transactions over a single stream connection,
+// per RFC 7766 section 6.2.1.1. Each outgoing request is assigned a message ID that is unique among
+// all in-flight requests on the session, and a background reader demultiplexes responses, which
+// may arrive out of order, back to their originating transactions by ID.
+type PipelinedSession struct {
+	conn         net.Conn
+	cxHook       metrics.ConnectionLifecycleHook
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// In-flight transactions, keyed by the message ID with which they were written upstream.
+	pending      map[uint16]*sessionConn
+	pendingMutex sync.Mutex
+	// Serializes writes so that frames from concurrent transactions are not interleaved.
+	writeMutex sync.Mutex
+
+	// UNIX nanosecond timestamps of the most recent write and read on the session.
+	lastWrite int64
+	lastRead  int64
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// sessionError is a net.Error describing a transaction that failed because of the state of its
+// session, rather than its own I/O, so that callers treat it like any other network failure.
+type sessionError struct {
+	msg     string
+	timeout bool
+}
+
+// PipelinedSessionPool maintains a fixed number of pipelined sessions, lazily establishing each
+// session when it is first needed and reestablishing it after it is closed or becomes stale.
+// Connections are provided from each session in turn.
+type PipelinedSessionPool struct {
+	dialer       func(ctx context.Context) (net.Conn, error)
+	cxHook       metrics.ConnectionLifecycleHook
+	staleTimeout time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	slots        []*sessionSlot
+	slotIdx      uint32
+	// Whether the pool has been closed, set atomically.
+	closed int32
+}
+
+// PipelinedSessionPoolOpts formalizes configuration options for a pipelined session pool.
+type PipelinedSessionPoolOpts struct {
+	// Capacity is the number of sessions maintained by the pool. Since each session is capable
+	// of serving many concurrent transactions, this can generally be kept small.
+	Capacity int
+	// StaleTimeout is the duration of inactivity after which a session should be considered
+	// stale, and thus reestablished before use.
+	StaleTimeout time.Duration
+	// ReadTimeout is the maximum amount of time a transaction will wait for its response.
+	ReadTimeout time.Duration
+	// WriteTimeout is the timeout associated with writing each request to the session.
+	WriteTimeout time.Duration
+}
+
+// sessionSlot holds a single, possibly not yet established, session in a session pool.
+type sessionSlot struct {
+	session *PipelinedSession
+	mutex   sync.Mutex
+}
+
+// sessionConn is a net.Conn representing a single transaction on a pipelined session. The request
+// written to it is sent upstream under a session-unique message ID, and the response read from it
+// is restored to the request's original message ID.
+type sessionConn struct {
+	session *PipelinedSession
+
+	id         uint16
+	originalID uint16
+	written    int64
+	resp       chan []byte
+	buf        *bytes.Reader
+}
+
+var (
+	// errSessionTimeout describes a transaction whose response did not arrive within the read
+	// timeout.
+	errSessionTimeout = &sessionError{"session: timed out waiting for response", true}
+	// errSessionClosed describes a transaction whose session was closed before its response
+	// arrived, e.g. because the upstream closed the connection.
+	errSessionClosed = &sessionError{"session: session closed while waiting for response", false}
+)
+
+// NewPipelinedSession creates a session over an established stream connection, and starts
+// demultiplexing responses from it in the background. The connection should not enforce its own
+// read timeout, since the session is expected to remain idle between transactions.
+func NewPipelinedSession(conn net.Conn, cxHook metrics.ConnectionLifecycleHook, readTimeout time.Duration, writeTimeout time.Duration) *PipelinedSession {
+	now := time.Now().UnixNano()
+
+	s := &PipelinedSession{
+		conn:         conn,
+		cxHook:       cxHook,
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+		pending:      make(map[uint16]*sessionConn),
+		lastWrite:    now,
+		lastRead:     now,
+		closed:       make(chan struct{}),
+	}
+
+	go s.demultiplex()
+
+	return s
+}
+
+// Conn creates a connection for a single transaction on the session. It is an error to create a
+// connection on a session that has been closed.
+func (s *PipelinedSession) Conn() (net.Conn, error) {
+	if s.Closed() {
+		return nil, fmt.Errorf("session: session is closed")
+	}
+
+	return &sessionConn{session: s, resp: make(chan []byte, 1)}, nil
+}
+
+// Closed returns whether the session has been closed, either explicitly or due to an I/O error.
+func (s *PipelinedSession) Closed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Idle returns the duration of time since the session last performed any I/O.
+func (s *PipelinedSession) Idle() time.Duration {
+	lastIO := atomic.LoadInt64(&s.lastWrite)
+	if lastRead := atomic.LoadInt64(&s.lastRead); lastRead > lastIO {
+		lastIO = lastRead
+	}
+
+	return time.Since(time.Unix(0, lastIO))
+}
+
+// Close closes the session and its underlying connection. All in-flight transactions fail.
+func (s *PipelinedSession) Close() error {
+	var err error
+
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.cxHook.EmitConnectionClose(s.conn.RemoteAddr())
+		err = s.conn.Close()
+	})
+
+	return err
+}
+
+// String implements the Stringer interface for human-consumable representation.
+func (s *PipelinedSession) String() string {
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+
+	return fmt.Sprintf(
+		"PipelinedSession{%s->%s, pending: %d}",
+		s.conn.LocalAddr(),
+		s.conn.RemoteAddr(),
+		len(s.pending),
+	)
+}
+
+// demultiplex indefinitely reads responses from the session and dispatches them to their
+// originating transactions, until the session is closed or a read fails.
+func (s *PipelinedSession) demultiplex() {
+	defer s.Close()
+
+	reader := NewFramedReader(s.conn, MaxMessageSize)
+
+	for {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			return
+		}
+
+		atomic.StoreInt64(&s.lastRead, time.Now().UnixNano())
+
+		id := binary.BigEndian.Uint16(frame[2:4])
+
+		s.pendingMutex.Lock()
+		tx, ok := s.pending[id]
+		delete(s.pending, id)
+		s.pendingMutex.Unlock()
+
+		// A response with no associated transaction belongs to a transaction that has since
+		// given up on it; discard it.
+		if ok {
+			tx.resp <- frame
+		}
+	}
+}
+
+// register assigns the transaction a message ID that is unique among all in-flight transactions
+// on the session.
+func (s *PipelinedSession) register(tx *sessionConn) error {
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+
+	if len(s.pending) > 0xffff {
+		return fmt.Errorf("session: no message IDs available: pending=%d", len(s.pending))
+	}
+
+	// Random assignment keeps IDs unpredictable, and rarely collides in practice.
+	for {
+		id := uint16(rand.Intn(0x10000))
+
+		if _, ok := s.pending[id]; !ok {
+			tx.id = id
+			s.pending[id] = tx
+
+			return nil
+		}
+	}
+}
+
+// deregister removes the transaction from the set of in-flight transactions, if present.
+func (s *PipelinedSession) deregister(tx *sessionConn) {
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+
+	if s.pending[tx.id] == tx {
+		delete(s.pending, tx.id)
+	}
+}
+
+// write writes a single frame to the session.
+func (s *PipelinedSession) write(frame []byte) (int, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if s.writeTimeout > 0 {
+		if err := s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := s.conn.Write(frame)
+	if err != nil {
+		// A partially written frame leaves the stream in an unrecoverable state.
+		go s.Close()
+		return n, err
+	}
+
+	atomic.StoreInt64(&s.lastWrite, time.Now().UnixNano())
+
+	return n, nil
+}
+
+// Read reads the transaction's response. The first read blocks until the response is available,
+// the read timeout expires, or the session is closed.
+func (c *sessionConn) Read(buf []byte) (int, error) {
+	if c.buf == nil {
+		if c.written == 0 {
+			return 0, fmt.Errorf("session: no request associated with this connection")
+		}
+
+		var timeout <-chan time.Time
+		if c.session.readTimeout > 0 {
+			timer := time.NewTimer(c.session.readTimeout)
+			defer timer.Stop()
+
+			timeout = timer.C
+		}
+
+		select {
+		case frame := <-c.resp:
+			binary.BigEndian.PutUint16(frame[2:4], c.originalID)
+			c.buf = bytes.NewReader(frame)
+		case <-timeout:
+			c.session.deregister(c)
+			return 0, errSessionTimeout
+		case <-c.session.closed:
+			c.session.deregister(c)
+			return 0, errSessionClosed
+		}
+	}
+
+	return c.buf.Read(buf)
+}
+
+// Write writes a single, complete, length-prefixed request to the session under a session-unique
+// message ID. Only one request may be written per connection.
+func (c *sessionConn) Write(buf []byte) (int, error) {
+	if c.written != 0 {
+		return 0, fmt.Errorf("session: already associated with a transaction")
+	}
+
+	if len(buf) < 2+minMessageSize {
+		return 0, fmt.Errorf("session: request too small: bytes=%d", len(buf))
+	}
+
+	if err := c.session.register(c); err != nil {
+		return 0, err
+	}
+
+	// Rewrite a copy of the request, so that the caller's buffer is left untouched.
+	frame := make([]byte, len(buf))
+	copy(frame, buf)
+
+	c.originalID = binary.BigEndian.Uint16(frame[2:4])
+	binary.BigEndian.PutUint16(frame[2:4], c.id)
+	c.written = time.Now().UnixNano()
+
+	n, err := c.session.write(frame)
+	if err != nil {
+		c.session.deregister(c)
+	}
+
+	return n, err
+}
+
+// Close abandons the transaction, if it is still in flight.
+func (c *sessionConn) Close() error {
+	c.session.deregister(c)
+
+	return nil
+}
+
+// LocalAddr obtains the session's local address.
+func (c *sessionConn) LocalAddr() net.Addr {
+	return c.session.conn.LocalAddr()
+}
+
+// RemoteAddr obtains the session's remote address.
+func (c *sessionConn) RemoteAddr() net.Addr {
+	return c.session.conn.RemoteAddr()
+}
+
+// SetDeadline noops; timeouts are governed by the session.
+func (c *sessionConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline noops; timeouts are governed by the session.
+func (c *sessionConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline noops; timeouts are governed by the session.
+func (c *sessionConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// unresponsive returns whether the session has not received any response since the transaction's
+// request was written.
+func (c *sessionConn) unresponsive() bool {
+	return c.written != 0 && atomic.LoadInt64(&c.session.lastRead) < c.written
+}
+
+// NewPipelinedSessionPool creates a session pool with the specified dialer factory and
+// configuration options. The dialer should provide connections that do not enforce their own read
+// timeout.
+func NewPipelinedSessionPool(dialer func(ctx context.Context) (net.Conn, error), cxHook metrics.ConnectionLifecycleHook, opts PipelinedSessionPoolOpts) *PipelinedSessionPool {
+	if opts.Capacity <= 0 {
+		opts.Capacity = 1
+	}
+
+	slots := make([]*sessionSlot, opts.Capacity)
+	for i := range slots {
+		slots[i] = &sessionSlot{}
+	}
+
+	return &PipelinedSessionPool{
+		dialer:       dialer,
+		cxHook:       cxHook,
+		staleTimeout: opts.StaleTimeout,
+		readTimeout:  opts.ReadTimeout,
+		writeTimeout: opts.WriteTimeout,
+		slots:        slots,
+	}
+}
+
+// Conn returns a connection for a single transaction on the next session in the pool,
+// establishing the session first if necessary. Establishing the session is abandoned if the context
+// is done first.
+func (p *PipelinedSessionPool) Conn(ctx context.Context) (*PersistentConn, error) {
+	slot := p.slots[int(atomic.AddUint32(&p.slotIdx, 1))%len(p.slots)]
+
+	session, err := slot.acquire(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := session.Conn()
+	if err != nil {
+		return nil, err
+	}
+
+	tx := conn.(*sessionConn)
+
+	return NewPersistentConn(conn, func(destroyed bool) error {
+		// A transaction that failed without the session having received anything since
+		// its request was written suggests that the session itself is unresponsive.
+		if destroyed && tx.unresponsive() {
+			go session.Close()
+		}
+
+		return conn.Close()
+	}), nil
+}
+
+// Size reports the number of live sessions in the pool.
+func (p *PipelinedSessionPool) Size() int {
+	size := 0
+
+	for _, slot := range p.slots {
+		slot.mutex.Lock()
+		if slot.session != nil && !slot.session.Closed() {
+			size++
+		}
+		slot.mutex.Unlock()
+	}
+
+	return size
+}
+
+// Close closes every session in the pool, failing all in-flight transactions. Subsequent requests
+// for connections fail.
+func (p *PipelinedSessionPool) Close() error {
+	atomic.StoreInt32(&p.closed, 1)
+
+	for _, slot := range p.slots {
+		slot.mutex.Lock()
+		if slot.session != nil {
+			go slot.session.Close()
+			slot.session = nil
+		}
+		slot.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// acquire returns the slot's session, (re)establishing it if it is absent, closed, or stale.
+func (s *sessionSlot) acquire(ctx context.Context, p *PipelinedSessionPool) (*PipelinedSession, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if atomic.LoadInt32(&p.closed) != 0 {
+		return nil, fmt.Errorf("session: session pool is closed")
+	}
+
+	if s.session != nil && !s.session.Closed() {
+		if p.staleTimeout <= 0 || s.session.Idle() < p.staleTimeout {
+			return s.session, nil
+		}
+
+		// The session is stale; close it and establish a new session. Any transactions
+		// still in flight on the stale session will fail.
+		go s.session.Close()
+	}
+
+	dialTimer := lib.NewStopwatch()
+	conn, err := p.dialer(ctx)
+	if err != nil {
+		p.cxHook.EmitConnectionError()
+		return nil, err
+	}
+
+	p.cxHook.EmitConnectionOpen(dialTimer.Elapsed(), conn.RemoteAddr())
+	s.session = NewPipelinedSession(conn, p.cxHook, p.readTimeout, p.writeTimeout)
+
+	return s.session, nil
+}
+
+// Error returns the error message.
+func (e *sessionError) Error() string {
+	return e.msg
+}
+
+// Timeout returns whether the transaction timed out.
+func (e *sessionError) Timeout() bool {
+	return e.timeout
+}
+
+// Temporary returns true, since the transaction may succeed on another session.
+func (e *sessionError) Temporary() bool {
+	return true
+}
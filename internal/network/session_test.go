@@ -0,0 +1,312 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"dotproxy/internal/dns"
+	"dotproxy/internal/metrics"
+)
+
+// sessionStub is a loopback upstream server for a single pipelined session. It collects requests
+// in batches and answers each batch in reverse order, echoing every request with the QR bit set.
+type sessionStub struct {
+	listener net.Listener
+	batch    int
+	// Message IDs with which requests arrived, in order of arrival
+	ids   []uint16
+	mutex sync.Mutex
+}
+
+// newSessionStub starts a stub server that answers requests in batches of the specified size. A
+// batch size of zero never answers, and a negative batch size hangs up upon the first request.
+func newSessionStub(t *testing.T, batch int) *sessionStub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening on loopback: %v", err)
+	}
+
+	stub := &sessionStub{listener: listener, batch: batch}
+
+	go stub.serve()
+
+	t.Cleanup(func() { listener.Close() })
+
+	return stub
+}
+
+// session dials the stub and wraps the connection in a pipelined session.
+func (s *sessionStub) session(t *testing.T, readTimeout time.Duration) *PipelinedSession {
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("error dialing stub: %v", err)
+	}
+
+	session := NewPipelinedSession(conn, metrics.NewNoopConnectionLifecycleHook(), readTimeout, time.Second)
+
+	t.Cleanup(func() { session.Close() })
+
+	return session
+}
+
+func (s *sessionStub) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	reader := NewFramedReader(conn, MaxMessageSize)
+
+	var pending [][]byte
+
+	for {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		s.ids = append(s.ids, binary.BigEndian.Uint16(frame[2:4]))
+		s.mutex.Unlock()
+
+		if s.batch < 0 {
+			return
+		}
+
+		if s.batch == 0 {
+			continue
+		}
+
+		frame[4] |= 0x80
+		pending = append(pending, frame)
+
+		if len(pending) < s.batch {
+			continue
+		}
+
+		for idx := len(pending) - 1; idx >= 0; idx-- {
+			if _, err := conn.Write(pending[idx]); err != nil {
+				return
+			}
+		}
+
+		pending = nil
+	}
+}
+
+// received returns the message IDs with which requests arrived at the stub.
+func (s *sessionStub) received() []uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]uint16(nil), s.ids...)
+}
+
+// sessionQuery creates a framed query for the specified name.
+func sessionQuery(t *testing.T, id uint16, name string) []byte {
+	query, err := dns.NewQuery(id, name, dns.TypeA)
+	if err != nil {
+		t.Fatalf("error creating query: %v", err)
+	}
+
+	frame := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(frame, uint16(len(query)))
+
+	return append(frame, query...)
+}
+
+// sessionTransact performs a single transaction on the session, returning the framed response.
+func sessionTransact(session *PipelinedSession, req []byte) ([]byte, error) {
+	conn, err := session.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	return NewFramedReader(conn, MaxMessageSize).ReadFrame()
+}
+
+func TestPipelinedSessionOutOfOrderResponses(t *testing.T) {
+	const transactions = 64
+
+	stub := newSessionStub(t, transactions)
+	session := stub.session(t, 5*time.Second)
+
+	var wg sync.WaitGroup
+
+	for idx := 0; idx < transactions; idx++ {
+		wg.Add(1)
+
+		go func(idx int) {
+			defer wg.Done()
+
+			// Every transaction uses the same message ID, which the session must replace with
+			// a unique one on the wire.
+			req := sessionQuery(t, 0x1234, fmt.Sprintf("%d.example.com", idx))
+
+			resp, err := sessionTransact(session, req)
+			if err != nil {
+				t.Errorf("error performing transaction: idx=%d err=%v", idx, err)
+				return
+			}
+
+			if id := binary.BigEndian.Uint16(resp[2:4]); id != 0x1234 {
+				t.Errorf("expected original message ID to be restored: idx=%d id=%#x", idx, id)
+			}
+
+			// The response to a transaction echoes its own question, not another's.
+			expected := append([]byte(nil), req...)
+			expected[4] |= 0x80
+
+			if !bytes.Equal(resp[4:], expected[4:]) {
+				t.Errorf("response does not match request: idx=%d", idx)
+			}
+		}(idx)
+	}
+
+	wg.Wait()
+
+	seen := make(map[uint16]bool)
+	for _, id := range stub.received() {
+		if seen[id] {
+			t.Errorf("message ID assigned to concurrent transactions: id=%d", id)
+		}
+
+		seen[id] = true
+	}
+
+	if len(seen) != transactions {
+		t.Errorf("unexpected number of requests received: received=%d", len(seen))
+	}
+
+	if session.Closed() {
+		t.Error("expected session to remain open")
+	}
+}
+
+func TestPipelinedSessionRegisterUniqueIDs(t *testing.T) {
+	stub := newSessionStub(t, 0)
+	session := stub.session(t, time.Second)
+
+	seen := make(map[uint16]bool)
+	txs := make([]*sessionConn, 0x8000)
+
+	for idx := range txs {
+		txs[idx] = &sessionConn{session: session, resp: make(chan []byte, 1)}
+
+		if err := session.register(txs[idx]); err != nil {
+			t.Fatalf("error registering transaction: %v", err)
+		}
+
+		if seen[txs[idx].id] {
+			t.Fatalf("message ID assigned twice: id=%d", txs[idx].id)
+		}
+
+		seen[txs[idx].id] = true
+	}
+
+	for _, tx := range txs {
+		session.deregister(tx)
+	}
+
+	if len(session.pending) != 0 {
+		t.Errorf("expected no transactions in flight: pending=%d", len(session.pending))
+	}
+}
+
+func TestPipelinedSessionTimeout(t *testing.T) {
+	stub := newSessionStub(t, 0)
+	session := stub.session(t, 50*time.Millisecond)
+
+	start := time.Now()
+
+	_, err := sessionTransact(session, sessionQuery(t, 1, "example.com"))
+
+	// Timeouts are reported as network errors, so that the request may be retried.
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected transaction to time out: err=%v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("transaction did not time out promptly: elapsed=%v", elapsed)
+	}
+
+	session.pendingMutex.Lock()
+	pending := len(session.pending)
+	session.pendingMutex.Unlock()
+
+	if pending != 0 {
+		t.Errorf("expected timed out transaction to be deregistered: pending=%d", pending)
+	}
+
+	// A single transaction timing out does not close the session.
+	if session.Closed() {
+		t.Error("expected session to remain open")
+	}
+}
+
+func TestPipelinedSessionClose(t *testing.T) {
+	stub := newSessionStub(t, 0)
+	session := stub.session(t, 0)
+
+	errs := make(chan error, 1)
+
+	go func() {
+		_, err := sessionTransact(session, sessionQuery(t, 1, "example.com"))
+		errs <- err
+	}()
+
+	// Wait for the request to arrive before closing the session.
+	for deadline := time.Now().Add(time.Second); len(stub.received()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("stub did not receive request")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	session.Close()
+
+	select {
+	case err := <-errs:
+		var netErr net.Error
+		if !errors.As(err, &netErr) {
+			t.Errorf("expected in-flight transaction to fail with a network error: err=%v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("in-flight transaction did not fail when the session closed")
+	}
+
+	if !session.Closed() {
+		t.Error("expected session to be closed")
+	}
+
+	if _, err := session.Conn(); err == nil {
+		t.Error("expected connection on closed session to fail")
+	}
+}
+
+func TestPipelinedSessionClosedByUpstream(t *testing.T) {
+	stub := newSessionStub(t, -1)
+	session := stub.session(t, 0)
+
+	if _, err := sessionTransact(session, sessionQuery(t, 1, "example.com")); err == nil {
+		t.Fatal("expected transaction to fail when the upstream hangs up")
+	}
+
+	if !session.Closed() {
+		t.Error("expected session to be closed")
+	}
+}
@@ -3,10 +3,15 @@
 package network
 
 import (
+	"context"
 	"fmt"
+	"hash/fnv"
+	"math"
 	"math/rand"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,10 +25,67 @@ type ShardedClientFactory func([]Client) Client
 
 // RoundRobinShardedClient shards requests among clients fairly in round-robin order.
 type RoundRobinShardedClient struct {
+	// Number of connections requested so far, incremented atomically; the round robin index is
+	// derived from it. It is the first field to guarantee 64-bit alignment for atomic access.
+	rrCount uint64
+
+	clients []Client
+}
+
+// WeightedRoundRobinShardedClient shards requests among clients in proportion to their weights,
+// using smooth weighted round robin: each client's selections are spread evenly over time, rather
+// than made in bursts.
+type WeightedRoundRobinShardedClient struct {
 	clients []Client
+	weights []int
 
-	// Current round robin index (not necessarily async-safe)
-	rrIdx int
+	// Current smoothed weight of each client, and the mutex protecting them.
+	current []int
+	mutex   sync.Mutex
+}
+
+// WeightedRandomShardedClient shards requests among clients randomly, in proportion to their
+// weights.
+type WeightedRandomShardedClient struct {
+	clients []Client
+	weights []int
+}
+
+// ShardedClientOpts formalizes sharded client configuration options.
+type ShardedClientOpts struct {
+	// Weights are the relative weights of the clients, in the same order as the clients, used
+	// by the weighted load balancing policies. Clients without a positive weight are given a
+	// weight of 1.
+	Weights []int
+	// Keys are stable, unique identifiers of the clients, e.g. their addresses, in the same
+	// order as the clients, used by the consistent hash load balancing policy to place clients
+	// on the hash ring. Clients without a key are identified by their index, in which case
+	// adding or removing a client may remap more keys than necessary.
+	Keys []string
+	// FailureBackoff is the duration for which the availability load balancing policy initially
+	// disables a client that fails to provide a connection. The duration doubles with each
+	// consecutive failure, and is reset once the client provides a connection. Defaults to 100
+	// milliseconds.
+	FailureBackoff time.Duration
+	// MaxFailureBackoff caps the duration for which the availability load balancing policy
+	// disables a failed client. Defaults to 30 seconds.
+	MaxFailureBackoff time.Duration
+}
+
+// ConsistentHashShardedClient directs requests with the same key, i.e. query name, to the same
+// client, so that upstream caches are not diluted across all clients. Keys are mapped onto a hash
+// ring of clients with bounded loads: a client already serving more than its fair share of
+// in-flight transactions is passed over in favor of the next client on the ring, as is a client
+// that is unhealthy or fails to provide a connection.
+type ConsistentHashShardedClient struct {
+	clients []Client
+	ring    []consistentHashNode
+}
+
+// consistentHashNode is a single point on a consistent hash ring.
+type consistentHashNode struct {
+	hash uint64
+	idx  int
 }
 
 // RandomShardedClient shards requests among clients randomly.
@@ -45,6 +107,11 @@ type HistoricalConnectionsShardedClient struct {
 type AvailabilityShardedClient struct {
 	clients []Client
 
+	// Duration for which a client is initially disabled after failing to provide a connection,
+	// and the cap on the duration as it doubles with each consecutive failure.
+	backoff    time.Duration
+	maxBackoff time.Duration
+
 	// Tracks the timestamp at which each client last errored
 	lastError map[Client]time.Time
 	// Tracks the current duration of time to wait before a failed connection is once again
@@ -54,6 +121,21 @@ type AvailabilityShardedClient struct {
 	mutex sync.RWMutex
 }
 
+// LowestLatencyShardedClient directs requests to the client with the lowest moving average of
+// transaction latency. A small fraction of requests are directed to a client at random instead, so
+// that the latency of every client, including those recovering from a period of slowness or
+// failure, continues to be measured.
+type LowestLatencyShardedClient struct {
+	clients []Client
+}
+
+// LeastOutstandingShardedClient directs requests to the less loaded of two clients chosen at
+// random, as measured by their number of in-flight transactions. Sampling two clients, rather
+// than comparing all of them, avoids herding all requests onto the single least loaded client.
+type LeastOutstandingShardedClient struct {
+	clients []Client
+}
+
 // FailoverShardedClient provides connections in priority order, serially failing over to the next
 // client(s) in the list when the primary is not successful in providing a connection.
 type FailoverShardedClient struct {
@@ -76,18 +158,57 @@ const (
 	// Failover provides connections from multiple clients in serial order, only failing over to
 	// secondary clients when the primary fails.
 	Failover
+	// LowestLatency selects the client with the lowest moving average of transaction latency,
+	// occasionally selecting a client at random to re-measure its latency.
+	LowestLatency
+	// LeastOutstanding selects two clients at random, and selects whichever of them has fewer
+	// transactions in flight to provide the connection.
+	LeastOutstanding
+	// WeightedRoundRobin iterates through clients in proportion to their weights, interleaving
+	// selections of each client as evenly as possible.
+	WeightedRoundRobin
+	// WeightedRandom selects a client at random, with probability proportional to its weight.
+	WeightedRandom
+	// ConsistentHash selects a client by hashing the query name onto a ring of clients, so that
+	// each name is consistently served by the same client, bounding the load on each client.
+	ConsistentHash
+)
+
+const (
+	// latencyExplorationProbability is the probability with which the lowest latency policy
+	// selects a client at random, rather than the client with the lowest latency.
+	latencyExplorationProbability = 0.05
+	// consistentHashReplicas is the number of points on the hash ring for each client. More
+	// points distribute keys among clients more evenly.
+	consistentHashReplicas = 160
+	// consistentHashLoadFactor bounds the number of in-flight transactions on each client of
+	// the consistent hash policy, as a multiple of the average per client.
+	consistentHashLoadFactor = 1.25
 )
 
 // NewShardedClient creates a single Client that provides connections from several other Clients
-// governed by a load balancing policy. It returns an error if the specified load balancing policy
-// has no associated sharded client factory.
-func NewShardedClient(clients []Client, lbPolicy LoadBalancingPolicy) (Client, error) {
+// governed by a load balancing policy. Every sharded client is safe for concurrent use. It returns
+// an error if the specified load balancing policy has no associated sharded client factory.
+func NewShardedClient(clients []Client, lbPolicy LoadBalancingPolicy, opts ShardedClientOpts) (Client, error) {
 	factories := map[LoadBalancingPolicy]ShardedClientFactory{
 		RoundRobin:            NewRoundRobinShardedClient,
 		Random:                NewRandomShardedClient,
 		HistoricalConnections: NewHistoricalConnectionsShardedClient,
-		Availability:          NewAvailabilityShardedClient,
-		Failover:              NewFailoverShardedClient,
+		Availability: func(clients []Client) Client {
+			return NewAvailabilityShardedClient(clients, opts.FailureBackoff, opts.MaxFailureBackoff)
+		},
+		Failover:         NewFailoverShardedClient,
+		LowestLatency:    NewLowestLatencyShardedClient,
+		LeastOutstanding: NewLeastOutstandingShardedClient,
+		WeightedRoundRobin: func(clients []Client) Client {
+			return NewWeightedRoundRobinShardedClient(clients, opts.Weights)
+		},
+		WeightedRandom: func(clients []Client) Client {
+			return NewWeightedRandomShardedClient(clients, opts.Weights)
+		},
+		ConsistentHash: func(clients []Client) Client {
+			return NewConsistentHashShardedClient(clients, opts.Keys)
+		},
 	}
 
 	factory, ok := factories[lbPolicy]
@@ -106,13 +227,25 @@ func NewRoundRobinShardedClient(clients []Client) Client {
 	return &RoundRobinShardedClient{clients: clients}
 }
 
-// Conn retrieves a connection from the next client in the round robin index.
-func (c *RoundRobinShardedClient) Conn() (*PersistentConn, error) {
-	defer func() {
-		c.rrIdx = (c.rrIdx + 1) % len(c.clients)
-	}()
+// Conn retrieves a connection from the next healthy client in the round robin index.
+func (c *RoundRobinShardedClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	healthy := healthyClients(c.clients)
+
+	// Unhealthy clients are skipped by drawing the next index, rather than advancing to the next
+	// healthy client in index order, so that the skipped client's share of requests is spread
+	// evenly among the healthy clients instead of falling to its neighbor. The draws are bounded
+	// to a single pass of the index, which ordinarily includes a healthy client.
+	var rrIdx int
 
-	return c.clients[c.rrIdx].Conn()
+	for range c.clients {
+		rrIdx = int((atomic.AddUint64(&c.rrCount, 1) - 1) % uint64(len(c.clients)))
+
+		if healthy[rrIdx] {
+			break
+		}
+	}
+
+	return c.clients[rrIdx].Conn(ctx)
 }
 
 // Stats aggregates stats from all child clients.
@@ -120,14 +253,107 @@ func (c *RoundRobinShardedClient) Stats() Stats {
 	return aggregateClientsStats(c.clients)
 }
 
+// NewWeightedRoundRobinShardedClient is a client factory for the weighted round robin load
+// balancing policy.
+func NewWeightedRoundRobinShardedClient(clients []Client, weights []int) Client {
+	return &WeightedRoundRobinShardedClient{
+		clients: clients,
+		weights: normalizeWeights(clients, weights),
+		current: make([]int, len(clients)),
+	}
+}
+
+// Conn retrieves a connection from the next client in the smooth weighted round robin order. Each
+// selection raises every client's smoothed weight by its weight, selects the client with the
+// highest smoothed weight, and lowers the selected client's smoothed weight by the total weight.
+// Unhealthy clients do not participate in the selection.
+func (c *WeightedRoundRobinShardedClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	healthy := healthyClients(c.clients)
+
+	c.mutex.Lock()
+
+	total := 0
+	selected := -1
+
+	for idx, weight := range c.weights {
+		if !healthy[idx] {
+			continue
+		}
+
+		c.current[idx] += weight
+		total += weight
+
+		if selected < 0 || c.current[idx] > c.current[selected] {
+			selected = idx
+		}
+	}
+
+	c.current[selected] -= total
+
+	c.mutex.Unlock()
+
+	return c.clients[selected].Conn(ctx)
+}
+
+// Stats aggregates stats from all child clients.
+func (c *WeightedRoundRobinShardedClient) Stats() Stats {
+	return aggregateClientsStats(c.clients)
+}
+
+// NewWeightedRandomShardedClient is a client factory for the weighted random load balancing
+// policy.
+func NewWeightedRandomShardedClient(clients []Client, weights []int) Client {
+	return &WeightedRandomShardedClient{
+		clients: clients,
+		weights: normalizeWeights(clients, weights),
+	}
+}
+
+// Conn selects a healthy client at random, with probability proportional to its weight, to provide
+// the connection.
+func (c *WeightedRandomShardedClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	healthy := healthyClients(c.clients)
+
+	total := 0
+	for idx, weight := range c.weights {
+		if healthy[idx] {
+			total += weight
+		}
+	}
+
+	target := rand.Intn(total)
+	selected := 0
+
+	for idx, weight := range c.weights {
+		if !healthy[idx] {
+			continue
+		}
+
+		selected = idx
+
+		if target -= weight; target < 0 {
+			break
+		}
+	}
+
+	return c.clients[selected].Conn(ctx)
+}
+
+// Stats aggregates stats from all child clients.
+func (c *WeightedRandomShardedClient) Stats() Stats {
+	return aggregateClientsStats(c.clients)
+}
+
 // NewRandomShardedClient is a client factory for the random load balancing policy.
 func NewRandomShardedClient(clients []Client) Client {
 	return &RandomShardedClient{clients}
 }
 
-// Conn selects a client at random to provide the connection.
-func (c *RandomShardedClient) Conn() (*PersistentConn, error) {
-	return c.clients[rand.Intn(len(c.clients))].Conn()
+// Conn selects a healthy client at random to provide the connection.
+func (c *RandomShardedClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	candidates := filterClients(c.clients, healthyClients(c.clients))
+
+	return candidates[rand.Intn(len(candidates))].Conn(ctx)
 }
 
 // Stats aggregates stats from all child clients.
@@ -141,18 +367,18 @@ func NewHistoricalConnectionsShardedClient(clients []Client) Client {
 	return &HistoricalConnectionsShardedClient{clients}
 }
 
-// Conn selects the client that has, up until the time of invocation, provided the fewest successful
-// connections.
-func (c *HistoricalConnectionsShardedClient) Conn() (*PersistentConn, error) {
+// Conn selects the healthy client that has, up until the time of invocation, provided the fewest
+// successful connections.
+func (c *HistoricalConnectionsShardedClient) Conn(ctx context.Context) (*PersistentConn, error) {
 	var client Client
 
-	for _, candidate := range c.clients {
+	for _, candidate := range filterClients(c.clients, healthyClients(c.clients)) {
 		if client == nil || candidate.Stats().SuccessfulConnections < client.Stats().SuccessfulConnections {
 			client = candidate
 		}
 	}
 
-	return client.Conn()
+	return client.Conn(ctx)
 }
 
 // Stats aggregates stats from all child clients.
@@ -160,8 +386,11 @@ func (c *HistoricalConnectionsShardedClient) Stats() Stats {
 	return aggregateClientsStats(c.clients)
 }
 
-// NewAvailabilityShardedClient is a client factory for the availability load balancing policy.
-func NewAvailabilityShardedClient(clients []Client) Client {
+// NewAvailabilityShardedClient is a client factory for the availability load balancing policy. A
+// client that fails to provide a connection is disabled for the backoff duration, doubling with
+// each consecutive failure up to the maximum backoff duration. Non-positive durations are replaced
+// with defaults of 100 milliseconds and 30 seconds, respectively.
+func NewAvailabilityShardedClient(clients []Client, backoff time.Duration, maxBackoff time.Duration) Client {
 	lastError := make(map[Client]time.Time)
 	errorExpiry := make(map[Client]time.Duration)
 
@@ -170,51 +399,54 @@ func NewAvailabilityShardedClient(clients []Client) Client {
 		errorExpiry[client] = 0
 	}
 
+	// Sane option defaults
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+
 	return &AvailabilityShardedClient{
 		clients:     clients,
+		backoff:     backoff,
+		maxBackoff:  maxBackoff,
 		lastError:   lastError,
 		errorExpiry: errorExpiry,
 	}
 }
 
 // Conn attempts to robustly provide a connection from all available client using a failover retry
-// mechanism. It is possible for this method to error if the load balancing policy determines that
-// there are no live clients eligible for providing a connection.
-func (c *AvailabilityShardedClient) Conn() (*PersistentConn, error) {
-	// Describes the amount of time that must elapse before resetting a client's error expiry
-	// timer. In other words, this is the minimum amount of time after which a client errors
-	// that it is permitted to be retried for a live connection. Otherwise, the connection is
-	// pulled out of the sharding pool for exponentially increasing durations of time.
-	failedClientExpiry := 30 * time.Second
-
-	client, err := c.selectAvailable()
-	if err != nil {
-		return nil, err
-	}
-
-	conn, err := client.Conn()
-	if err != nil {
-		c.mutex.Lock()
-
-		if c.lastError[client].IsZero() || time.Since(c.lastError[client]) > failedClientExpiry {
-			// The client has either never errored before, or the last error is too far
-			// in the past. Start its exponential backoff timer at 100 ms, indicating
-			// that this client will be marked unavailable for the next 100 ms.
-			c.errorExpiry[client] = 100 * time.Millisecond
-		} else {
-			// The most recent client failure was too recent; double the current expiry
-			// time.
-			c.errorExpiry[client] *= 2
+// mechanism, trying at most as many clients as there are. It is possible for this method to error
+// if the load balancing policy determines that there are no live clients eligible for providing a
+// connection.
+func (c *AvailabilityShardedClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	for range c.clients {
+		client, err := c.selectAvailable()
+		if err != nil {
+			return nil, err
 		}
 
-		c.lastError[client] = time.Now()
+		conn, err := client.Conn(ctx)
+		if err == nil {
+			c.restore(client)
+			return conn, nil
+		}
 
-		c.mutex.Unlock()
+		// A client is not penalized for failing a request that has been abandoned.
+		if ctx.Err() != nil {
+			return nil, err
+		}
 
-		return c.Conn()
+		c.disable(client)
 	}
 
-	return conn, nil
+	return nil, fmt.Errorf("sharding: all clients failed to provide a connection")
 }
 
 // Stats aggregates stats from all child clients.
@@ -222,12 +454,56 @@ func (c *AvailabilityShardedClient) Stats() Stats {
 	return aggregateClientsStats(c.clients)
 }
 
+// disable pulls a client that failed to provide a connection out of the availability pool. The
+// client is disabled for the initial backoff duration if it has not failed since it was last
+// restored, and for double its previous duration, up to the maximum, otherwise. Failures of
+// requests that raced with a previous failure, while the client is already disabled, do not extend
+// the duration.
+func (c *AvailabilityShardedClient) disable(client Client) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	lastError := c.lastError[client]
+	expiry := c.errorExpiry[client]
+
+	switch {
+	case lastError.IsZero():
+		c.errorExpiry[client] = c.backoff
+	case time.Since(lastError) > expiry:
+		if expiry *= 2; expiry > c.maxBackoff {
+			expiry = c.maxBackoff
+		}
+
+		c.errorExpiry[client] = expiry
+	default:
+		return
+	}
+
+	c.lastError[client] = time.Now()
+}
+
+// restore resets the backoff of a client that successfully provided a connection.
+func (c *AvailabilityShardedClient) restore(client Client) {
+	c.mutex.RLock()
+	failed := !c.lastError[client].IsZero()
+	c.mutex.RUnlock()
+
+	if !failed {
+		return
+	}
+
+	c.mutex.Lock()
+	c.lastError[client] = time.Time{}
+	c.errorExpiry[client] = 0
+	c.mutex.Unlock()
+}
+
 // Select an eligible client at random. This method may error if no clients are available to
 // provide connections.
 func (c *AvailabilityShardedClient) selectAvailable() (Client, error) {
 	var eligibleClients []Client
 
-	for _, candidate := range c.clients {
+	for _, candidate := range filterClients(c.clients, healthyClients(c.clients)) {
 		c.mutex.RLock()
 		lastError := c.lastError[candidate]
 		expiry := c.errorExpiry[candidate]
@@ -252,13 +528,19 @@ func NewFailoverShardedClient(clients []Client) Client {
 	return &FailoverShardedClient{clients}
 }
 
-// Conn attempts to provide connections from clients in serial order, failing over to the next
-// client on error.
-func (c *FailoverShardedClient) Conn() (*PersistentConn, error) {
-	for _, client := range c.clients {
-		if conn, err := client.Conn(); err == nil {
+// Conn attempts to provide connections from healthy clients in serial order, failing over to the
+// next client on error.
+func (c *FailoverShardedClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	for _, client := range filterClients(c.clients, healthyClients(c.clients)) {
+		conn, err := client.Conn(ctx)
+		if err == nil {
 			return conn, nil
 		}
+
+		// The remaining clients are not tried for a request that has been abandoned.
+		if ctx.Err() != nil {
+			return nil, err
+		}
 	}
 
 	return nil, fmt.Errorf("sharding: all clients failed to provide a connection")
@@ -269,6 +551,177 @@ func (c *FailoverShardedClient) Stats() Stats {
 	return aggregateClientsStats(c.clients)
 }
 
+// NewLowestLatencyShardedClient is a client factory for the lowest latency load balancing policy.
+func NewLowestLatencyShardedClient(clients []Client) Client {
+	return &LowestLatencyShardedClient{clients}
+}
+
+// Conn selects the healthy client with the lowest latency to provide the connection. Clients whose
+// latency has not yet been measured are preferred, so that every client is measured.
+func (c *LowestLatencyShardedClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	candidates := filterClients(c.clients, healthyClients(c.clients))
+
+	if rand.Float64() < latencyExplorationProbability {
+		return candidates[rand.Intn(len(candidates))].Conn(ctx)
+	}
+
+	var client Client
+	var latency time.Duration
+
+	for _, candidate := range candidates {
+		candidateLatency := candidate.Stats().Latency
+
+		if client == nil || candidateLatency < latency {
+			client = candidate
+			latency = candidateLatency
+		}
+	}
+
+	return client.Conn(ctx)
+}
+
+// Stats aggregates stats from all child clients.
+func (c *LowestLatencyShardedClient) Stats() Stats {
+	return aggregateClientsStats(c.clients)
+}
+
+// NewLeastOutstandingShardedClient is a client factory for the least outstanding load balancing
+// policy.
+func NewLeastOutstandingShardedClient(clients []Client) Client {
+	return &LeastOutstandingShardedClient{clients}
+}
+
+// Conn selects the client with fewer in-flight transactions among two healthy clients sampled at
+// random.
+func (c *LeastOutstandingShardedClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	candidates := filterClients(c.clients, healthyClients(c.clients))
+
+	if len(candidates) == 1 {
+		return candidates[0].Conn(ctx)
+	}
+
+	// Sample two distinct clients.
+	first := rand.Intn(len(candidates))
+	second := rand.Intn(len(candidates) - 1)
+	if second >= first {
+		second++
+	}
+
+	client := candidates[first]
+	if candidates[second].Stats().ActiveConnections < client.Stats().ActiveConnections {
+		client = candidates[second]
+	}
+
+	return client.Conn(ctx)
+}
+
+// Stats aggregates stats from all child clients.
+func (c *LeastOutstandingShardedClient) Stats() Stats {
+	return aggregateClientsStats(c.clients)
+}
+
+// NewConsistentHashShardedClient is a client factory for the consistent hash load balancing
+// policy.
+func NewConsistentHashShardedClient(clients []Client, keys []string) Client {
+	ring := make([]consistentHashNode, 0, len(clients)*consistentHashReplicas)
+
+	for idx := range clients {
+		key := fmt.Sprintf("client-%d", idx)
+		if idx < len(keys) && keys[idx] != "" {
+			key = keys[idx]
+		}
+
+		for replica := 0; replica < consistentHashReplicas; replica++ {
+			ring = append(ring, consistentHashNode{
+				hash: hashKey(fmt.Sprintf("%s#%d", key, replica)),
+				idx:  idx,
+			})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	return &ConsistentHashShardedClient{clients: clients, ring: ring}
+}
+
+// Conn retrieves a connection for a request without a key, starting from a random point on the
+// ring.
+func (c *ConsistentHashShardedClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	return c.connFrom(ctx, rand.Intn(len(c.ring)))
+}
+
+// ConnFor retrieves a connection from the client to which the key is mapped, failing over to
+// subsequent clients on the ring.
+func (c *ConsistentHashShardedClient) ConnFor(ctx context.Context, key string) (*PersistentConn, error) {
+	hash := hashKey(key)
+	start := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].hash >= hash })
+
+	return c.connFrom(ctx, start%len(c.ring))
+}
+
+// Stats aggregates stats from all child clients.
+func (c *ConsistentHashShardedClient) Stats() Stats {
+	return aggregateClientsStats(c.clients)
+}
+
+// connFrom walks the ring clockwise from the specified point, visiting each client once in the
+// order it is first encountered, until one provides a connection.
+func (c *ConsistentHashShardedClient) connFrom(ctx context.Context, start int) (*PersistentConn, error) {
+	healthy := healthyClients(c.clients)
+	visited := make([]bool, len(c.clients))
+	order := make([]int, 0, len(c.clients))
+
+	for offset := 0; offset < len(c.ring) && len(order) < len(c.clients); offset++ {
+		idx := c.ring[(start+offset)%len(c.ring)].idx
+
+		if !visited[idx] {
+			visited[idx] = true
+			order = append(order, idx)
+		}
+	}
+
+	// Each client's load is bounded by a multiple of the average load, including the request
+	// being placed, per "Consistent Hashing with Bounded Loads" (Mirrokni et al.).
+	load := make([]int, len(c.clients))
+	total := 0
+
+	for idx, client := range c.clients {
+		load[idx] = client.Stats().ActiveConnections
+		total += load[idx]
+	}
+
+	capacity := int(math.Ceil(consistentHashLoadFactor * float64(total+1) / float64(len(c.clients))))
+
+	// Clients are tried in tiers: healthy clients with spare capacity, then healthy clients
+	// without it, then unhealthy clients, each in ring order.
+	var preferred, overloaded, unhealthy []int
+
+	for _, idx := range order {
+		switch {
+		case !healthy[idx]:
+			unhealthy = append(unhealthy, idx)
+		case load[idx] >= capacity:
+			overloaded = append(overloaded, idx)
+		default:
+			preferred = append(preferred, idx)
+		}
+	}
+
+	for _, idx := range append(append(preferred, overloaded...), unhealthy...) {
+		conn, err := c.clients[idx].Conn(ctx)
+		if err == nil {
+			return conn, nil
+		}
+
+		// The remaining clients are not tried for a request that has been abandoned.
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("sharding: all clients failed to provide a connection")
+}
+
 // ParseLoadBalancingPolicy parses a LoadBalancingPolicy constant from its stringified
 // representation in a case-insensitive manner.
 func ParseLoadBalancingPolicy(lbPolicy string) (LoadBalancingPolicy, bool) {
@@ -278,6 +731,11 @@ func ParseLoadBalancingPolicy(lbPolicy string) (LoadBalancingPolicy, bool) {
 		HistoricalConnections,
 		Availability,
 		Failover,
+		LowestLatency,
+		LeastOutstanding,
+		WeightedRoundRobin,
+		WeightedRandom,
+		ConsistentHash,
 	}
 
 	for _, knownLbPolicy := range knownLbPolicies {
@@ -289,10 +747,79 @@ func ParseLoadBalancingPolicy(lbPolicy string) (LoadBalancingPolicy, bool) {
 	return RoundRobin, false
 }
 
-// aggregateClientsStats creates a single Stats struct from those in multiple Clients.
+// normalizeWeights returns the weight of each client, defaulting to 1 for clients without a
+// positive weight.
+func normalizeWeights(clients []Client, weights []int) []int {
+	normalized := make([]int, len(clients))
+
+	for idx := range clients {
+		normalized[idx] = 1
+
+		if idx < len(weights) && weights[idx] > 0 {
+			normalized[idx] = weights[idx]
+		}
+	}
+
+	return normalized
+}
+
+// healthyClients describes, in client order, whether each client is eligible to provide
+// connections on the basis of its health. If every client has been marked unhealthy, all clients
+// are considered eligible, so that requests are attempted rather than failed outright.
+func healthyClients(clients []Client) []bool {
+	healthy := make([]bool, len(clients))
+	anyHealthy := false
+
+	for idx, client := range clients {
+		healthy[idx] = !client.Stats().Unhealthy
+		anyHealthy = anyHealthy || healthy[idx]
+	}
+
+	if !anyHealthy {
+		for idx := range healthy {
+			healthy[idx] = true
+		}
+	}
+
+	return healthy
+}
+
+// filterClients returns the clients that are marked eligible, preserving their order.
+func filterClients(clients []Client, eligible []bool) []Client {
+	var filtered []Client
+
+	for idx, client := range clients {
+		if eligible[idx] {
+			filtered = append(filtered, client)
+		}
+	}
+
+	return filtered
+}
+
+// hashKey hashes a key onto the consistent hash ring. The FNV-1a hash is finalized with additional
+// mixing, so that similar keys are spread evenly around the ring.
+func hashKey(key string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	hash := hasher.Sum64()
+
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+
+	return hash
+}
+
+// aggregateClientsStats creates a single Stats struct from those in multiple Clients. The
+// aggregate is unhealthy only if every client is unhealthy.
 func aggregateClientsStats(clients []Client) Stats {
 	var multipleStats []Stats
 	var aggregatedStats Stats
+	var measuredClients int
+	var unhealthyClients int
 
 	for _, client := range clients {
 		multipleStats = append(multipleStats, client.Stats())
@@ -301,7 +828,24 @@ func aggregateClientsStats(clients []Client) Stats {
 	for _, stats := range multipleStats {
 		aggregatedStats.SuccessfulConnections += stats.SuccessfulConnections
 		aggregatedStats.FailedConnections += stats.FailedConnections
+		aggregatedStats.ActiveConnections += stats.ActiveConnections
+
+		if stats.Unhealthy {
+			unhealthyClients++
+		}
+
+		if stats.Latency > 0 {
+			aggregatedStats.Latency += stats.Latency
+			measuredClients++
+		}
 	}
 
+	// The aggregate latency is the mean latency among clients whose latency has been measured.
+	if measuredClients > 0 {
+		aggregatedStats.Latency /= time.Duration(measuredClients)
+	}
+
+	aggregatedStats.Unhealthy = len(clients) > 0 && unhealthyClients == len(clients)
+
 	return aggregatedStats
 }
@@ -0,0 +1,134 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingClient is a Client that counts the connections it provides, and reports a fixed latency.
+type countingClient struct {
+	conns   uint64
+	latency time.Duration
+}
+
+func (c *countingClient) Conn(ctx context.Context) (*PersistentConn, error) {
+	atomic.AddUint64(&c.conns, 1)
+
+	return NewPersistentConn(nil, func(destroyed bool) error { return nil }), nil
+}
+
+func (c *countingClient) Stats() Stats {
+	return Stats{
+		SuccessfulConnections: int(atomic.LoadUint64(&c.conns)),
+		Latency:               c.latency,
+	}
+}
+
+func TestShardedClientConcurrentDistribution(t *testing.T) {
+	const (
+		goroutines = 64
+		requests   = 1000
+		total      = goroutines * requests
+	)
+
+	weights := []int{1, 2, 3, 4}
+	uniform := []float64{0.25, 0.25, 0.25, 0.25}
+	weighted := []float64{0.1, 0.2, 0.3, 0.4}
+	explored := latencyExplorationProbability / float64(len(weights))
+
+	cases := []struct {
+		policy LoadBalancingPolicy
+		// Expected fraction of connections provided by each client
+		shares []float64
+		// Maximum deviation from the expected fraction, or zero if the distribution is exact
+		tolerance float64
+	}{
+		{RoundRobin, uniform, 0},
+		{Random, uniform, 0.02},
+		{HistoricalConnections, uniform, 0.02},
+		{Availability, uniform, 0.02},
+		{Failover, []float64{1, 0, 0, 0}, 0},
+		{LowestLatency, []float64{1 - 3*explored, explored, explored, explored}, 0.01},
+		{LeastOutstanding, uniform, 0.02},
+		{WeightedRoundRobin, weighted, 0},
+		{WeightedRandom, weighted, 0.02},
+		{ConsistentHash, uniform, 0.05},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			counters := make([]*countingClient, len(weights))
+			clients := make([]Client, len(weights))
+
+			for idx := range clients {
+				// The first client has the lowest latency.
+				counters[idx] = &countingClient{latency: time.Duration(idx+1) * time.Millisecond}
+				clients[idx] = counters[idx]
+			}
+
+			sharded, err := NewShardedClient(clients, tc.policy, ShardedClientOpts{Weights: weights})
+			if err != nil {
+				t.Fatalf("error creating sharded client: %v", err)
+			}
+
+			var wg sync.WaitGroup
+
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+
+				go func(g int) {
+					defer wg.Done()
+
+					for i := 0; i < requests; i++ {
+						var conn *PersistentConn
+						var err error
+
+						if keyed, ok := sharded.(KeyedClient); ok {
+							conn, err = keyed.ConnFor(context.Background(), fmt.Sprintf("%d.%d.example.com", g, i))
+						} else {
+							conn, err = sharded.Conn(context.Background())
+						}
+
+						if err != nil {
+							t.Errorf("error retrieving connection: %v", err)
+							return
+						}
+
+						conn.Close()
+					}
+				}(g)
+			}
+
+			wg.Wait()
+
+			for idx, counter := range counters {
+				conns := atomic.LoadUint64(&counter.conns)
+				expected := uint64(math.Round(tc.shares[idx] * total))
+				share := float64(conns) / total
+
+				if tc.tolerance == 0 && conns != expected {
+					t.Errorf(
+						"unexpected number of connections: client=%d conns=%d expected=%d",
+						idx,
+						conns,
+						expected,
+					)
+				} else if math.Abs(share-tc.shares[idx]) > tc.tolerance {
+					t.Errorf(
+						"unfair share of connections: client=%d share=%.4f expected=%.4f",
+						idx,
+						share,
+						tc.shares[idx],
+					)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dotproxy/internal/data"
+	"dotproxy/internal/dns"
+)
+
+// ResponseCache is an in-memory cache of upstream responses. Responses are keyed on their question
+// and the request options that influence the content of the response, and expire according to the
+// TTLs of the records they contain. Negative responses are cached per RFC 2308.
+type ResponseCache struct {
+	store *data.LRUCache
+	opts  ResponseCacheOpts
+
+	// Keys of the responses currently being refreshed in the background.
+	refreshing      map[string]bool
+	refreshingMutex sync.Mutex
+}
+
+// ResponseCacheOpts formalizes configuration options for the response cache.
+type ResponseCacheOpts struct {
+	// MaxSize is the approximate maximum amount of memory, in bytes, that cached responses may
+	// occupy. The least recently used responses are evicted to remain within this limit.
+	MaxSize int
+	// MaxTTL caps the duration for which any single response may be cached, regardless of the
+	// TTLs of the records it contains.
+	MaxTTL time.Duration
+	// MaxNegativeTTL caps the duration for which any single negative response may be cached.
+	MaxNegativeTTL time.Duration
+	// StaleWindow is the duration of time past expiry for which a response is retained, so that
+	// it may be served stale if the upstream fails to provide a fresh response, per RFC 8767.
+	// Serving stale responses is disabled if unset.
+	StaleWindow time.Duration
+	// StaleTTL is the TTL with which stale responses are served.
+	StaleTTL time.Duration
+	// PrefetchThreshold is the fraction of a response's original TTL below which its remaining
+	// TTL must fall for it to be prefetched when served. Prefetching is disabled if unset.
+	PrefetchThreshold float64
+	// PrefetchMinHits is the minimum number of times a response must have been served from the
+	// cache for it to be eligible for prefetching.
+	PrefetchMinHits int
+}
+
+// cacheEntry describes a single cached response.
+type cacheEntry struct {
+	resp   *dns.Message
+	stored time.Time
+	ttl    time.Duration
+	hits   int64
+}
+
+const (
+	// cacheEntryOverhead is a rough estimate of the memory consumed by each cache entry, in
+	// bytes, in addition to the size of the cached response itself.
+	cacheEntryOverhead = 256
+)
+
+// NewResponseCache creates a response cache with the specified options.
+func NewResponseCache(opts ResponseCacheOpts) *ResponseCache {
+	// Sane option defaults
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 16 * 1024 * 1024
+	}
+
+	if opts.MaxNegativeTTL <= 0 {
+		// RFC 2308 section 5 suggests a maximum of between one and three hours.
+		opts.MaxNegativeTTL = 3 * time.Hour
+	}
+
+	if opts.StaleTTL <= 0 {
+		// RFC 8767 section 4 recommends 30 seconds.
+		opts.StaleTTL = 30 * time.Second
+	}
+
+	return &ResponseCache{
+		store:      data.NewLRUCache(opts.MaxSize),
+		opts:       opts,
+		refreshing: make(map[string]bool),
+	}
+}
+
+// Get retrieves a cached response to the request, if one exists and has not expired. The returned
+// response is addressed to the request's message ID and carries TTLs decremented by the time the
+// response has spent in the cache. It additionally returns whether the response is popular and
+// close enough to expiry that it should be prefetched from the upstream.
+func (c *ResponseCache) Get(req *dns.Message) ([]byte, bool, bool) {
+	entry, ok := c.lookup(req)
+	if !ok {
+		return nil, false, false
+	}
+
+	age := time.Since(entry.stored)
+	if age >= entry.ttl {
+		return nil, false, false
+	}
+
+	hits := atomic.AddInt64(&entry.hits, 1)
+	prefetch := c.opts.PrefetchThreshold > 0 &&
+		hits >= int64(c.opts.PrefetchMinHits) &&
+		float64(entry.ttl-age) < c.opts.PrefetchThreshold*float64(entry.ttl)
+
+	elapsed := uint32(age / time.Second)
+
+	return entry.respond(req, func(ttl uint32) uint32 {
+		if ttl < elapsed {
+			return 0
+		}
+
+		return ttl - elapsed
+	}), prefetch, true
+}
+
+// GetStale retrieves a cached response to the request that has expired, but remains within the
+// stale window. The returned response is addressed to the request's message ID and carries the
+// stale TTL.
+func (c *ResponseCache) GetStale(req *dns.Message) ([]byte, bool) {
+	if c.opts.StaleWindow <= 0 {
+		return nil, false
+	}
+
+	entry, ok := c.lookup(req)
+	if !ok || time.Since(entry.stored) >= entry.ttl+c.opts.StaleWindow {
+		return nil, false
+	}
+
+	staleTTL := uint32(c.opts.StaleTTL / time.Second)
+
+	return entry.respond(req, func(ttl uint32) uint32 {
+		return staleTTL
+	}), true
+}
+
+// Set caches an upstream response to the request, if the response is cacheable.
+func (c *ResponseCache) Set(req *dns.Message, resp []byte) {
+	key, ok := cacheKey(req)
+	if !ok {
+		return
+	}
+
+	// Retain a private copy of the response, since the caller's buffer may be reused.
+	msg, err := dns.Parse(append([]byte(nil), resp...))
+	if err != nil {
+		return
+	}
+
+	ttl, ok := c.ttl(msg)
+	if !ok || ttl <= 0 {
+		return
+	}
+
+	c.store.Set(key, &cacheEntry{
+		resp:   msg,
+		stored: time.Now(),
+		ttl:    ttl,
+	}, len(resp)+len(key)+cacheEntryOverhead)
+}
+
+// lookup retrieves the cache entry for the request, regardless of its expiry.
+func (c *ResponseCache) lookup(req *dns.Message) (*cacheEntry, bool) {
+	key, ok := cacheKey(req)
+	if !ok {
+		return nil, false
+	}
+
+	value, ok := c.store.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	return value.(*cacheEntry), true
+}
+
+// startRefresh marks the response to the request as being refreshed. It returns false if a refresh
+// is already in progress, in which case the caller should not start another.
+func (c *ResponseCache) startRefresh(req *dns.Message) bool {
+	key, ok := cacheKey(req)
+	if !ok {
+		return false
+	}
+
+	c.refreshingMutex.Lock()
+	defer c.refreshingMutex.Unlock()
+
+	if c.refreshing[key] {
+		return false
+	}
+
+	c.refreshing[key] = true
+
+	return true
+}
+
+// finishRefresh marks the refresh of the response to the request as complete.
+func (c *ResponseCache) finishRefresh(req *dns.Message) {
+	key, _ := cacheKey(req)
+
+	c.refreshingMutex.Lock()
+	defer c.refreshingMutex.Unlock()
+
+	delete(c.refreshing, key)
+}
+
+// ttl determines the duration for which a response may be cached. It returns false if the response
+// is not cacheable.
+func (c *ResponseCache) ttl(resp *dns.Message) (time.Duration, bool) {
+	if !resp.Header.Response() || resp.Header.Truncated() {
+		return 0, false
+	}
+
+	var ttl uint32
+	var ok bool
+	var max time.Duration
+
+	switch {
+	case resp.Header.Rcode() == dns.RcodeSuccess && resp.Header.ANCount > 0:
+		ttl, ok = resp.MinTTL()
+		max = c.opts.MaxTTL
+	case resp.Header.Rcode() == dns.RcodeSuccess || resp.Header.Rcode() == dns.RcodeNameError:
+		// NODATA and NXDOMAIN responses are negative responses, which may only be cached
+		// if they contain an SOA record from which to derive their TTL.
+		ttl, ok = resp.NegativeTTL()
+		max = c.opts.MaxNegativeTTL
+	}
+
+	if !ok {
+		return 0, false
+	}
+
+	duration := time.Duration(ttl) * time.Second
+	if max > 0 && duration > max {
+		duration = max
+	}
+
+	return duration, true
+}
+
+// respond creates a response to the request from the cache entry, with TTLs rewritten by the
+// specified function.
+func (e *cacheEntry) respond(req *dns.Message, rewrite func(ttl uint32) uint32) []byte {
+	resp := e.resp.RewriteTTLs(rewrite)
+
+	dns.SetID(resp, req.Header.ID)
+
+	// Echo the request's question verbatim, preserving its original letter case for clients
+	// that rely on randomized case as a defense against spoofing. The question is only echoed if
+	// it differs from the cached one in letter case alone.
+	if reqQuestion := req.QuestionSection(); len(reqQuestion) == len(e.resp.QuestionSection()) &&
+		sameQuestion(req, e.resp) {
+		copy(resp[dns.HeaderSize:], reqQuestion)
+	}
+
+	return resp
+}
+
+// sameQuestion returns whether two messages carry a single question for the same name, type, and
+// class, disregarding the letter case of the name.
+func sameQuestion(a *dns.Message, b *dns.Message) bool {
+	if len(a.Question) != 1 || len(b.Question) != 1 {
+		return false
+	}
+
+	qa, qb := a.Question[0], b.Question[0]
+
+	return dns.CanonicalName(qa.Name) == dns.CanonicalName(qb.Name) &&
+		qa.Type == qb.Type &&
+		qa.Class == qb.Class
+}
+
+// cacheKey creates a cache key for the request from its question, the presence of an EDNS(0)
+// pseudo-record, and the DO and CD bits, which influence the content of the response. Responses to
+// requests with EDNS(0) carry an OPT record of their own, which must not be served to clients that
+// do not support EDNS(0), per RFC 6891 section 7. It returns false if the request is not
+// cacheable.
+func cacheKey(req *dns.Message) (string, bool) {
+	if req.Header.Response() || req.Header.Opcode() != 0 || len(req.Question) != 1 {
+		return "", false
+	}
+
+	q := req.Question[0]
+	_, edns := req.OPT()
+
+	return fmt.Sprintf(
+		"%s/%d/%d/%t/%t/%t",
+		dns.CanonicalName(q.Name),
+		q.Type,
+		q.Class,
+		edns,
+		req.DNSSECOK(),
+		req.Header.CheckingDisabled(),
+	), true
+}
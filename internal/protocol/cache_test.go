@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"dotproxy/internal/dns"
+)
+
+// cacheTestRequest creates a parsed query for the name, optionally with an EDNS(0) pseudo-record
+// that has the DO bit set as specified.
+func cacheTestRequest(t *testing.T, id uint16, name string, edns bool, do bool) *dns.Message {
+	req, err := dns.NewQuery(id, name, dns.TypeA)
+	if err != nil {
+		t.Fatalf("error creating query: %v", err)
+	}
+
+	if edns {
+		var ttl uint32
+		if do {
+			ttl = 0x8000
+		}
+
+		opt := make([]byte, 11)
+		binary.BigEndian.PutUint16(opt[1:3], dns.TypeOPT)
+		binary.BigEndian.PutUint16(opt[3:5], 4096)
+		binary.BigEndian.PutUint32(opt[5:9], ttl)
+
+		req = append(req, opt...)
+		binary.BigEndian.PutUint16(req[10:12], 1)
+	}
+
+	msg, err := dns.Parse(req)
+	if err != nil {
+		t.Fatalf("error parsing query: %v", err)
+	}
+
+	return msg
+}
+
+// cacheTestResponse creates a parsed response to a query for the name, carrying a single A record
+// with the specified TTL.
+func cacheTestResponse(t *testing.T, id uint16, name string, ttl uint32) *dns.Message {
+	resp, err := dns.NewQuery(id, name, dns.TypeA)
+	if err != nil {
+		t.Fatalf("error creating query: %v", err)
+	}
+
+	resp[2] |= 0x80
+	binary.BigEndian.PutUint16(resp[6:8], 1)
+
+	// The answer refers to the question name by a pointer.
+	answer := []byte{0xc0, dns.HeaderSize, 0, 1, 0, 1, 0, 0, 0, 0, 0, 4, 192, 0, 2, 1}
+	binary.BigEndian.PutUint32(answer[6:10], ttl)
+
+	msg, err := dns.Parse(append(resp, answer...))
+	if err != nil {
+		t.Fatalf("error parsing response: %v", err)
+	}
+
+	return msg
+}
+
+func TestCacheKey(t *testing.T) {
+	base := cacheTestRequest(t, 1, "www.google.com.", false, false)
+
+	baseKey, ok := cacheKey(base)
+	if !ok {
+		t.Fatal("expected query to be cacheable")
+	}
+
+	cases := []struct {
+		name string
+		req  *dns.Message
+		// Whether the request shares the base request's key
+		same bool
+	}{
+		{"different id", cacheTestRequest(t, 2, "www.google.com.", false, false), true},
+		{"different case", cacheTestRequest(t, 1, "WWW.GoOgLe.CoM.", false, false), true},
+		{"escaped dot", cacheTestRequest(t, 1, `www\.google.com.`, false, false), false},
+		{"escaped dots", cacheTestRequest(t, 1, `www\.google\.com.`, false, false), false},
+		{"different name", cacheTestRequest(t, 1, "www.google.org.", false, false), false},
+		{"edns", cacheTestRequest(t, 1, "www.google.com.", true, false), false},
+		{"dnssec ok", cacheTestRequest(t, 1, "www.google.com.", true, true), false},
+	}
+
+	for _, tc := range cases {
+		key, ok := cacheKey(tc.req)
+		if !ok {
+			t.Errorf("expected query to be cacheable: case=%s", tc.name)
+			continue
+		}
+
+		if (key == baseKey) != tc.same {
+			t.Errorf("unexpected cache key: case=%s key=%s base=%s", tc.name, key, baseKey)
+		}
+	}
+
+	// Responses and queries with multiple questions are not cacheable.
+	resp := cacheTestResponse(t, 1, "www.google.com.", 300)
+	if _, ok := cacheKey(resp); ok {
+		t.Error("expected response not to be cacheable")
+	}
+
+	multi := append([]byte(nil), base.Raw()...)
+	multi = append(multi, base.QuestionSection()...)
+	binary.BigEndian.PutUint16(multi[4:6], 2)
+
+	if msg, err := dns.Parse(multi); err != nil {
+		t.Errorf("error parsing query: %v", err)
+	} else if _, ok := cacheKey(msg); ok {
+		t.Error("expected query with multiple questions not to be cacheable")
+	}
+}
+
+func TestCacheEntryRespond(t *testing.T) {
+	entry := &cacheEntry{resp: cacheTestResponse(t, 1, "www.google.com.", 300)}
+	halve := func(ttl uint32) uint32 { return ttl / 2 }
+
+	cases := []struct {
+		name string
+		req  *dns.Message
+		// Question name expected in the response
+		expected string
+	}{
+		{"same case", cacheTestRequest(t, 2, "www.google.com.", false, false), "www.google.com."},
+		{"randomized case", cacheTestRequest(t, 3, "wWw.GOOgle.cOm.", false, false), "wWw.GOOgle.cOm."},
+		{"colliding name", cacheTestRequest(t, 4, `www\.google.com.`, false, false), "www.google.com."},
+		{"different name", cacheTestRequest(t, 5, "www.google.org.", false, false), "www.google.com."},
+	}
+
+	for _, tc := range cases {
+		msg, err := dns.Parse(entry.respond(tc.req, halve))
+		if err != nil {
+			t.Errorf("error parsing response: case=%s err=%v", tc.name, err)
+			continue
+		}
+
+		if msg.Header.ID != tc.req.Header.ID {
+			t.Errorf("unexpected message ID: case=%s id=%d", tc.name, msg.Header.ID)
+		}
+
+		if msg.Question[0].Name != tc.expected {
+			t.Errorf("unexpected question name: case=%s name=%s", tc.name, msg.Question[0].Name)
+		}
+
+		if ttl, _ := msg.MinTTL(); ttl != 150 {
+			t.Errorf("unexpected TTL: case=%s ttl=%d", tc.name, ttl)
+		}
+	}
+
+	// The cached response itself is not modified.
+	raw := entry.resp.Raw()
+	if binary.BigEndian.Uint16(raw) != 1 || !bytes.Contains(raw, []byte("\x03www\x06google\x03com\x00")) {
+		t.Error("cached response was modified")
+	}
+}
@@ -1,40 +1,69 @@
+//go:generate go run golang.org/x/tools/cmd/stringer -type=FailureResponse -linecomment=true
+
 package protocol
 
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/getsentry/raven-go"
 	"lib.kevinlin.info/aperture/lib"
 
+	"dotproxy/internal/dns"
 	"dotproxy/internal/log"
 	"dotproxy/internal/metrics"
 	"dotproxy/internal/network"
 )
 
 // DNSProxyHandler is a semi-DNS-protocol-aware server handler that proxies requests between a
-// client and upstream server.
+// client and upstream server. If a routing table is configured, requests are proxied to the
+// upstream it selects for the query name; otherwise, and for requests that cannot be parsed, they
+// are proxied to the default upstream.
 type DNSProxyHandler struct {
 	Upstream         network.Client
 	ClientCxIOHook   metrics.ConnectionIOHook
 	UpstreamCxIOHook metrics.ConnectionIOHook
 	ProxyHook        metrics.ProxyHook
+	Cache            *ResponseCache
+	Routes           *RoutingTable
+	Hedge            *HedgePolicy
+	Retry            *RetryPolicy
 	Logger           log.Logger
 	Opts             DNSProxyOpts
 }
 
+// FailureResponse describes how the proxy responds to a client when it fails to obtain a response
+// to its request from the upstream.
+type FailureResponse int
+
 // DNSProxyOpts formalizes configuration options for the proxy handler.
 type DNSProxyOpts struct {
-	// MaxUpstreamRetries describes the maximum allowable times the proxy server is permitted to
-	// retry a request with the upstream server(s). It is recommended to set this to a liberal
-	// value above 0; since connections are pooled and persisted over a long period of time, it
-	// is highly likely that any single proxy request will fail (due to a server-side closed
-	// connection) and will need to be retried with another connection in the pool.
-	MaxUpstreamRetries int
+	// StaleClientTimeout is the maximum amount of time to wait for a fresh upstream response
+	// before serving a stale response from the cache instead, if one is available. The
+	// upstream request continues in the background, refreshing the cache when it completes.
+	// If unset, stale responses are served only if the upstream request fails.
+	StaleClientTimeout time.Duration
+	// FailureResponse controls the response sent to the client when the upstream request
+	// fails.
+	FailureResponse FailureResponse
 }
 
+const (
+	// FailureServFail responds with a SERVFAIL, allowing the client to fail fast or retry with
+	// another server.
+	FailureServFail FailureResponse = iota // SERVFAIL
+	// FailureRefused responds with a REFUSED.
+	FailureRefused // REFUSED
+	// FailureSilent sends no response, leaving the client to wait for its own timeout.
+	FailureSilent // SILENT
+)
+
 // ConsumeError simply logs the proxy error.
 func (h *DNSProxyHandler) ConsumeError(ctx context.Context, err error) {
 	h.Logger.Error("%v", err)
@@ -53,7 +82,7 @@ func (h *DNSProxyHandler) Handle(ctx context.Context, clientConn net.Conn) error
 
 	/* Read the DNS request from the client */
 
-	clientReq, err := h.clientRead(clientConn)
+	clientReq, err := h.clientRead(ctx, clientConn)
 	if err != nil {
 		return err
 	}
@@ -78,26 +107,25 @@ func (h *DNSProxyHandler) Handle(ctx context.Context, clientConn net.Conn) error
 		clientReq = append(clientHeader, clientReq...)
 	}
 
-	/* Open a (possibly cached) connection to the upstream and perform a W/R transaction */
+	/* Serve the request from the cache or the upstream */
 
-	maxRetries := h.Opts.MaxUpstreamRetries
-	if maxRetries <= 0 {
-		maxRetries = 16
-	}
+	req := h.parseRequest(clientReq)
 
-	upstreamResp, upstreamConn, err := h.proxyUpstream(clientConn, clientReq, maxRetries)
+	resp, upstreamAddr, err := h.resolve(ctx, clientConn, req, clientReq)
 	if err != nil {
+		h.respondFailure(ctx, clientConn, clientReq)
 		return err
 	}
 
-	// Omit the response's size header if the client initially requested a UDP transport
+	// Omit the response's size header if the client initially requested a UDP transport, and
+	// ensure that the response fits in a single datagram the client is able to receive.
 	if ctx.Value(network.TransportContextKey) == network.UDP {
-		upstreamResp = upstreamResp[2:]
+		resp = h.truncateUDP(req, clientReq, resp[2:])
 	}
 
 	/* Write the proxied result back to the client */
 
-	if err := h.clientWrite(clientConn, upstreamResp); err != nil {
+	if err := h.clientWrite(clientConn, resp); err != nil {
 		return err
 	}
 
@@ -109,24 +137,155 @@ func (h *DNSProxyHandler) Handle(ctx context.Context, clientConn net.Conn) error
 
 	/* Clean up and report end-to-end metrics */
 
-	h.ProxyHook.EmitProcess(clientConn.RemoteAddr(), upstreamConn.RemoteAddr())
+	// The upstream address is nil if the request was served from the cache.
+	h.ProxyHook.EmitProcess(clientConn.RemoteAddr(), upstreamAddr)
 	h.ProxyHook.EmitRequestSize(int64(len(clientReq)), clientConn.RemoteAddr())
-	h.ProxyHook.EmitResponseSize(int64(len(upstreamResp)), upstreamConn.RemoteAddr())
+	h.ProxyHook.EmitResponseSize(int64(len(resp)), upstreamAddr)
 	h.ProxyHook.EmitRTT(
 		rttTxTimer.Elapsed(),
 		clientConn.RemoteAddr(),
-		upstreamConn.RemoteAddr(),
+		upstreamAddr,
 	)
 
 	return nil
 }
 
-// clientRead reads a request from the client.
-func (h *DNSProxyHandler) clientRead(conn net.Conn) ([]byte, error) {
+// resolve produces a length-prefixed response to the client request: from the response cache if
+// possible, and otherwise from the upstream. If the upstream fails or is too slow, a stale response
+// from the cache is served instead, if available. The returned upstream address is nil if the
+// response did not come from the upstream.
+func (h *DNSProxyHandler) resolve(ctx context.Context, client net.Conn, req *dns.Message, clientReq []byte) ([]byte, net.Addr, error) {
+	if resp, ok := h.cacheGet(client, req, clientReq); ok {
+		return resp, nil, nil
+	}
+
+	stale, ok := h.cacheGetStale(req)
+	if !ok {
+		ctx, cancel := h.retryPolicy().Context(ctx)
+		defer cancel()
+
+		resp, upstreamConn, err := h.proxyUpstreamHedged(ctx, client, req, clientReq)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		h.cacheSet(req, resp)
+
+		return resp, upstreamConn.RemoteAddr(), nil
+	}
+
+	// A stale response is available as a fallback; race the upstream against the client-facing
+	// deadline. The upstream request is detached from the client request and is not abandoned if
+	// the deadline expires or the client goes away, so that it can still refresh the cache.
+	type result struct {
+		resp []byte
+		addr net.Addr
+		err  error
+	}
+
+	results := make(chan result, 1)
+
+	go func() {
+		ctx, cancel := h.retryPolicy().Context(context.Background())
+		defer cancel()
+
+		resp, upstreamConn, err := h.proxyUpstreamHedged(ctx, client, req, clientReq)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+
+		h.cacheSet(req, resp)
+		results <- result{resp: resp, addr: upstreamConn.RemoteAddr()}
+	}()
+
+	var timeout <-chan time.Time
+	if h.Opts.StaleClientTimeout > 0 {
+		timer := time.NewTimer(h.Opts.StaleClientTimeout)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case r := <-results:
+		if r.err == nil {
+			return r.resp, r.addr, nil
+		}
+
+		h.Logger.Warn("dns_proxy: upstream failed; serving stale response: err=%v", r.err)
+		h.refresh(client, req, clientReq)
+	case <-timeout:
+		h.Logger.Debug(
+			"dns_proxy: upstream exceeded client deadline; serving stale response: timeout=%v",
+			h.Opts.StaleClientTimeout,
+		)
+	}
+
+	h.ProxyHook.EmitCacheStale(client.RemoteAddr())
+
+	return stale, nil, nil
+}
+
+// refresh asynchronously resolves the client request with the upstream and caches the response,
+// unless a refresh of the same request is already in progress. It returns whether a refresh was
+// started.
+func (h *DNSProxyHandler) refresh(client net.Conn, req *dns.Message, clientReq []byte) bool {
+	if h.Cache == nil || req == nil || !h.Cache.startRefresh(req) {
+		return false
+	}
+
+	go func() {
+		defer h.Cache.finishRefresh(req)
+
+		// The refresh is detached from the client request, which may complete first.
+		ctx, cancel := h.retryPolicy().Context(context.Background())
+		defer cancel()
+
+		resp, _, err := h.proxyUpstream(ctx, client, req, clientReq, newUpstreamSet())
+		if err != nil {
+			h.Logger.Debug("dns_proxy: failed to refresh cached response: err=%v", err)
+			return
+		}
+
+		h.cacheSet(req, resp)
+	}()
+
+	return true
+}
+
+// retryPolicy returns the policy for retrying failed upstream transactions, or a default policy if
+// none is configured.
+func (h *DNSProxyHandler) retryPolicy() *RetryPolicy {
+	if h.Retry == nil {
+		return defaultRetryPolicy
+	}
+
+	return h.Retry
+}
+
+// clientRead reads a request from the client. Requests on stream transports are read as a single
+// length-prefixed frame, which is returned with its length header intact.
+func (h *DNSProxyHandler) clientRead(ctx context.Context, conn net.Conn) ([]byte, error) {
 	clientReadTimer := lib.NewStopwatch()
-	clientReq := make([]byte, 1024) // The DNS protocol limits the maximum size of a DNS packet.
 
-	clientReadBytes, err := conn.Read(clientReq)
+	var clientReq []byte
+	var err error
+
+	if ctx.Value(network.TransportContextKey) == network.UDP {
+		// A UDP request is always delivered in a single datagram, which may be no larger
+		// than the maximum DNS message size.
+		clientReq = make([]byte, network.MaxMessageSize)
+
+		var clientReadBytes int
+		clientReadBytes, err = conn.Read(clientReq)
+
+		// Trim the request buffer to only what the server was able to read
+		clientReq = clientReq[:clientReadBytes]
+	} else {
+		clientReq, err = network.NewFramedReader(conn, network.MaxMessageSize).ReadFrame()
+	}
+
 	if err != nil {
 		h.ClientCxIOHook.EmitReadError(conn.RemoteAddr())
 		return nil, fmt.Errorf("dns_proxy: error reading request from client: err=%v", err)
@@ -134,23 +293,33 @@ func (h *DNSProxyHandler) clientRead(conn net.Conn) ([]byte, error) {
 
 	h.ClientCxIOHook.EmitRead(clientReadTimer.Elapsed(), conn.RemoteAddr())
 
-	// Trim the request buffer to only what the server was able to read
-	return clientReq[:clientReadBytes], nil
+	return clientReq, nil
 }
 
 // upstreamTransact performs a write-read transaction with the upstream connection and returns the
-// upstream response.
-func (h *DNSProxyHandler) upstreamTransact(client net.Conn, upstream *network.PersistentConn, clientReq []byte) ([]byte, error) {
+// upstream response. The duration and outcome of the transaction are reported to the upstream
+// client, unless the transaction fails because the request is cancelled.
+func (h *DNSProxyHandler) upstreamTransact(ctx context.Context, client net.Conn, upstream *network.PersistentConn, clientReq []byte) (resp []byte, err error) {
 	upstreamTxTimer := lib.NewStopwatch()
 
+	defer func() {
+		if err == nil || !errors.Is(ctx.Err(), context.Canceled) {
+			upstream.Observe(upstreamTxTimer.Elapsed(), err == nil)
+		}
+	}()
+
 	/* Proxy the client request to the upstream */
 
 	upstreamWriteTimer := lib.NewStopwatch()
 
 	upstreamWriteBytes, err := upstream.Write(clientReq)
-	if err != nil || upstreamWriteBytes != len(clientReq) {
+	if err == nil && upstreamWriteBytes != len(clientReq) {
+		err = io.ErrShortWrite
+	}
+
+	if err != nil {
 		h.UpstreamCxIOHook.EmitWriteError(upstream.RemoteAddr())
-		return nil, fmt.Errorf("dns_proxy: error writing to upstream: err=%v", err)
+		return nil, fmt.Errorf("dns_proxy: error writing to upstream: err=%w", err)
 	}
 
 	h.UpstreamCxIOHook.EmitWrite(upstreamWriteTimer.Elapsed(), upstream.RemoteAddr())
@@ -162,29 +331,30 @@ func (h *DNSProxyHandler) upstreamTransact(client net.Conn, upstream *network.Pe
 	upstreamReadTimer := lib.NewStopwatch()
 
 	// By RFC specification, the server response follows the same format as the TCP request: the
-	// first two bytes specify the length of the message.
+	// first two bytes specify the length of the message. Stream transports may deliver either
+	// part of the response across several reads, so each is read in full.
 	upstreamHeader := make([]byte, 2)
-	upstreamHeaderBytes, err := upstream.Read(upstreamHeader)
-	if err != nil || upstreamHeaderBytes != 2 {
+	upstreamHeaderBytes, err := io.ReadFull(upstream, upstreamHeader)
+	if err != nil {
 		h.UpstreamCxIOHook.EmitReadError(upstream.RemoteAddr())
 		return nil, fmt.Errorf(
-			"dns_proxy: error reading header from upstream: err=%v bytes=%d",
+			"dns_proxy: error reading header from upstream: err=%w bytes=%d",
 			err,
 			upstreamHeaderBytes,
 		)
 	}
 
-	// Parse the alleged size of the remaining response and perform another exactly-sized read.
+	// Parse the alleged size of the remaining response and read exactly that many bytes.
 	respSize := binary.BigEndian.Uint16(upstreamHeader)
 	upstreamResp := make([]byte, respSize)
 
 	h.Logger.Debug("dns_proxy: read upstream header: response_size=%d", respSize)
 
-	upstreamReadBytes, err := upstream.Read(upstreamResp)
-	if err != nil || upstreamReadBytes != int(respSize) {
+	upstreamReadBytes, err := io.ReadFull(upstream, upstreamResp)
+	if err != nil {
 		h.UpstreamCxIOHook.EmitReadError(upstream.RemoteAddr())
 		return nil, fmt.Errorf(
-			"dns_proxy: error reading full response from upstream: err=%v bytes=%d",
+			"dns_proxy: error reading full response from upstream: err=%w bytes=%d",
 			err,
 			upstreamReadBytes,
 		)
@@ -199,50 +369,401 @@ func (h *DNSProxyHandler) upstreamTransact(client net.Conn, upstream *network.Pe
 		upstream.RemoteAddr(),
 	)
 
+	if h.Hedge != nil {
+		h.Hedge.Observe(upstreamTxTimer.Elapsed())
+	}
+
 	return append(upstreamHeader, upstreamResp...), nil
 }
 
-// proxyUpstream opens an upstream connection and performs a write-read transaction with a client
-// request, wrapping retry logic. It returns the upstream response, the upstream connection, and
-// optionally an error.
-func (h *DNSProxyHandler) proxyUpstream(client net.Conn, clientReq []byte, retries int) ([]byte, net.Conn, error) {
-	upstream, err := h.Upstream.Conn()
-	if err != nil {
-		return nil, nil, fmt.Errorf(
-			"dns_proxy: error opening upstream connection: err=%v",
+// proxyUpstreamHedged proxies a client request to the upstream like proxyUpstream. If hedging is
+// enabled and the upstream does not respond within the hedge delay, the request is also sent to a
+// second upstream selected by the load balancing policy. The first successful response is returned,
+// and the other request is cancelled. A SERVFAIL response is only returned once the other request
+// has also completed, in case the other upstream is able to answer.
+func (h *DNSProxyHandler) proxyUpstreamHedged(ctx context.Context, client net.Conn, req *dns.Message, clientReq []byte) ([]byte, net.Conn, error) {
+	// The upstreams tried by either request are excluded from the other's selection, so that the
+	// hedged request is not sent to the upstream that is already slow.
+	tried := newUpstreamSet()
+
+	if h.Hedge == nil {
+		return h.proxyUpstream(ctx, client, req, clientReq, tried)
+	}
+
+	delay, ok := h.Hedge.Delay()
+	if !ok {
+		return h.proxyUpstream(ctx, client, req, clientReq, tried)
+	}
+
+	type result struct {
+		resp  []byte
+		conn  net.Conn
+		err   error
+		hedge bool
+	}
+
+	results := make(chan result, 2)
+
+	// The request that loses the race is cancelled when this function returns.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	send := func(hedge bool) {
+		go func() {
+			resp, conn, err := h.proxyUpstream(ctx, client, req, clientReq, tried)
+			results <- result{resp, conn, err, hedge}
+		}()
+	}
+
+	send(false)
+	hedged := false
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var err error
+
+	// A SERVFAIL response received while the other request is in flight, returned only if the
+	// other request does not produce a better response.
+	var fallback *result
+
+	for pending := 1; pending > 0; {
+		select {
+		case <-timer.C:
+			h.Logger.Debug("dns_proxy: upstream exceeded hedge delay; hedging: delay=%v", delay)
+
+			send(true)
+			hedged = true
+			pending++
+
+		case r := <-results:
+			pending--
+
+			if r.err != nil {
+				err = r.err
+				continue
+			}
+
+			if pending > 0 && serverFailure(r.resp) {
+				h.Logger.Debug("dns_proxy: upstream responded with SERVFAIL; awaiting hedged request")
+
+				fallback = &r
+				continue
+			}
+
+			if hedged {
+				h.ProxyHook.EmitHedge(r.hedge, client.RemoteAddr())
+			}
+
+			return r.resp, r.conn, nil
+		}
+	}
+
+	if fallback != nil {
+		h.ProxyHook.EmitHedge(fallback.hedge, client.RemoteAddr())
+
+		return fallback.resp, fallback.conn, nil
+	}
+
+	if hedged {
+		h.ProxyHook.EmitHedge(false, client.RemoteAddr())
+	}
+
+	return nil, nil, err
+}
+
+// serverFailure returns whether a length-prefixed upstream response carries a SERVFAIL response
+// code.
+func serverFailure(resp []byte) bool {
+	if len(resp) < 2 {
+		return false
+	}
+
+	header, err := dns.ParseHeader(resp[2:])
+
+	return err == nil && header.Rcode() == dns.RcodeServerFailure
+}
+
+// proxyUpstream proxies a client request to the upstream, retrying failed attempts according to the
+// retry policy, each with an upstream that has not yet been tried if possible. It returns the
+// upstream response, the upstream connection, and optionally an error. The request is abandoned
+// once the context is done.
+func (h *DNSProxyHandler) proxyUpstream(ctx context.Context, client net.Conn, req *dns.Message, clientReq []byte, tried *upstreamSet) ([]byte, net.Conn, error) {
+	policy := h.retryPolicy()
+
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			if err := policy.wait(ctx, retry); err != nil {
+				return nil, nil, fmt.Errorf("dns_proxy: upstream request abandoned: err=%w", err)
+			}
+		}
+
+		resp, upstream, err := h.proxyUpstreamAttempt(ctx, client, req, clientReq, tried)
+		if err == nil {
+			h.Logger.Debug("dns_proxy: completed upstream proxy: response_bytes=%d", len(resp))
+
+			return resp, upstream, nil
+		}
+
+		if ctx.Err() != nil || !policy.Retryable(err) {
+			h.Logger.Debug("dns_proxy: upstream request failed; not retrying: err=%v", err)
+
+			return nil, nil, err
+		}
+
+		if retry >= policy.maxRetries {
+			h.Logger.Debug("dns_proxy: upstream request failed; available retries exhausted")
+
+			return nil, nil, err
+		}
+
+		var upstreamAddr net.Addr
+		if upstream != nil {
+			upstreamAddr = upstream.RemoteAddr()
+		}
+
+		h.UpstreamCxIOHook.EmitRetry(upstreamAddr)
+		h.Logger.Debug(
+			"dns_proxy: upstream request failed; retrying: retry=%d err=%v",
+			retry+1,
 			err,
 		)
 	}
+}
+
+// proxyUpstreamAttempt opens an upstream connection, preferring an upstream that is not in the
+// set of those already tried, and performs a single write-read transaction with a client request.
+// The upstream is added to the set of those tried. The connection is returned even if the
+// transaction fails, but it is no longer usable.
+func (h *DNSProxyHandler) proxyUpstreamAttempt(ctx context.Context, client net.Conn, req *dns.Message, clientReq []byte, tried *upstreamSet) ([]byte, net.Conn, error) {
+	var upstream *network.PersistentConn
+	var err error
+
+	for i := 0; i < retryDistinctUpstreamAttempts; i++ {
+		// Connections to upstreams that have already been tried are released unused. Since no
+		// transaction is observed on them, they count toward neither the latency nor the error
+		// rate of their upstream.
+		if upstream != nil {
+			go upstream.Close()
+		}
+
+		if upstream, err = h.upstreamConn(ctx, req); err != nil {
+			return nil, nil, fmt.Errorf("dns_proxy: %w: err=%v", errUpstreamConn, err)
+		}
+
+		if tried.add(upstream.RemoteAddr().String()) {
+			break
+		}
+	}
 
 	h.Logger.Debug("dns_proxy: created upstream connection: conn=%v", upstream)
 
-	resp, err := h.upstreamTransact(client, upstream, clientReq)
-	if err != nil {
-		// No matter the retry budget, destroy the connection if it fails during I/O
-		go upstream.Destroy()
+	// Abort the transaction by destroying its connection if the context is done while it is in
+	// flight. A transaction that outlives the request deadline is reported as failed before its
+	// connection is destroyed, so that the failure is not mistaken for an abandoned transaction.
+	done := make(chan struct{})
+	upstreamTxTimer := lib.NewStopwatch()
 
-		if retries > 0 {
-			h.UpstreamCxIOHook.EmitRetry(upstream.RemoteAddr())
-			h.Logger.Debug(
-				"dns_proxy: upstream I/O failed; retrying: retry=%d",
-				retries,
-			)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				upstream.Observe(upstreamTxTimer.Elapsed(), false)
+			}
 
-			return h.proxyUpstream(client, clientReq, retries-1)
+			upstream.Destroy()
+		case <-done:
 		}
+	}()
+
+	resp, err := h.upstreamTransact(ctx, client, upstream, clientReq)
+	close(done)
+
+	if err != nil {
+		// Destroy the connection if it fails during I/O, since its state is unknown.
+		go upstream.Destroy()
 
-		h.Logger.Debug("dns_proxy: upstream I/O failed; available retries exhausted")
+		if ctx.Err() != nil {
+			return nil, upstream, fmt.Errorf("dns_proxy: upstream request abandoned: err=%w", ctx.Err())
+		}
 
-		return nil, nil, err
+		return nil, upstream, err
 	}
 
 	// Upstream transaction succeeded; schedule the connection for reinsertion into the
 	// long-lived connection pool
 	go upstream.Close()
 
-	h.Logger.Debug("dns_proxy: completed upstream proxy: response_bytes=%d", len(resp))
+	return resp, upstream, nil
+}
+
+// route selects the upstream client for the request.
+func (h *DNSProxyHandler) route(req *dns.Message) network.Client {
+	if h.Routes == nil || req == nil || len(req.Question) == 0 {
+		return h.Upstream
+	}
+
+	return h.Routes.Route(req.Question[0].Name)
+}
+
+// upstreamConn retrieves a connection from the upstream client for the request. Clients that
+// select upstreams by key are keyed by the request's query name.
+func (h *DNSProxyHandler) upstreamConn(ctx context.Context, req *dns.Message) (*network.PersistentConn, error) {
+	client := h.route(req)
+
+	if keyed, ok := client.(network.KeyedClient); ok && req != nil && len(req.Question) > 0 {
+		return keyed.ConnFor(ctx, dns.CanonicalName(req.Question[0].Name))
+	}
+
+	return client.Conn(ctx)
+}
+
+// parseRequest parses the length-prefixed client request, only if the handler needs to understand
+// its contents. It returns nil if parsing is unnecessary or if the request is malformed; such
+// requests are still proxied to the upstream, which is better positioned to respond to them.
+func (h *DNSProxyHandler) parseRequest(clientReq []byte) *dns.Message {
+	_, keyed := h.Upstream.(network.KeyedClient)
+
+	if h.Cache == nil && h.Routes == nil && !keyed {
+		return nil
+	}
+
+	req, err := dns.Parse(clientReq[2:])
+	if err != nil {
+		h.Logger.Debug("dns_proxy: failed to parse client request: err=%v", err)
+		return nil
+	}
+
+	return req
+}
+
+// cacheGet attempts to retrieve a length-prefixed response to the request from the response cache.
+// Popular responses nearing expiry are prefetched from the upstream in the background.
+func (h *DNSProxyHandler) cacheGet(client net.Conn, req *dns.Message, clientReq []byte) ([]byte, bool) {
+	if h.Cache == nil || req == nil {
+		return nil, false
+	}
+
+	resp, prefetch, ok := h.Cache.Get(req)
+	if !ok {
+		h.ProxyHook.EmitCacheMiss(client.RemoteAddr())
+		return nil, false
+	}
+
+	h.ProxyHook.EmitCacheHit(client.RemoteAddr())
+	h.Logger.Debug("dns_proxy: serving response from cache: response_bytes=%d", len(resp))
+
+	if prefetch && h.refresh(client, req, clientReq) {
+		h.ProxyHook.EmitCachePrefetch(client.RemoteAddr())
+		h.Logger.Debug("dns_proxy: prefetching popular cached response nearing expiry")
+	}
+
+	return frame(resp), true
+}
+
+// cacheGetStale attempts to retrieve a length-prefixed, stale response to the request from the
+// response cache.
+func (h *DNSProxyHandler) cacheGetStale(req *dns.Message) ([]byte, bool) {
+	if h.Cache == nil || req == nil {
+		return nil, false
+	}
+
+	resp, ok := h.Cache.GetStale(req)
+	if !ok {
+		return nil, false
+	}
+
+	return frame(resp), true
+}
+
+// cacheSet caches a length-prefixed upstream response to the request, if it is cacheable.
+func (h *DNSProxyHandler) cacheSet(req *dns.Message, resp []byte) {
+	if h.Cache == nil || req == nil {
+		return
+	}
+
+	h.Cache.Set(req, resp[2:])
+}
+
+// truncateUDP ensures that a response to a UDP client is no larger than the maximum payload size
+// advertised by the client. Oversized responses are truncated with the TC bit set, signaling the
+// client to retry over TCP.
+func (h *DNSProxyHandler) truncateUDP(req *dns.Message, clientReq []byte, resp []byte) []byte {
+	// Every client accepts payloads of the minimum size; avoid parsing in the common case.
+	if len(resp) <= dns.MinUDPSize {
+		return resp
+	}
+
+	limit := dns.MinUDPSize
+
+	if req == nil {
+		req, _ = dns.Parse(clientReq[2:])
+	}
+
+	if req != nil {
+		limit = req.MaxUDPSize()
+	}
+
+	if len(resp) <= limit {
+		return resp
+	}
+
+	h.Logger.Debug(
+		"dns_proxy: truncating oversized UDP response: response_bytes=%d limit=%d",
+		len(resp),
+		limit,
+	)
+
+	msg, err := dns.Parse(resp)
+	if err == nil {
+		return msg.Truncate(limit)
+	}
+
+	// The upstream response is not understood; fall back to an empty, truncated response
+	// created from the request, or from the response's header alone if the request is not
+	// understood either.
+	truncated, err := dns.NewErrorResponse(clientReq[2:], dns.RcodeSuccess)
+	if err != nil {
+		truncated = make([]byte, dns.HeaderSize)
+		copy(truncated, resp[:4])
+	}
 
-	return resp, upstream, err
+	dns.SetTruncated(truncated)
+
+	return truncated
+}
+
+// respondFailure informs the client that its request could not be served, as configured by the
+// failure response option. Errors are not propagated, since the request has already failed.
+func (h *DNSProxyHandler) respondFailure(ctx context.Context, client net.Conn, clientReq []byte) {
+	var rcode int
+
+	switch h.Opts.FailureResponse {
+	case FailureServFail:
+		rcode = dns.RcodeServerFailure
+	case FailureRefused:
+		rcode = dns.RcodeRefused
+	default:
+		return
+	}
+
+	resp, err := dns.NewErrorResponse(clientReq[2:], rcode)
+	if err != nil {
+		h.Logger.Debug("dns_proxy: unable to create failure response: err=%v", err)
+		return
+	}
+
+	// Only stream transports expect the response's size header
+	if ctx.Value(network.TransportContextKey) != network.UDP {
+		resp = frame(resp)
+	}
+
+	if err := h.clientWrite(client, resp); err != nil {
+		h.Logger.Debug("dns_proxy: failed to write failure response: err=%v", err)
+		return
+	}
+
+	h.Logger.Debug("dns_proxy: wrote failure response to client: rcode=%d", rcode)
 }
 
 // clientWrite writes data back to the client.
@@ -268,3 +789,26 @@ func (h *DNSProxyHandler) clientWrite(conn net.Conn, upstreamResp []byte) error
 
 	return nil
 }
+
+// frame prefixes a DNS message with the two-octet length header used by stream transports.
+func frame(msg []byte) []byte {
+	framed := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[2:], msg)
+
+	return framed
+}
+
+// ParseFailureResponse parses a FailureResponse constant from its stringified representation in a
+// case-insensitive manner.
+func ParseFailureResponse(failureResponse string) (FailureResponse, bool) {
+	knownFailureResponses := []FailureResponse{FailureServFail, FailureRefused, FailureSilent}
+
+	for _, knownFailureResponse := range knownFailureResponses {
+		if strings.ToLower(failureResponse) == strings.ToLower(knownFailureResponse.String()) {
+			return knownFailureResponse, true
+		}
+	}
+
+	return FailureServFail, false
+}
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// HedgePolicy decides how long to wait for an upstream response before hedging the request, i.e.
+// sending the same request to a second upstream and serving whichever response arrives first.
+// The delay is either fixed, or derived from a percentile of recently observed upstream latency.
+type HedgePolicy struct {
+	opts HedgePolicyOpts
+
+	// Ring buffer of the most recently observed upstream latencies.
+	samples     []time.Duration
+	next        int
+	count       int
+	sampleMutex sync.Mutex
+}
+
+// HedgePolicyOpts formalizes configuration options for the hedge policy.
+type HedgePolicyOpts struct {
+	// Delay is the time to wait for an upstream response before hedging. If a percentile is
+	// also configured, it is used only until enough latency samples have been observed.
+	Delay time.Duration
+	// Percentile, between 0 and 100 exclusive, derives the hedge delay from the corresponding
+	// percentile of recently observed upstream latency. For example, a value of 95 hedges the
+	// slowest 5% of requests. Disabled if unset.
+	Percentile float64
+}
+
+const (
+	// hedgeSampleSize is the number of recent upstream latency samples from which a percentile
+	// hedge delay is derived.
+	hedgeSampleSize = 256
+	// hedgeMinSamples is the minimum number of latency samples required before a percentile
+	// hedge delay is derived.
+	hedgeMinSamples = 32
+)
+
+// NewHedgePolicy creates a hedge policy with the specified options.
+func NewHedgePolicy(opts HedgePolicyOpts) *HedgePolicy {
+	return &HedgePolicy{
+		opts:    opts,
+		samples: make([]time.Duration, hedgeSampleSize),
+	}
+}
+
+// Observe records the latency of a successful upstream transaction.
+func (p *HedgePolicy) Observe(latency time.Duration) {
+	if p.opts.Percentile <= 0 {
+		return
+	}
+
+	p.sampleMutex.Lock()
+	defer p.sampleMutex.Unlock()
+
+	p.samples[p.next] = latency
+	p.next = (p.next + 1) % len(p.samples)
+
+	if p.count < len(p.samples) {
+		p.count++
+	}
+}
+
+// Delay returns the time to wait for an upstream response before hedging the request. It returns
+// false if the request should not be hedged.
+func (p *HedgePolicy) Delay() (time.Duration, bool) {
+	if p.opts.Percentile > 0 {
+		p.sampleMutex.Lock()
+
+		if p.count >= hedgeMinSamples {
+			samples := make([]time.Duration, p.count)
+			copy(samples, p.samples[:p.count])
+			p.sampleMutex.Unlock()
+
+			sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+			return samples[int(float64(len(samples)-1)*p.opts.Percentile/100)], true
+		}
+
+		p.sampleMutex.Unlock()
+	}
+
+	return p.opts.Delay, p.opts.Delay > 0
+}
@@ -0,0 +1,244 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dotproxy/internal/dns"
+	"dotproxy/internal/log"
+	"dotproxy/internal/metrics"
+	"dotproxy/internal/network"
+)
+
+// scriptedUpstream describes how an upstream responds to a single transaction.
+type scriptedUpstream struct {
+	// IP address identifying the upstream
+	addr string
+	// Time to wait before responding
+	delay time.Duration
+	// Response code with which to respond
+	rcode int
+	// Whether to close the connection instead of responding
+	hangUp bool
+}
+
+// scriptedClient is a Client whose connections follow a script: each connection it provides
+// behaves as the next upstream in the script, and once the script is exhausted, every connection
+// behaves as the last upstream.
+type scriptedClient struct {
+	script []scriptedUpstream
+	conns  int32
+}
+
+// scriptedConn is an in-memory connection to a scripted upstream.
+type scriptedConn struct {
+	addr string
+
+	net.Conn
+}
+
+func (c *scriptedClient) Conn(ctx context.Context) (*network.PersistentConn, error) {
+	idx := int(atomic.AddInt32(&c.conns, 1)) - 1
+	if idx >= len(c.script) {
+		idx = len(c.script) - 1
+	}
+
+	local, remote := net.Pipe()
+
+	go c.script[idx].serve(remote)
+
+	return network.NewPersistentConn(
+		scriptedConn{c.script[idx].addr, local},
+		func(destroyed bool) error { return local.Close() },
+	), nil
+}
+
+func (c *scriptedClient) Stats() network.Stats {
+	return network.Stats{}
+}
+
+// serve performs a single transaction on the upstream side of a connection.
+func (u scriptedUpstream) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return
+	}
+
+	frame := make([]byte, 2+int(length))
+	binary.BigEndian.PutUint16(frame, length)
+
+	if _, err := io.ReadFull(conn, frame[2:]); err != nil || u.hangUp {
+		return
+	}
+
+	time.Sleep(u.delay)
+
+	frame[4] |= 0x80
+	frame[5] = frame[5]&0xf0 | byte(u.rcode)
+
+	conn.Write(frame)
+}
+
+func (c scriptedConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(c.addr), Port: 53}
+}
+
+// scriptedRequest creates a length-prefixed request, and its parsed form.
+func scriptedRequest(t *testing.T) ([]byte, *dns.Message) {
+	query, err := dns.NewQuery(7, "example.com", dns.TypeA)
+	if err != nil {
+		t.Fatalf("error creating query: %v", err)
+	}
+
+	req, err := dns.Parse(query)
+	if err != nil {
+		t.Fatalf("error parsing query: %v", err)
+	}
+
+	frame := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(frame, uint16(len(query)))
+
+	return append(frame, query...), req
+}
+
+// scriptedHandler creates a proxy handler for the upstream client, with the specified retry and
+// hedge policies.
+func scriptedHandler(upstream network.Client, retry *RetryPolicy, hedge *HedgePolicy) *DNSProxyHandler {
+	return &DNSProxyHandler{
+		Upstream:         upstream,
+		UpstreamCxIOHook: metrics.NewNoopConnectionIOHook(),
+		ProxyHook:        metrics.NewNoopProxyHook(),
+		Hedge:            hedge,
+		Retry:            retry,
+		Logger:           log.NewConsoleLogger(log.Error),
+	}
+}
+
+func TestProxyUpstreamHedgedServerFailure(t *testing.T) {
+	const (
+		primary = "192.0.2.1"
+		hedged  = "192.0.2.2"
+	)
+
+	noRetries := 0
+
+	cases := []struct {
+		name string
+		// Delay before the request is hedged
+		delay time.Duration
+		// Primary upstream, followed by the hedged upstream
+		script []scriptedUpstream
+		// Expected response code, and the upstream expected to provide it
+		rcode    int
+		upstream string
+		// Expected number of upstream connections
+		conns int32
+	}{
+		{
+			"hedged request answers",
+			20 * time.Millisecond,
+			[]scriptedUpstream{
+				{addr: primary, delay: 50 * time.Millisecond, rcode: dns.RcodeServerFailure},
+				{addr: hedged, delay: 150 * time.Millisecond, rcode: dns.RcodeSuccess},
+			},
+			dns.RcodeSuccess,
+			hedged,
+			2,
+		},
+		{
+			"primary request answers",
+			20 * time.Millisecond,
+			[]scriptedUpstream{
+				{addr: primary, delay: 150 * time.Millisecond, rcode: dns.RcodeNameError},
+				{addr: hedged, delay: 30 * time.Millisecond, rcode: dns.RcodeServerFailure},
+			},
+			dns.RcodeNameError,
+			primary,
+			2,
+		},
+		{
+			"both requests fail",
+			20 * time.Millisecond,
+			[]scriptedUpstream{
+				{addr: primary, delay: 50 * time.Millisecond, rcode: dns.RcodeServerFailure},
+				{addr: hedged, delay: 150 * time.Millisecond, rcode: dns.RcodeServerFailure},
+			},
+			dns.RcodeServerFailure,
+			hedged,
+			2,
+		},
+		{
+			"hedged request errors",
+			20 * time.Millisecond,
+			[]scriptedUpstream{
+				{addr: primary, delay: 50 * time.Millisecond, rcode: dns.RcodeServerFailure},
+				{addr: hedged, hangUp: true},
+			},
+			dns.RcodeServerFailure,
+			primary,
+			2,
+		},
+		{
+			"not yet hedged",
+			time.Second,
+			[]scriptedUpstream{
+				{addr: primary, rcode: dns.RcodeServerFailure},
+				{addr: hedged, rcode: dns.RcodeSuccess},
+			},
+			dns.RcodeServerFailure,
+			primary,
+			1,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := &scriptedClient{script: tc.script}
+			h := scriptedHandler(
+				upstream,
+				NewRetryPolicy(RetryPolicyOpts{MaxRetries: &noRetries}),
+				NewHedgePolicy(HedgePolicyOpts{Delay: tc.delay}),
+			)
+
+			client, _ := net.Pipe()
+			defer client.Close()
+
+			clientReq, req := scriptedRequest(t)
+
+			resp, conn, err := h.proxyUpstreamHedged(context.Background(), client, req, clientReq)
+			if err != nil {
+				t.Fatalf("error proxying request: %v", err)
+			}
+
+			msg, err := dns.Parse(resp[2:])
+			if err != nil {
+				t.Fatalf("error parsing response: %v", err)
+			}
+
+			if rcode := msg.Header.Rcode(); rcode != tc.rcode {
+				t.Errorf("unexpected response code: rcode=%d expected=%d", rcode, tc.rcode)
+			}
+
+			if addr := conn.RemoteAddr().(*net.TCPAddr).IP.String(); addr != tc.upstream {
+				t.Errorf("unexpected upstream: addr=%s expected=%s", addr, tc.upstream)
+			}
+
+			if conns := atomic.LoadInt32(&upstream.conns); conns != tc.conns {
+				t.Errorf(
+					"unexpected number of upstream connections: conns=%d expected=%d",
+					conns,
+					tc.conns,
+				)
+			}
+		})
+	}
+}
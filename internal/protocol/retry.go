@@ -0,0 +1,177 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy governs how upstream transactions that fail are retried: how many times, with what
+// delay between attempts, and within what overall deadline. Only errors that another attempt could
+// plausibly resolve, such as a pooled connection that the upstream has since closed, are retried.
+type RetryPolicy struct {
+	opts RetryPolicyOpts
+	// Maximum number of times a request is retried, resolved from the options
+	maxRetries int
+}
+
+// RetryPolicyOpts formalizes configuration options for the retry policy.
+type RetryPolicyOpts struct {
+	// MaxRetries describes the maximum allowable times the proxy server is permitted to retry a
+	// request with the upstream server(s). It is recommended to set this to a liberal value
+	// above 0; since connections are pooled and persisted over a long period of time, it is
+	// highly likely that any single proxy request will fail (due to a server-side closed
+	// connection) and will need to be retried with another connection in the pool. Defaults to
+	// 16 if unset; 0 permits only a single attempt per request.
+	MaxRetries *int
+	// Deadline is the maximum total time to spend on a request with the upstream server(s),
+	// across all attempts. Disabled if unset.
+	Deadline time.Duration
+	// InitialBackoff is the maximum delay before the second retry; the maximum delay doubles
+	// with each subsequent retry, and the actual delay is chosen at random up to the maximum.
+	// The first retry is never delayed, since it most commonly follows a stale pooled
+	// connection. Disabled if unset.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the maximum delay between retries. Defaults to 1 second.
+	MaxBackoff time.Duration
+}
+
+// upstreamSet is a set of upstream addresses that is safe for concurrent use. It tracks the
+// upstreams already tried on behalf of a single client request, across its retries and its hedged
+// request.
+type upstreamSet struct {
+	addrs map[string]bool
+	mutex sync.Mutex
+}
+
+var (
+	// errUpstreamConn describes a failure to obtain an upstream connection.
+	errUpstreamConn = errors.New("error opening upstream connection")
+	// defaultRetryPolicy is the retry policy used by handlers without one configured.
+	defaultRetryPolicy = NewRetryPolicy(RetryPolicyOpts{})
+)
+
+const (
+	// retryDistinctUpstreamAttempts is the number of connections requested from the upstream
+	// client on retry in search of an upstream that has not yet been tried for the request.
+	retryDistinctUpstreamAttempts = 3
+)
+
+// NewRetryPolicy creates a retry policy with the specified options.
+func NewRetryPolicy(opts RetryPolicyOpts) *RetryPolicy {
+	// Sane option defaults
+	maxRetries := 16
+	if opts.MaxRetries != nil {
+		maxRetries = *opts.MaxRetries
+	}
+
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = time.Second
+	}
+
+	return &RetryPolicy{opts: opts, maxRetries: maxRetries}
+}
+
+// Context derives the context for a single request from a parent context, applying the deadline.
+func (p *RetryPolicy) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	if p.opts.Deadline > 0 {
+		return context.WithTimeout(parent, p.opts.Deadline)
+	}
+
+	return context.WithCancel(parent)
+}
+
+// Retryable returns whether an error from a failed attempt may be resolved by retrying, possibly
+// with another upstream: failures to obtain a connection, connections closed or reset by the
+// upstream, and network errors, including timeouts. Cancellation, the expiry of the request
+// deadline, and upstream protocol errors are not retryable.
+func (p *RetryPolicy) Retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	retryable := []error{
+		errUpstreamConn,
+		io.EOF,
+		io.ErrUnexpectedEOF,
+		io.ErrShortWrite,
+		syscall.ECONNRESET,
+		syscall.ECONNABORTED,
+		syscall.EPIPE,
+	}
+
+	for _, target := range retryable {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr)
+}
+
+// Backoff returns the delay before the specified retry, numbered from 1.
+func (p *RetryPolicy) Backoff(retry int) time.Duration {
+	if retry <= 1 || p.opts.InitialBackoff <= 0 {
+		return 0
+	}
+
+	limit := p.opts.InitialBackoff
+	for i := 2; i < retry && limit < p.opts.MaxBackoff; i++ {
+		limit *= 2
+	}
+
+	if limit > p.opts.MaxBackoff {
+		limit = p.opts.MaxBackoff
+	}
+
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// wait blocks for the backoff before the specified retry, returning early with an error if the
+// context is done first.
+func (p *RetryPolicy) wait(ctx context.Context, retry int) error {
+	backoff := p.Backoff(retry)
+	if backoff <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newUpstreamSet creates an empty upstream set.
+func newUpstreamSet() *upstreamSet {
+	return &upstreamSet{addrs: make(map[string]bool)}
+}
+
+// add adds an upstream address to the set. It returns false if the address was already present.
+func (s *upstreamSet) add(addr string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.addrs[addr] {
+		return false
+	}
+
+	s.addrs[addr] = true
+
+	return true
+}
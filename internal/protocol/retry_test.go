@@ -0,0 +1,215 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// timeoutError is a net.Error describing a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	const upstreamURL = "https://192.0.2.1/dns-query"
+
+	policy := NewRetryPolicy(RetryPolicyOpts{})
+
+	reset := &net.OpError{
+		Op:  "read",
+		Net: "tcp",
+		Err: os.NewSyscallError("read", syscall.ECONNRESET),
+	}
+
+	cases := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"connection", fmt.Errorf("dns_proxy: %w: err=%v", errUpstreamConn, "refused"), true},
+		{"eof", fmt.Errorf("dns_proxy: error reading header: err=%w", io.EOF), true},
+		{"unexpected eof", fmt.Errorf("framing: short frame: err=%w", io.ErrUnexpectedEOF), true},
+		{"short write", io.ErrShortWrite, true},
+		{"reset", fmt.Errorf("client: error reading TCP fallback response: err=%w", reset), true},
+		{"broken pipe", syscall.EPIPE, true},
+		{"timeout", fmt.Errorf("dns_proxy: error reading header: err=%w", timeoutError{}), true},
+		{"http", &url.Error{Op: "Post", URL: upstreamURL, Err: io.EOF}, true},
+		{"cancelled", fmt.Errorf("dns_proxy: abandoned: err=%w", context.Canceled), false},
+		{"deadline", fmt.Errorf("dns_proxy: abandoned: err=%w", context.DeadlineExceeded), false},
+		{"cancelled http", &url.Error{Op: "Post", URL: upstreamURL, Err: context.Canceled}, false},
+		{"protocol", errors.New("client: unexpected HTTP response status: status=500"), false},
+		// Errors must be wrapped, rather than flattened, to be recognized.
+		{"flattened", fmt.Errorf("client: error performing HTTP request: err=%v", io.EOF), false},
+	}
+
+	for _, tc := range cases {
+		if retryable := policy.Retryable(tc.err); retryable != tc.retryable {
+			t.Errorf("unexpected retryability: case=%s retryable=%t", tc.name, retryable)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := NewRetryPolicy(RetryPolicyOpts{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	})
+
+	limits := []time.Duration{
+		0,
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		50 * time.Millisecond,
+		50 * time.Millisecond,
+	}
+
+	for idx, limit := range limits {
+		retry := idx + 1
+		distinct := make(map[time.Duration]bool)
+
+		for i := 0; i < 100; i++ {
+			backoff := policy.Backoff(retry)
+			if backoff < 0 || backoff > limit {
+				t.Fatalf("backoff out of range: retry=%d backoff=%v max=%v", retry, backoff, limit)
+			}
+
+			distinct[backoff] = true
+		}
+
+		// Backoffs are jittered, rather than always the limit.
+		if limit > 0 && len(distinct) < 2 {
+			t.Errorf("backoff not jittered: retry=%d", retry)
+		}
+	}
+
+	if backoff := NewRetryPolicy(RetryPolicyOpts{}).Backoff(10); backoff != 0 {
+		t.Errorf("expected no backoff without an initial backoff: backoff=%v", backoff)
+	}
+}
+
+func TestProxyUpstreamRetries(t *testing.T) {
+	cases := []struct {
+		name   string
+		opts   RetryPolicyOpts
+		script []scriptedUpstream
+		// Upstream expected to answer, or empty if the request is expected to fail
+		upstream string
+		// Expected number of upstream connections
+		conns int32
+	}{
+		{
+			// A retry skips the upstream that already failed, releasing its connection unused.
+			"distinct upstream",
+			RetryPolicyOpts{},
+			[]scriptedUpstream{
+				{addr: "192.0.2.1", hangUp: true},
+				{addr: "192.0.2.1"},
+				{addr: "192.0.2.2"},
+			},
+			"192.0.2.2",
+			3,
+		},
+		{
+			"retries exhausted",
+			RetryPolicyOpts{MaxRetries: retryLimit(2)},
+			[]scriptedUpstream{
+				{addr: "192.0.2.1", hangUp: true},
+				{addr: "192.0.2.2", hangUp: true},
+				{addr: "192.0.2.3", hangUp: true},
+				{addr: "192.0.2.4"},
+			},
+			"",
+			3,
+		},
+		{
+			"no retries",
+			RetryPolicyOpts{MaxRetries: retryLimit(0)},
+			[]scriptedUpstream{
+				{addr: "192.0.2.1", hangUp: true},
+				{addr: "192.0.2.2"},
+			},
+			"",
+			1,
+		},
+		{
+			// Every attempt after the first is delayed by at least the initial backoff, so
+			// the deadline expires before the retries are exhausted.
+			"deadline",
+			RetryPolicyOpts{
+				MaxRetries:     retryLimit(1000),
+				Deadline:       100 * time.Millisecond,
+				InitialBackoff: 40 * time.Millisecond,
+				MaxBackoff:     40 * time.Millisecond,
+			},
+			[]scriptedUpstream{{addr: "192.0.2.1", hangUp: true}},
+			"",
+			-1,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := &scriptedClient{script: tc.script}
+			policy := NewRetryPolicy(tc.opts)
+			h := scriptedHandler(upstream, policy, nil)
+
+			client, _ := net.Pipe()
+			defer client.Close()
+
+			clientReq, req := scriptedRequest(t)
+
+			ctx, cancel := policy.Context(context.Background())
+			defer cancel()
+
+			start := time.Now()
+			_, conn, err := h.proxyUpstream(ctx, client, req, clientReq, newUpstreamSet())
+
+			if tc.upstream == "" {
+				if err == nil {
+					t.Fatal("expected request to fail")
+				}
+			} else if err != nil {
+				t.Fatalf("error proxying request: %v", err)
+			} else if addr := conn.RemoteAddr().(*net.TCPAddr).IP.String(); addr != tc.upstream {
+				t.Errorf("unexpected upstream: addr=%s expected=%s", addr, tc.upstream)
+			}
+
+			if conns := atomic.LoadInt32(&upstream.conns); tc.conns >= 0 && conns != tc.conns {
+				t.Errorf(
+					"unexpected number of upstream connections: conns=%d expected=%d",
+					conns,
+					tc.conns,
+				)
+			}
+
+			if tc.opts.Deadline > 0 {
+				if elapsed := time.Since(start); elapsed > tc.opts.Deadline+time.Second {
+					t.Errorf("request outlived its deadline: elapsed=%v", elapsed)
+				}
+
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("expected deadline to be exceeded: err=%v", err)
+				}
+			}
+		})
+	}
+}
+
+// retryLimit returns a pointer to the maximum number of retries.
+func retryLimit(retries int) *int {
+	return &retries
+}
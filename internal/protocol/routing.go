@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"strings"
+
+	"dotproxy/internal/dns"
+	"dotproxy/internal/network"
+)
+
+// RoutingTable directs requests to upstream clients by the domain name being queried, allowing
+// queries for specific zones to be forwarded to dedicated upstreams. A request is routed to the
+// client registered for the longest domain suffix matching its query name, or to the default
+// client if no suffix matches.
+type RoutingTable struct {
+	routes   map[string]network.Client
+	fallback network.Client
+}
+
+// NewRoutingTable creates an empty routing table, routing all requests to the default client.
+func NewRoutingTable(fallback network.Client) *RoutingTable {
+	return &RoutingTable{
+		routes:   make(map[string]network.Client),
+		fallback: fallback,
+	}
+}
+
+// Add routes requests for the domain, and all of its subdomains, to the client. Domains are matched
+// case-insensitively, and may be specified with or without a trailing dot.
+func (t *RoutingTable) Add(domain string, client network.Client) {
+	t.routes[canonicalDomain(domain)] = client
+}
+
+// Route returns the client to which requests for the query name should be directed.
+func (t *RoutingTable) Route(name string) network.Client {
+	name = canonicalDomain(name)
+
+	// Walk from the full name towards the root, one label at a time, so that the first match is
+	// the longest matching suffix.
+	for {
+		if client, ok := t.routes[name]; ok {
+			return client
+		}
+
+		if name == "." {
+			return t.fallback
+		}
+
+		if end := labelEnd(name); end < len(name) {
+			name = name[end+1:]
+		} else {
+			name = ""
+		}
+
+		if name == "" {
+			name = "."
+		}
+	}
+}
+
+// canonicalDomain returns the canonical, fully qualified representation of a domain name.
+func canonicalDomain(name string) string {
+	return dns.CanonicalName(strings.TrimSuffix(name, ".") + ".")
+}
+
+// labelEnd returns the offset of the dot terminating the first label of a name in presentation
+// format, skipping over escaped dots within the label.
+func labelEnd(name string) int {
+	for idx := 0; idx < len(name); idx++ {
+		switch name[idx] {
+		case '\\':
+			idx++
+		case '.':
+			return idx
+		}
+	}
+
+	return len(name)
+}